@@ -7,31 +7,42 @@ package main
 // and let it sort them while discarding duplicates.
 
 // Necessary functions:
-// GET /status - return a status of the API, including number of images
-// GET /images - return a list of images
+// GET /status - return a status of the API, including number of images (see status.go)
+// GET /media - return a paginated list of media, filterable by date, size, extension and checksum
+// GET /scrub - return the report of the last scheduled library scrub
+// GET /similar - return clusters of visually similar images (perceptual hash)
+// POST /predict - return where files would be stored, without storing anything
+// /uploads - resumable chunked uploads for large files (see uploads.go)
 // POST /images - accept an image and store it
 // POST /images/checksum - accept a checksum and return whether it exists
+// All endpoints require an API token once one has been created (see auth.go)
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"bytes"
-	"crypto/md5"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//"path"
 	"path/filepath"
 	//"time"
 
+	"github.com/ascheel/gosort/internal/logging"
 	"github.com/ascheel/gosort/internal/sortengine"
 	"github.com/gin-gonic/gin"
 )
@@ -44,80 +55,30 @@ type Status struct {
 	Status string	`json:"status"`
 }
 
-type Stats struct {
-	Count int `json:"count"`
-}
-
 var engine *sortengine.Engine
 
-var stats = Stats{Count: 0}
 var uploadQueue *UploadQueue
-var batchInsertBuffer *BatchInsertBuffer
-
-// BatchInsertBuffer collects files for batch database insertion
-type BatchInsertBuffer struct {
-	buffer    []*sortengine.Media
-	batchSize int
-	mu        sync.Mutex
-}
-
-// NewBatchInsertBuffer creates a new batch insert buffer
-func NewBatchInsertBuffer(batchSize int) *BatchInsertBuffer {
-	return &BatchInsertBuffer{
-		buffer:    make([]*sortengine.Media, 0, batchSize),
-		batchSize: batchSize,
-	}
-}
-
-// Add adds a media file to the buffer and flushes if buffer is full
-func (b *BatchInsertBuffer) Add(media *sortengine.Media) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	
-	b.buffer = append(b.buffer, media)
-	
-	// Flush if buffer is full
-	if len(b.buffer) >= b.batchSize {
-		return b.flush()
-	}
-	
-	return nil
-}
-
-// Flush inserts all buffered files into the database
-func (b *BatchInsertBuffer) Flush() error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	return b.flush()
-}
-
-// flush performs the actual batch insert (must be called with lock held)
-func (b *BatchInsertBuffer) flush() error {
-	if len(b.buffer) == 0 {
-		return nil
-	}
-	
-	// Create a copy of the buffer for insertion
-	batch := make([]*sortengine.Media, len(b.buffer))
-	copy(batch, b.buffer)
-	
-	// Clear the buffer
-	b.buffer = b.buffer[:0]
-	
-	// Release lock before database operation
-	b.mu.Unlock()
-	err := engine.DB.AddFilesToDBBatch(batch, b.batchSize)
-	b.mu.Lock()
-	
-	return err
-}
 
 // UploadRequest represents a file upload request in the queue
+// Workers never write to the request's gin.Context: gin reuses it once the
+// handler has returned, which it does if it gives up waiting. The reply goes
+// back over ResponseChan and the handler sends it.
 type UploadRequest struct {
-	Context      *gin.Context
+	Ctx          context.Context // Cancelled once nobody is waiting for the reply
 	Media        sortengine.Media
 	FileData     *multipart.FileHeader
-	ResponseChan chan bool // Channel to signal when processing is complete
+	ResponseChan chan UploadResponse // Receives the reply when processing is complete; buffered
+	Log          *slog.Logger        // Tagged with the request ID of the upload
+
+	// Set instead of FileData when finalizing a chunked upload, whose data
+	// is already in the session's temp file
+	Session *sortengine.UploadSession
+}
+
+// UploadResponse is the HTTP status and body a worker produced for an UploadRequest
+type UploadResponse struct {
+	Status int
+	Body   gin.H
 }
 
 // RateLimiter implements a token bucket rate limiter
@@ -127,6 +88,7 @@ type RateLimiter struct {
 	refillTicker *time.Ticker
 	rate         int // Requests per second
 	capacity     int // Maximum tokens (burst capacity)
+	rejected     atomic.Int64 // Requests refused for lack of a token
 }
 
 // NewRateLimiter creates a new rate limiter
@@ -171,16 +133,25 @@ func (rl *RateLimiter) Allow() bool {
 	case <-rl.tokens:
 		return true
 	default:
+		rl.rejected.Add(1)
 		return false
 	}
 }
 
+// Rejected returns how many requests Allow has refused
+func (rl *RateLimiter) Rejected() int64 {
+	return rl.rejected.Load()
+}
+
 // UploadQueue manages a queue of upload requests with worker pool
 type UploadQueue struct {
 	queue      chan UploadRequest
 	workers    int
 	wg         sync.WaitGroup
 	rateLimiter *RateLimiter
+
+	refused atomic.Int64 // Requests Enqueue gave up on because the queue was full
+	active  atomic.Int64 // Workers currently storing an upload
 }
 
 // NewUploadQueue creates a new upload queue with worker pool
@@ -205,27 +176,36 @@ func (uq *UploadQueue) worker(id int) {
 	defer uq.wg.Done()
 	
 	for req := range uq.queue {
-		// Apply rate limiting - wait for token if needed
-		// This controls throughput (requests per second)
-		if !uq.rateLimiter.Allow() {
+		var response UploadResponse
+		if req.Ctx != nil && req.Ctx.Err() != nil {
+			// The handler stopped waiting or the client went away; for a
+			// POST /file the received data is gone with the request too
+			req.Log.Warn("Upload abandoned before a worker took it")
+			metrics.countUpload(uploadFailed)
+			response = UploadResponse{http.StatusRequestTimeout, gin.H{"status": "timeout", "reason": "Request processing timed out"}}
+		} else if !uq.rateLimiter.Allow() {
+			// Apply rate limiting - this controls throughput (requests per second)
 			// Rate limit exceeded, return 429 Too Many Requests
-			req.Context.JSON(http.StatusTooManyRequests, gin.H{
+			response = UploadResponse{http.StatusTooManyRequests, gin.H{
 				"status": "rate_limited",
 				"reason": "Too many requests, please try again later",
-			})
-			// Signal that processing is complete
-			if req.ResponseChan != nil {
-				req.ResponseChan <- false
+			}}
+			metrics.countUpload(uploadFailed)
+		} else {
+			// Process the upload
+			uq.active.Add(1)
+			if req.Session != nil {
+				response.Status, response.Body = processFinalizeRequest(req)
+			} else {
+				response.Status, response.Body = processUploadRequest(req)
 			}
-			continue
+			uq.active.Add(-1)
 		}
-		
-		// Process the upload
-		processUploadRequest(req)
-		
-		// Signal that processing is complete
+
+		// Signal that processing is complete; the channel is buffered, so
+		// this doesn't block if the handler has stopped waiting
 		if req.ResponseChan != nil {
-			req.ResponseChan <- true
+			req.ResponseChan <- response
 		}
 	}
 }
@@ -240,6 +220,7 @@ func (uq *UploadQueue) Enqueue(req UploadRequest, blocking bool, timeout time.Du
 		case uq.queue <- req:
 			return true
 		case <-time.After(timeout):
+			uq.refused.Add(1)
 			return false // Timeout
 		}
 	} else {
@@ -248,11 +229,27 @@ func (uq *UploadQueue) Enqueue(req UploadRequest, blocking bool, timeout time.Du
 		case uq.queue <- req:
 			return true
 		default:
+			uq.refused.Add(1)
 			return false // Queue is full
 		}
 	}
 }
 
+// Depth returns the number of requests waiting for a worker
+func (uq *UploadQueue) Depth() int {
+	return len(uq.queue)
+}
+
+// Active returns the number of workers currently storing an upload
+func (uq *UploadQueue) Active() int64 {
+	return uq.active.Load()
+}
+
+// Refused returns how many requests Enqueue turned away
+func (uq *UploadQueue) Refused() int64 {
+	return uq.refused.Load()
+}
+
 // Shutdown gracefully shuts down the queue
 func (uq *UploadQueue) Shutdown() {
 	close(uq.queue)
@@ -282,7 +279,26 @@ func logRequestMiddleware(c *gin.Context) {
 }
 
 func giveVersion(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"version": Version})
+	// Clients use hash_algorithm to compute checksums the server can compare
+	c.JSON(http.StatusOK, gin.H{"version": Version, "hash_algorithm": engine.Config.Server.HashAlgorithm})
+}
+
+// checkHashAlgorithm verifies that a client computed its checksums with the
+// algorithm this server stores. An empty algorithm means a client that predates
+// algorithm negotiation, which always used MD5.
+// Writes a 400 response and returns false on mismatch.
+func checkHashAlgorithm(c *gin.Context, algorithm string) bool {
+	if algorithm == "" {
+		algorithm = sortengine.LegacyHashAlgorithm
+	}
+	if !strings.EqualFold(algorithm, engine.Config.Server.HashAlgorithm) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status": "failed",
+			"reason": fmt.Sprintf("hash algorithm mismatch: client used %s, server uses %s", algorithm, engine.Config.Server.HashAlgorithm),
+		})
+		return false
+	}
+	return true
 }
 
 // pushFile handles incoming file upload requests
@@ -292,6 +308,11 @@ func pushFile(c *gin.Context) {
 	// Binary data named "file"
 	// Media struct (populated) named "media"
 
+	// Anything that returns before the upload is handed to a worker failed,
+	// unless noted otherwise; the worker counts the rest
+	result := uploadFailed
+	defer func() { metrics.countUpload(result) }()
+
 	form, err := c.MultipartForm()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": err.Error()})
@@ -304,36 +325,57 @@ func pushFile(c *gin.Context) {
 
 	err = json.Unmarshal([]byte(mediaString), &media)
 	if err != nil {
-		fmt.Printf("Error unmarshalling JSON: %s\n", err.Error())
+		reqLog(c).Warn("Error unmarshalling JSON", "error", err)
 		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": err.Error()})
 		return
 	}
 
 	data, err := c.FormFile("file")
 	if err != nil {
-		fmt.Printf("Error getting form file: %s\n", err.Error())
+		reqLog(c).Warn("Error getting form file", "error", err)
 		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": err.Error()})
 		return
 	}
 
+	if !checkHashAlgorithm(c, media.HashAlgorithm) {
+		return
+	}
+	media.HashAlgorithm = engine.Config.Server.HashAlgorithm
+	media.UploadedBy = uploaderName(c)
+
 	// Quick check if checksum exists (before queuing)
 	// This prevents unnecessary queueing of duplicate files
 	if engine.DB.ChecksumExists(media.Checksum) {
-		fmt.Printf("Checksum exists: %s\n", media.Checksum)
+		reqLog(c).Info("Checksum exists", "checksum", media.Checksum)
 		c.JSON(409, gin.H{"status": "exists"})
+		result = uploadDuplicate
+		return
+	}
+	if refuseRejected(c, media.Checksum) {
+		result = uploadRejected
 		return
 	}
 
 	// Enqueue the request for processing by worker pool
-	// We use blocking enqueue with timeout so the handler waits for a worker
-	// This provides concurrency control while still allowing the response to be sent
-	responseChan := make(chan bool, 1)
 	req := UploadRequest{
-		Context:      c,
-		Media:        media,
-		FileData:     data,
-		ResponseChan: responseChan,
+		Ctx:      c.Request.Context(),
+		Media:    media,
+		FileData: data,
+		Log:      reqLog(c),
 	}
+	if queueUpload(c, req) {
+		result = ""
+	}
+}
+
+// queueUpload hands req to the upload workers, waits until one has processed
+// it and sends its response. Returns false, having sent a 503, if no worker
+// took it in time.
+// We use blocking enqueue with timeout so the handler waits for a worker
+// This provides concurrency control while still allowing the response to be sent
+func queueUpload(c *gin.Context, req UploadRequest) bool {
+	responseChan := make(chan UploadResponse, 1)
+	req.ResponseChan = responseChan
 
 	// Try to enqueue the request (blocking with 30 second timeout)
 	// This allows the handler to wait for a worker while still providing
@@ -344,65 +386,76 @@ func pushFile(c *gin.Context) {
 			"status": "queue_full",
 			"reason": "Server is busy, please try again later",
 		})
-		return
+		return false
 	}
 
 	// Wait for worker to finish processing
-	// The response will be sent by processUploadRequest()
 	// We wait here to ensure the HTTP connection stays open
 	select {
-	case <-responseChan:
-		// Processing complete, response already sent
-		return
+	case response := <-responseChan:
+		c.JSON(response.Status, response.Body)
 	case <-time.After(5 * time.Minute):
 		// Timeout waiting for response (shouldn't happen, but safety check)
+		// The worker may still store the file; its reply is dropped
 		c.JSON(http.StatusRequestTimeout, gin.H{
 			"status": "timeout",
 			"reason": "Request processing timed out",
 		})
-		return
 	}
+	return true
 }
 
 // processUploadRequest processes a file upload request
-// This is called by worker goroutines from the upload queue
-func processUploadRequest(req UploadRequest) {
-	c := req.Context
+// This is called by worker goroutines from the upload queue, and returns the
+// HTTP status and body to reply with
+func processUploadRequest(req UploadRequest) (int, gin.H) {
 	media := req.Media
 	data := req.FileData
-
-	newFilename := engine.GetNewFilename(&media)
-	tmpFilename := fmt.Sprintf("%s.download", newFilename)
-
-	// Create temp file for saving
-	// This prevents incomplete files from being saved
+	log := req.Log
+
+	// Failed unless commitUpload is reached, which counts the outcome itself
+	result := uploadFailed
+	defer func() { metrics.countUpload(result) }()
+
+	// The file is received into the uploads directory; where it goes in the
+	// library depends on the metadata read from it once it's all here (see
+	// commitUpload). Leftovers are removed on startup by cleanupTempFiles.
+	tmpFilename := sortengine.UploadTempPath(engine.Config.Server.SaveDir, "file-"+newRequestID())
+	if err := os.MkdirAll(filepath.Dir(tmpFilename), 0755); err != nil {
+		log.Error("Error creating uploads directory", "error", err)
+		return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
+	}
 
 	// Open the uploaded file
 	src, err := data.Open()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
-		fmt.Printf("Error opening uploaded file: %s\n", err.Error())
-		return
+		log.Error("Error opening uploaded file", "error", err)
+		return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
 	}
 	defer src.Close()
 
 	// Create the destination file
 	dst, err := os.Create(tmpFilename)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
-		fmt.Printf("Error creating temp file: %s\n", err.Error())
-		return
+		log.Error("Error creating temp file", "error", err)
+		return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
 	}
 	defer dst.Close()
 
 	// Create hash functions for checksum calculation during file save
 	// This allows us to calculate checksums while saving, avoiding a second file read
-	fullHash := md5.New()
-	hash100k := md5.New()
+	hasher, err := media.Hasher()
+	if err != nil {
+		dst.Close()
+		safeRemoveFile(tmpFilename, 3)
+		return http.StatusBadRequest, gin.H{"status": "failed", "reason": err.Error()}
+	}
+	fullHash := hasher.New()
+	hash100k := hasher.New()
 
 	// Create a custom reader that feeds data to both hashes during the first 100KB
 	// After 100KB, only feed to fullHash
-	var BUFSIZE int64 = 102400
+	var BUFSIZE int64 = sortengine.ShortChecksumSize
 	var bytesRead int64 = 0
 	
 	buf := make([]byte, 32*1024) // 32KB buffer for efficient copying
@@ -411,6 +464,7 @@ func processUploadRequest(req UploadRequest) {
 		nr, er := src.Read(buf)
 		if nr > 0 {
 			bytesRead += int64(nr)
+			metrics.bytesReceived.Add(int64(nr))
 			
 			// Write to file
 			nw, ew := dst.Write(buf[0:nr])
@@ -423,9 +477,8 @@ func processUploadRequest(req UploadRequest) {
 			if ew != nil {
 				dst.Close()
 				safeRemoveFile(tmpFilename, 3)
-				c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": ew.Error()})
-				fmt.Printf("Error writing to file: %s\n", ew.Error())
-				return
+				log.Error("Error writing to file", "error", ew)
+				return http.StatusInternalServerError, gin.H{"status": "failed", "reason": ew.Error()}
 			}
 			
 			// Always update full hash
@@ -447,9 +500,8 @@ func processUploadRequest(req UploadRequest) {
 			if er != io.EOF {
 				dst.Close()
 				safeRemoveFile(tmpFilename, 3)
-				c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": er.Error()})
-				fmt.Printf("Error reading from upload: %s\n", er.Error())
-				return
+				log.Error("Error reading from upload", "error", er)
+				return http.StatusInternalServerError, gin.H{"status": "failed", "reason": er.Error()}
 			}
 			break
 		}
@@ -458,9 +510,8 @@ func processUploadRequest(req UploadRequest) {
 	// Close the destination file
 	if err := dst.Close(); err != nil {
 		safeRemoveFile(tmpFilename, 3)
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
-		fmt.Printf("Error closing temp file: %s\n", err.Error())
-		return
+		log.Error("Error closing temp file", "error", err)
+		return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
 	}
 
 	// Calculate checksums from the hashes
@@ -471,83 +522,158 @@ func processUploadRequest(req UploadRequest) {
 	// This ensures file integrity without reading the file twice
 	if actualChecksum != media.Checksum {
 		safeRemoveFile(tmpFilename, 3)
-		fmt.Printf("Checksum mismatch: client sent %s, but file has %s\n", media.Checksum, actualChecksum)
-		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": "checksum mismatch - file may be corrupted"})
-		return
+		log.Warn("Checksum mismatch", "client_checksum", media.Checksum, "file_checksum", actualChecksum)
+		metrics.checksumMismatches.Add(1)
+		return http.StatusBadRequest, gin.H{"status": "failed", "reason": "checksum mismatch - file may be corrupted"}
 	}
 
 	// Update the checksum100k in media struct
 	media.Checksum100k = actualChecksum100k
 
+	result = ""
+	status, response := commitUpload(log, &media, tmpFilename)
+	if status != http.StatusOK {
+		return status, response
+	}
+
+	shortFilename := filepath.Base(data.Filename)
+	log.Info("Uploaded file", "count", metrics.accepted(), "filename", shortFilename, "stored_path", media.StoredPath)
+	return status, response
+}
+
+// storeMu is held from choosing an upload's name in the library until the
+// file has that name, so two uploads can't choose the same one
+var storeMu sync.Mutex
+
+// commitUpload stores a fully received file whose checksum has been verified
+// It reads the file's metadata, records the file in the database and then
+// moves it from tmpFilename to where the metadata says it belongs, which is
+// left in media.StoredPath. Both single-request and chunked uploads finish
+// here.
+// Returns the HTTP status and body to send to the client; the outcome is
+// counted in metrics.
+func commitUpload(log *slog.Logger, media *sortengine.Media, tmpFilename string) (status int, response gin.H) {
+	defer func() { metrics.countUpload(uploadOutcome(status, response)) }()
+
+	// The perceptual hash is computed from the received file; the one the
+	// client sent could claim the file resembles anything.
+	// media.IsImage() can't be used here since it stats the client's path;
+	// image.Decode sniffs the header and rejects videos immediately anyway.
+	media.PerceptualHash = ""
+	if phash, err := sortengine.PerceptualHash(tmpFilename); err == nil {
+		media.PerceptualHash = sortengine.FormatPerceptualHash(phash)
+	}
+
 	// Check for duplicate BEFORE database insert and file rename
 	// This prevents creating files that will be removed due to duplicates
-	if engine.DB.ChecksumExists(actualChecksum) {
+	if engine.DB.ChecksumExists(media.Checksum) {
 		safeRemoveFile(tmpFilename, 3)
-		fmt.Printf("Checksum exists: %s\n", actualChecksum)
-		c.JSON(409, gin.H{"status": "exists"})
-		return
+		log.Info("Checksum exists", "checksum", media.Checksum)
+		return 409, gin.H{"status": "exists"}
+	}
+	if engine.DB.ChecksumRejected(media.Checksum, media.HashAlgorithm) {
+		safeRemoveFile(tmpFilename, 3)
+		log.Info("Checksum rejected", "checksum", media.Checksum)
+		return http.StatusConflict, gin.H{"status": "rejected", "reason": rejectedReason}
 	}
 
-	// CRITICAL FIX: Insert into database FIRST, before renaming file
-	// This ensures database consistency - if DB insert fails, file remains in temp location
-	// and can be cleaned up. If we rename first and DB fails, we have orphaned files.
-	
-	// Add to batch insert buffer and flush immediately to ensure DB insert completes
-	// before file is moved to final location
-	err = batchInsertBuffer.Add(&media)
+	// What the file says decides where it goes, not what the client sent
+	extracted, err := media.ExtractReceived(tmpFilename)
+	if err != nil {
+		log.Warn("Unable to read metadata from upload, storing none", "error", err, "creation_date", media.CreationDate)
+	} else if !extracted.DateFromFile {
+		log.Info("No creation date in upload, using the client's", "creation_date", media.CreationDate)
+	} else if !extracted.ClientDate.IsZero() && !extracted.ClientDate.Equal(media.CreationDate) {
+		log.Info("Creation date differs from the client's", "creation_date", media.CreationDate, "client_creation_date", extracted.ClientDate)
+	}
+
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	// Record where the file will live on the server; media.Filename keeps the
+	// client's original path so we can tell where it came from
+	newFilename, err := engine.GetNewFilename(media)
 	if err != nil {
 		safeRemoveFile(tmpFilename, 3)
-		fmt.Printf("Error adding file to DB batch: %s\n", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
-		return
+		if errors.Is(err, sortengine.ErrAlreadyStored) {
+			// On disk without a row; scrub -reimport will pick it up
+			log.Warn("File is already stored but not in the database", "error", err)
+			return http.StatusConflict, gin.H{"status": "exists"}
+		}
+		log.Error("Unable to choose a name for the upload", "error", err)
+		return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
 	}
-	
-	// Force immediate flush to ensure database insert completes before file rename
-	// This prevents the scenario where file is renamed but DB insert is still pending
-	err = batchInsertBuffer.Flush()
+	media.StoredPath = newFilename
+
+	// Insert into the database FIRST, before renaming the file, and journal
+	// both steps in upload_intents. If the server dies in between,
+	// RecoverUploads (run from cleanupTempFiles on startup) sees how far the
+	// upload got and either finishes the rename or removes the row.
+	insertStart := time.Now()
+	intent, err := engine.DB.BeginUploadIntent(media.Checksum, tmpFilename, newFilename)
 	if err != nil {
 		safeRemoveFile(tmpFilename, 3)
-		fmt.Printf("Error flushing DB batch: %s\n", err.Error())
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
-		return
+		log.Error("Error recording upload intent", "error", err)
+		return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
+	}
+
+	inserted, err := engine.DB.CommitUploadIntent(intent, media)
+	metrics.dbInsert.Observe(time.Since(insertStart))
+	if err != nil || !inserted {
+		safeRemoveFile(tmpFilename, 3)
+		if aerr := engine.DB.AbortUploadIntent(intent); aerr != nil {
+			log.Warn("Unable to abort upload intent", "error", aerr)
+		}
+		if err != nil {
+			log.Error("Error adding file to DB", "error", err)
+			return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
+		}
+		// Another upload of the same file got there first
+		log.Info("Checksum exists", "checksum", media.Checksum)
+		return 409, gin.H{"status": "exists"}
 	}
 
 	// Only after successful database insert, move file to final destination
-	// This ensures atomicity: either both DB insert and file rename succeed, or neither does
 	if err := os.Rename(tmpFilename, newFilename); err != nil {
-		// DB insert succeeded but file rename failed - this is a critical error
-		// The file is in temp location, but DB has the record
-		// Attempt to remove from DB to maintain consistency
-		// Note: This is best-effort - if DB removal fails, manual recovery is needed
-		fmt.Printf("CRITICAL: DB insert succeeded but file rename failed for %s: %s\n", tmpFilename, err.Error())
-		fmt.Printf("File remains in temp location: %s\n", tmpFilename)
-		fmt.Printf("Attempting to remove DB record to maintain consistency...\n")
-		// Note: We don't have a DeleteFile method, so this would need to be added
-		// For now, we log it for manual recovery
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
-		return
+		// Undo the insert so the database doesn't claim a file that isn't there;
+		// the client gets an error and sends the file again
+		log.Error("Error moving upload into place", "temp_path", tmpFilename, "error", err)
+		if aerr := engine.DB.AbortUploadIntent(intent); aerr != nil {
+			// The intent stays behind and startup recovery will retry the rename
+			log.Warn("Unable to abort upload intent", "error", aerr)
+		} else {
+			safeRemoveFile(tmpFilename, 3)
+		}
+		return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
 	}
-	
-	c.JSON(http.StatusOK, gin.H{"status": "success"})
 
-	shortFilename := filepath.Base(data.Filename)
-	stats.Count += 1
-	fmt.Printf("(%03d) Uploaded file: %s\n", stats.Count, shortFilename)
+	// The file is in place; if this fails, recovery finds it there and just
+	// drops the intent
+	if err := engine.DB.FinishUploadIntent(intent); err != nil {
+		log.Warn("Unable to finish upload intent", "error", err)
+	}
+
+	return http.StatusOK, gin.H{"status": "success"}
 }
 
+// checksumExists also reports rejected checksums, so clients skip those files
+// without uploading them
 func checksumExists(checksum string) bool {
 	// db := NewDB("./gosort.db")	// Clean this up to make it secure if necessary
-	return engine.DB.ChecksumExists(checksum)
+	return engine.DB.ChecksumExists(checksum) || engine.DB.ChecksumRejected(checksum, engine.Config.Server.HashAlgorithm)
 }
 
 func checksum100kExists(checksum string) bool {
 	// db := NewDB("./gosort.db")	// Clean this up to make it secure if necessary
-	return engine.DB.Checksum100kExists(checksum)
+	return engine.DB.Checksum100kExists(checksum) || engine.DB.Checksum100kRejected(checksum, engine.Config.Server.HashAlgorithm)
 }
 
 func checkFile(c *gin.Context) {
 	status := "not found"
-	if checksumExists(c.PostForm("checksum")) {
+	checksum := c.PostForm("checksum")
+	if engine.DB.ChecksumRejected(checksum, engine.Config.Server.HashAlgorithm) {
+		status = "rejected"
+	} else if checksumExists(checksum) {
 		status = "exists"
 	}
 	c.IndentedJSON(http.StatusOK, Status{Status: status})
@@ -558,7 +684,7 @@ func checkChecksums(c *gin.Context) {
 
 	form, err := c.MultipartForm()
 	if err != nil {
-		fmt.Printf("Error getting form: %s\n", err.Error())
+		reqLog(c).Warn("Error getting form", "error", err)
 		c.String(http.StatusBadRequest, fmt.Sprintf("get multipart form err: %s", err.Error()))
 		return
 	}
@@ -568,13 +694,22 @@ func checkChecksums(c *gin.Context) {
 
 	err = json.Unmarshal([]byte(form.Value["checksums"][0]), &checksumData)
 	if err != nil {
-		fmt.Printf("Error unmarshalling JSON: %s\n", err.Error())
+		reqLog(c).Warn("Error unmarshalling JSON", "error", err)
 		c.String(http.StatusBadRequest, fmt.Sprintf("Error unmarshalling JSON: %s", err.Error()))
 		return
 	}
+	// Older clients don't send an algorithm and always used MD5
+	var algorithm string
+	if values := form.Value["algorithm"]; len(values) > 0 {
+		algorithm = values[0]
+	}
+	if !checkHashAlgorithm(c, algorithm) {
+		return
+	}
+
 	checksumList := checksumData["checksums"]
-	for _, md5sum := range checksumList {
-		results[md5sum] = checksumExists(md5sum)
+	for _, sum := range checksumList {
+		results[sum] = checksumExists(sum)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"results": results})
@@ -585,7 +720,7 @@ func checkChecksum100k(c *gin.Context) {
 
 	form, err := c.MultipartForm()
 	if err != nil {
-		fmt.Printf("Error getting form: %s\n", err.Error())
+		reqLog(c).Warn("Error getting form", "error", err)
 		c.String(http.StatusBadRequest, fmt.Sprintf("get multipart form err: %s", err.Error()))
 		return
 	}
@@ -595,37 +730,231 @@ func checkChecksum100k(c *gin.Context) {
 
 	err = json.Unmarshal([]byte(form.Value["checksums"][0]), &checksumData)
 	if err != nil {
-		fmt.Printf("Error unmarshalling JSON: %s\n", err.Error())
+		reqLog(c).Warn("Error unmarshalling JSON", "error", err)
 		c.String(http.StatusBadRequest, fmt.Sprintf("Error unmarshalling JSON: %s", err.Error()))
 		return
 	}
+	// Older clients don't send an algorithm and always used MD5
+	var algorithm string
+	if values := form.Value["algorithm"]; len(values) > 0 {
+		algorithm = values[0]
+	}
+	if !checkHashAlgorithm(c, algorithm) {
+		return
+	}
+
 	checksumList := checksumData["checksums"]
-	for _, md5sum := range checksumList {
-		results[md5sum] = checksum100kExists(md5sum)
+	for _, sum := range checksumList {
+		results[sum] = checksum100kExists(sum)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"results": results})
 }
 
+// predictFilenames reports where files would be stored if they were uploaded now
+// Takes a "media" form field holding a JSON list of media, in upload order, and
+// returns the predicted paths in the same order. Nothing is created on disk.
+func predictFilenames(c *gin.Context) {
+	var medias []sortengine.Media
+	if err := json.Unmarshal([]byte(c.PostForm("media")), &medias); err != nil {
+		reqLog(c).Warn("Error unmarshalling JSON", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+
+	// Files earlier in the list claim their names first, just like they
+	// would if uploaded one after another
+	reserved := make(map[string]bool)
+	paths := make([]string, 0, len(medias))
+	for i := range medias {
+		path, err := engine.PredictNewFilename(&medias[i], reserved)
+		if err != nil {
+			reqLog(c).Warn("Unable to predict filename", "filename", medias[i].Filename, "error", err)
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": err.Error()})
+			return
+		}
+		paths = append(paths, path)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"paths": paths})
+}
+
+// parseQueryTime parses a date or timestamp from a query parameter
+// Accepts "2006-01-02", "2006-01-02 15:04:05" and RFC3339
+// If endOfDay is set and only a date was given, the start of the following day is returned
+// so that date-only upper bounds include the whole day
+func parseQueryTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			return t.AddDate(0, 0, 1), nil
+		}
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02 15:04:05", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// listMedia handles GET /media and returns one page of media records as JSON
+// Query parameters (all optional):
+//   from, to           - create_date range; from is inclusive, to is exclusive (a bare date includes that day)
+//   min_size, max_size - size range in bytes
+//   ext                - file extension, e.g. "jpg"
+//   checksum           - exact checksum match
+//   uploaded_by        - name of the token the file was uploaded with
+//   make, model, lens  - camera make, model and lens; case-insensitive, matching part of the value
+//   page, page_size    - pagination (page is 1-based, page_size defaults to 100, max 1000)
+func listMedia(c *gin.Context) {
+	var query sortengine.MediaQuery
+	var err error
+
+	if from := c.Query("from"); from != "" {
+		query.CreatedFrom, err = parseQueryTime(from, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": fmt.Sprintf("invalid from: %s", err.Error())})
+			return
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		query.CreatedTo, err = parseQueryTime(to, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": fmt.Sprintf("invalid to: %s", err.Error())})
+			return
+		}
+	}
+	if minSize := c.Query("min_size"); minSize != "" {
+		query.MinSize, err = strconv.ParseInt(minSize, 10, 64)
+		if err != nil || query.MinSize < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": "invalid min_size"})
+			return
+		}
+	}
+	if maxSize := c.Query("max_size"); maxSize != "" {
+		query.MaxSize, err = strconv.ParseInt(maxSize, 10, 64)
+		if err != nil || query.MaxSize < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": "invalid max_size"})
+			return
+		}
+	}
+	if ext := strings.TrimPrefix(c.Query("ext"), "."); ext != "" {
+		// Extensions are only ever alphanumeric; anything else would be a LIKE wildcard
+		for _, r := range ext {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": "invalid ext"})
+				return
+			}
+		}
+		query.Extension = ext
+	}
+	query.Checksum = c.Query("checksum")
+	query.UploadedBy = c.Query("uploaded_by")
+	query.CameraMake = c.Query("make")
+	query.CameraModel = c.Query("model")
+	query.Lens = c.Query("lens")
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": "invalid page"})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", "100"))
+	if err != nil || pageSize < 1 || pageSize > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": "invalid page_size (1-1000)"})
+		return
+	}
+	query.Limit = pageSize
+	query.Offset = (page - 1) * pageSize
+
+	records, total, err := engine.DB.QueryMedia(query)
+	if err != nil {
+		reqLog(c).Error("Error querying media", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"media":     records,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// listSimilar returns clusters of visually similar images
+// Query parameters:
+//   distance - maximum Hamming distance between perceptual hashes (default: server.similarity_distance)
+func listSimilar(c *gin.Context) {
+	distance := engine.Config.Server.SimilarityDistance
+	if value := c.Query("distance"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 64 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": "distance must be an integer between 0 and 64"})
+			return
+		}
+		distance = n
+	}
+
+	records, err := engine.DB.MediaWithPerceptualHash()
+	if err != nil {
+		reqLog(c).Error("Error querying perceptual hashes", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"distance": distance,
+		"clusters": sortengine.ClusterSimilar(records, distance),
+	})
+}
+
 func printVersion() {
 	fmt.Printf("GoSort API Version: %s\n", Version)
 }
 
 func checkSaveDir() {
 	if _, err := os.Stat(engine.Config.Server.SaveDir); os.IsNotExist(err) {
-		fmt.Printf("Save directory does not exist: %s\n", engine.Config.Server.SaveDir)
+		slog.Error("Save directory does not exist", "savedir", engine.Config.Server.SaveDir)
 		os.Exit(1)
 	}
 }
 
 // cleanupTempFiles removes orphaned .download temp files on startup
 // This prevents accumulation of temp files from crashes or interrupted uploads
+// Temp files of open chunked uploads are kept so those uploads can resume
+// Uploads interrupted while being stored are recovered first, since finishing
+// them needs their temp files.
 func cleanupTempFiles(saveDir string) {
+	forward, back, err := engine.RecoverUploads()
+	if err != nil {
+		slog.Warn("Could not recover interrupted uploads, leaving temp files alone", "error", err)
+		return
+	}
+	if forward > 0 || back > 0 {
+		slog.Info("Recovered interrupted uploads", "completed", forward, "rolled_back", back)
+	}
+
+	uploadsDir := filepath.Clean(filepath.Join(saveDir, sortengine.UploadsDirName))
+	active, sessionsErr := activeUploadTempFiles()
+	if sessionsErr != nil {
+		slog.Warn("Could not read upload sessions, leaving chunked uploads alone", "dir", uploadsDir, "error", sessionsErr)
+	}
+
 	count := 0
-	err := filepath.Walk(saveDir, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(saveDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Continue on errors
 		}
+		if info.IsDir() && sessionsErr != nil && filepath.Clean(path) == uploadsDir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && info.Name() == sortengine.QuarantineDirName {
+			// Quarantined temp files are kept for the admin to look at
+			return filepath.SkipDir
+		}
+		if active[filepath.Clean(path)] {
+			return nil
+		}
 		if !info.IsDir() && strings.HasSuffix(path, ".download") {
 			if err := os.Remove(path); err == nil {
 				count++
@@ -634,9 +963,61 @@ func cleanupTempFiles(saveDir string) {
 		return nil
 	})
 	if err != nil {
-		fmt.Printf("Warning: Error during temp file cleanup: %v\n", err)
+		slog.Warn("Error during temp file cleanup", "error", err)
 	} else if count > 0 {
-		fmt.Printf("Cleaned up %d orphaned temp files\n", count)
+		slog.Info("Cleaned up orphaned temp files", "count", count)
+	}
+}
+
+// printMigrationStatus reports the schema version of the configured database
+// and which migrations are applied or pending, without applying any
+func printMigrationStatus(config *sortengine.Config) {
+	db, err := sortengine.OpenDB(config.Server.DBFile, config)
+	if err != nil {
+		fmt.Printf("Error opening database: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer db.DbClose()
+
+	current, infos, err := db.MigrationStatus()
+	if err != nil {
+		fmt.Printf("Error reading migration status: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Database:       %s\n", config.Server.DBFile)
+	fmt.Printf("Schema version: %d (latest: %d)\n\n", current, sortengine.LatestSchemaVersion())
+	pending := 0
+	for _, info := range infos {
+		state := "applied"
+		if !info.Applied {
+			state = "pending"
+			pending++
+		}
+		fmt.Printf("  [%s] %3d  %s\n", state, info.Version, info.Description)
+	}
+	if pending > 0 {
+		fmt.Printf("\n%d pending migration(s) will be applied the next time the server starts.\n", pending)
+	}
+}
+
+// runReorganize moves the library to the configured layout and reports the result
+func runReorganize(dryRun bool, journalPath string) {
+	if journalPath == "" {
+		journalPath = engine.DefaultJournalPath()
+	}
+	result, err := engine.Reorganize(dryRun, journalPath)
+	if err != nil {
+		fmt.Printf("Error reorganizing library: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if dryRun {
+		fmt.Printf("Dry run complete: %d would move, %d unchanged, %d skipped\n", result.Moved, result.Unchanged, result.Skipped)
+		return
+	}
+	fmt.Printf("Reorganize complete: %d moved, %d unchanged, %d skipped\n", result.Moved, result.Unchanged, result.Skipped)
+	if result.Moved > 0 {
+		fmt.Printf("To undo, run: api -undo-reorganize %s\n", journalPath)
 	}
 }
 
@@ -656,7 +1037,7 @@ func safeRemoveFile(filename string, maxRetries int) error {
 		}
 	}
 	// Log persistent failures for manual intervention
-	fmt.Printf("Warning: Failed to remove file %s after %d retries: %v\n", filename, maxRetries, lastErr)
+	slog.Warn("Failed to remove file", "path", filename, "retries", maxRetries, "error", lastErr)
 	return lastErr
 }
 
@@ -667,14 +1048,45 @@ func main() {
 	flags := &sortengine.ConfigFlags{}
 	var uploadWorkers int
 	var rateLimit int
+	var migrateStatus bool
+	var rehash bool
+	var addTokenName string
+	var revokeTokenName string
+	var force bool
+	var listTokensFlag bool
+	var reorganize bool
+	var dryRun bool
+	var journalPath string
+	var undoJournal string
+	var scrub bool
+	var reindex bool
+	var reindexWorkers int
+	var scrubOpts sortengine.ScrubOptions
 	flag.StringVar(&flags.ConfigFile, "config", "", "Path to config file (default: ~/.gosort.yml)")
 	flag.StringVar(&flags.DBFile, "database-file", "", "Database file path (overrides config)")
 	flag.StringVar(&flags.SaveDir, "savedir", "", "Directory to save files (overrides config)")
 	flag.StringVar(&flags.IP, "ip", "", "IP address to bind to (overrides config)")
 	flag.IntVar(&flags.Port, "port", 0, "Port to listen on (overrides config)")
 	flag.BoolVar(&flags.InitConfig, "init", false, "Create default config file and exit")
+	flag.StringVar(&flags.LogLevel, "log-level", "", "Log level: debug, info, warn or error (overrides config)")
+	flag.StringVar(&flags.LogFormat, "log-format", "", "Log format: text or json (overrides config)")
 	flag.IntVar(&uploadWorkers, "upload-workers", 10, "Number of concurrent upload workers")
 	flag.IntVar(&rateLimit, "rate-limit", 50, "Maximum uploads per second (rate limiting)")
+	flag.BoolVar(&migrateStatus, "migrate-status", false, "Show database schema migration status and exit")
+	flag.BoolVar(&rehash, "rehash", false, "Recompute checksums of stored files hashed with a different algorithm than server.hash_algorithm, then exit")
+	flag.StringVar(&addTokenName, "add-token", "", "Create an API token with the given name, print it and exit")
+	flag.StringVar(&revokeTokenName, "revoke-token", "", "Revoke the API token with the given name and exit")
+	flag.BoolVar(&force, "force", false, "With -revoke-token, allow revoking the last token")
+	flag.BoolVar(&listTokensFlag, "list-tokens", false, "List API tokens and exit")
+	flag.BoolVar(&reorganize, "reorganize", false, "Move stored files to match server.layout, then exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "With -reorganize, only print the moves that would be made")
+	flag.StringVar(&journalPath, "journal", "", "With -reorganize, where to write the undo journal (default: next to the database)")
+	flag.BoolVar(&reindex, "reindex", false, "Add pictures and videos under savedir that aren't in the database yet, then exit")
+	flag.IntVar(&reindexWorkers, "reindex-workers", runtime.NumCPU(), "Number of files hashed in parallel by -reindex")
+	flag.BoolVar(&scrub, "scrub", false, "Verify every stored file against the database and report problems, then exit")
+	flag.BoolVar(&scrubOpts.Quarantine, "quarantine", false, "With -scrub, move corrupt, orphaned and leftover temp files to savedir/.quarantine")
+	flag.BoolVar(&scrubOpts.Reimport, "reimport", false, "With -scrub, add orphaned pictures and videos to the database where they are")
+	flag.StringVar(&undoJournal, "undo-reorganize", "", "Move files back to where they were before the -reorganize run that wrote the given journal, then exit")
 	flag.Parse()
 
 	// Handle -init flag
@@ -716,33 +1128,169 @@ func main() {
 	// Apply command-line flags to override config values
 	config.ApplyFlags(flags)
 
+	if err := config.Validate(); err != nil {
+		fmt.Printf("Invalid config: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	closeLog, err := logging.Setup(config.Server.Log)
+	if err != nil {
+		fmt.Printf("Error setting up logging: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// Every checksum computed by this server uses the configured algorithm
+	sortengine.DefaultHashAlgorithm = config.Server.HashAlgorithm
+
+	// One exiftool process per worker that reads metadata, so they don't
+	// queue behind each other
+	if reindex {
+		sortengine.SetMetadataReaderSize(reindexWorkers)
+	} else {
+		sortengine.SetMetadataReaderSize(uploadWorkers)
+	}
+
+	// Handle -migrate-status flag
+	// This must run before the engine is created, since opening the engine applies migrations
+	if migrateStatus {
+		printMigrationStatus(config)
+		os.Exit(0)
+	}
+
 	// Create engine with the config
 	engine = sortengine.NewEngineWithConfig(config)
 
+	// Handle -rehash flag
+	if rehash {
+		result, err := engine.Rehash()
+		if err != nil {
+			fmt.Printf("Error rehashing library: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Rehash complete: %d updated, %d skipped, %d rejected checksums converted\n", result.Updated, result.Skipped, result.Rejected)
+		if len(result.StaleRejected) > 0 {
+			fmt.Printf("\n%d rejected checksums could not be converted because their files are gone.\n", len(result.StaleRejected))
+			fmt.Printf("They no longer block uploads; delete these files with reject again once they are re-uploaded:\n")
+			for _, r := range result.StaleRejected {
+				algorithm := r.HashAlgorithm
+				if algorithm == "" {
+					algorithm = "unknown"
+				}
+				fmt.Printf("  %s (%s)  %s\n", r.Checksum, algorithm, r.Filename)
+			}
+		}
+		os.Exit(0)
+	}
+
+	// Handle -reindex flag
+	if reindex {
+		result, err := engine.Reindex(reindexWorkers)
+		sortengine.CloseMetadataReader()
+		if err != nil {
+			fmt.Printf("Error reindexing library: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Reindex complete: %d added, %d already indexed, %d duplicates, %d rejected files removed, %d failed\n", result.Added, result.Known, result.Duplicates, result.Rejected, result.Failed)
+		os.Exit(0)
+	}
+
+	// Handle -scrub flag
+	if scrub {
+		runScrub(scrubOpts)
+	}
+
+	// Handle -reorganize and -undo-reorganize flags
+	if reorganize {
+		runReorganize(dryRun, journalPath)
+		sortengine.CloseMetadataReader()
+		os.Exit(0)
+	}
+	if undoJournal != "" {
+		restored, skipped, err := engine.UndoReorganize(undoJournal)
+		if err != nil {
+			fmt.Printf("Error undoing reorganize: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Undo complete: %d restored, %d skipped\n", restored, skipped)
+		os.Exit(0)
+	}
+
+	// Handle token management flags
+	if addTokenName != "" {
+		addToken(addTokenName)
+		os.Exit(0)
+	}
+	if revokeTokenName != "" {
+		revokeToken(revokeTokenName, force)
+		os.Exit(0)
+	}
+	if listTokensFlag {
+		listTokens()
+		os.Exit(0)
+	}
+
 	// Initialize upload queue with worker pool and rate limiting
 	// This prevents the server from being overwhelmed by too many concurrent uploads
 	uploadQueue = NewUploadQueue(uploadWorkers, rateLimit)
-	fmt.Printf("Upload queue initialized: %d workers, %d requests/second rate limit\n", uploadWorkers, rateLimit)
+	slog.Info("Upload queue initialized", "workers", uploadWorkers, "rate_limit", rateLimit)
 	
-	// Initialize batch insert buffer for efficient database writes
-	// Batch size of 100 provides good balance between performance and memory usage
-	batchInsertBuffer = NewBatchInsertBuffer(100)
-	fmt.Printf("Batch insert buffer initialized: batch size %d\n", 100)
 
 	ip := engine.Config.Server.IP
 	port := engine.Config.Server.Port
 	checkSaveDir()
 	
 	// Cleanup temp files on startup
+	expireUploadSessions()
 	cleanupTempFiles(engine.Config.Server.SaveDir)
+
+	// Abandoned chunked uploads are discarded while the server runs, too
+	go func() {
+		for range time.Tick(time.Hour) {
+			expireUploadSessions()
+		}
+	}()
+
+	// Validate has already checked the interval
+	if interval, _ := engine.Config.ScrubInterval(); interval > 0 {
+		scheduleScrubs(interval)
+	}
 	
-	router := gin.Default()
+	if engine.Config.Server.Auth == sortengine.AuthDisabled {
+		slog.Warn("Authentication is disabled (server.auth), so anyone who can reach the server can use it")
+	} else if count, err := engine.DB.TokenCount(); err == nil && count == 0 {
+		slog.Warn("No API tokens exist, so every request will be refused. Create one with -add-token, or set server.auth to disabled.")
+	}
+
+	// requestLogger takes the place of gin.Default's access log, and gin's
+	// route listing is only wanted when debugging
+	if !strings.EqualFold(engine.Config.Server.Log.Level, "debug") {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	router := gin.New()
+	router.Use(gin.Recovery())
 	//router.Use(logRequestMiddleware)
+	router.Use(requestLogger)
+	router.Use(requireToken)
 	router.POST("/file", pushFile)
 	router.GET("/file", checkFile)
 	router.POST("/checksums", checkChecksums)
 	router.POST("/checksum100k", checkChecksum100k)
 	router.GET("/version", giveVersion)
+	router.GET("/metrics", serveMetrics)
+	router.GET("/status", getStatus)
+	router.GET("/media", listMedia)
+	router.DELETE("/media/:checksum", deleteMedia)
+	router.GET("/media/:checksum/metadata", getMediaMetadata)
+	router.GET("/rejected", listRejected)
+	router.DELETE("/rejected/:checksum", unrejectChecksum)
+	router.GET("/similar", listSimilar)
+	router.GET("/scrub", getScrubReport)
+	router.POST("/predict", predictFilenames)
+	router.POST("/uploads", startUpload)
+	router.GET("/uploads/:id", getUpload)
+	router.PUT("/uploads/:id", putUploadChunk)
+	router.POST("/uploads/:id/finalize", finalizeUpload)
+	router.DELETE("/uploads/:id", cancelUpload)
 	
 	// Create HTTP server with graceful shutdown support
 	srv := &http.Server{
@@ -754,12 +1302,29 @@ func main() {
 		IdleTimeout:  120 * time.Second,
 	}
 	
+	// Serve HTTPS when a certificate is configured
+	tlsConfig, err := serverTLSConfig(&engine.Config.Server)
+	if err != nil {
+		logging.Fatal("Error configuring TLS", "error", err)
+	}
+	srv.TLSConfig = tlsConfig
+
 	// Start server in goroutine
 	go func() {
-		fmt.Printf("Starting server on %s:%d\n", ip, port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			fmt.Printf("Server error: %v\n", err)
-			os.Exit(1)
+		var err error
+		if srv.TLSConfig != nil {
+			slog.Info("Starting server", "address", fmt.Sprintf("https://%s:%d", ip, port))
+			if srv.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+				slog.Info("Clients must present a certificate", "ca", engine.Config.Server.TLSClientCA)
+			}
+			// The certificate is already loaded into srv.TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Starting server", "address", fmt.Sprintf("%s:%d", ip, port))
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logging.Fatal("Server error", "error", err)
 		}
 	}()
 	
@@ -768,7 +1333,7 @@ func main() {
 	signal.Notify(quit, os.Interrupt) // SIGTERM is handled by the system, SIGINT is sufficient
 	<-quit
 	
-	fmt.Printf("\nReceived shutdown signal, starting graceful shutdown...\n")
+	slog.Info("Received shutdown signal, starting graceful shutdown")
 	
 	// Stop accepting new connections (give 30 seconds for in-flight requests)
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -776,18 +1341,15 @@ func main() {
 	
 	// Shutdown HTTP server (stops accepting new requests, waits for in-flight to complete)
 	if err := srv.Shutdown(ctx); err != nil {
-		fmt.Printf("Error during server shutdown: %v\n", err)
+		slog.Error("Error during server shutdown", "error", err)
 	}
 	
-	fmt.Printf("Shutting down upload queue (waiting for in-flight uploads)...\n")
+	slog.Info("Shutting down upload queue (waiting for in-flight uploads)")
+	waitForFinalizes()
 	uploadQueue.Shutdown()
 	
-	fmt.Printf("Flushing batch insert buffer...\n")
-	if err := batchInsertBuffer.Flush(); err != nil {
-		fmt.Printf("Error flushing batch insert buffer: %v\n", err)
-	}
-	
-	sortengine.GetExiftool().Close()
-	fmt.Printf("Graceful shutdown complete.\n")
+	sortengine.CloseMetadataReader()
+	slog.Info("Graceful shutdown complete")
+	closeLog()
 	os.Exit(0)
 }
@@ -0,0 +1,105 @@
+package main
+
+// Token authentication
+// Clients send "Authorization: Bearer <token>" with every request. Tokens are
+// managed with -add-token, -revoke-token and -list-tokens and looked up in the
+// database on each request, so revoking one takes effect immediately without
+// restarting the server. Running without tokens has to be asked for with
+// server.auth: disabled; a server that has none otherwise refuses everything.
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+	"github.com/gin-gonic/gin"
+)
+
+// tokenNameKey is the gin context key holding the name of the request's token
+const tokenNameKey = "token_name"
+
+// requireToken is middleware that rejects requests without a valid token
+func requireToken(c *gin.Context) {
+	if engine.Config.Server.Auth == sortengine.AuthDisabled {
+		c.Next()
+		return
+	}
+
+	token := ""
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+
+	name, err := engine.DB.LookupToken(token)
+	if err != nil {
+		reqLog(c).Error("Error checking token", "error", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	if name != "" {
+		c.Set(tokenNameKey, name)
+		c.Next()
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "unauthorized", "reason": "missing or invalid API token"})
+}
+
+// uploaderName returns the name of the token a request was made with, or ""
+// if authentication is disabled
+func uploaderName(c *gin.Context) string {
+	return c.GetString(tokenNameKey)
+}
+
+// addToken creates a token and prints it; the token can't be shown again later
+func addToken(name string) {
+	token, err := engine.DB.AddToken(name)
+	if err != nil {
+		fmt.Printf("Error adding token: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Created token %q:\n\n    %s\n\n", strings.TrimSpace(name), token)
+	fmt.Printf("Put it in the client's config file as client.token. It won't be shown again.\n")
+}
+
+// revokeToken deletes a token by name
+// Revoking the last token locks every client out, so it takes force.
+func revokeToken(name string, force bool) {
+	tokens, err := engine.DB.ListTokens()
+	if err != nil {
+		fmt.Printf("Error revoking token: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if len(tokens) == 1 && tokens[0].Name == name && !force && engine.Config.Server.Auth != sortengine.AuthDisabled {
+		fmt.Printf("%q is the last token; without it the server refuses every request.\n", name)
+		fmt.Printf("Add another token first, or use -force to revoke it anyway.\n")
+		os.Exit(1)
+	}
+	if err := engine.DB.RevokeToken(name); err != nil {
+		fmt.Printf("Error revoking token: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("Revoked token %q\n", name)
+}
+
+// listTokens prints the name and creation time of every token
+func listTokens() {
+	tokens, err := engine.DB.ListTokens()
+	if err != nil {
+		fmt.Printf("Error listing tokens: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if len(tokens) == 0 {
+		if engine.Config.Server.Auth == sortengine.AuthDisabled {
+			fmt.Printf("No tokens; authentication is disabled, so the server accepts requests from anyone who can reach it.\n")
+		} else {
+			fmt.Printf("No tokens; the server refuses every request until one is created with -add-token.\n")
+		}
+		return
+	}
+	for _, t := range tokens {
+		fmt.Printf("  %-30s created %s\n", t.Name, t.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+}
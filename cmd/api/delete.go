@@ -0,0 +1,119 @@
+package main
+
+// Deleting media and managing rejected checksums
+// DELETE /media/:checksum removes a file; with ?reject=true its checksum is
+// also refused from then on. GET /rejected lists rejected checksums and
+// DELETE /rejected/:checksum allows one to be uploaded again.
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+)
+
+// rejectedReason is sent to clients uploading a rejected file
+const rejectedReason = "this file was deleted from the library and may not be uploaded again"
+
+// refuseRejected answers with 409 and returns true if checksum was rejected
+// Clients treat "rejected" like "exists": the server doesn't want the file.
+func refuseRejected(c *gin.Context, checksum string) bool {
+	if !engine.DB.ChecksumRejected(checksum, engine.Config.Server.HashAlgorithm) {
+		return false
+	}
+	reqLog(c).Info("Checksum rejected", "checksum", checksum)
+	c.JSON(http.StatusConflict, gin.H{"status": "rejected", "reason": rejectedReason})
+	return true
+}
+
+// deleteMedia handles DELETE /media/:checksum
+func deleteMedia(c *gin.Context) {
+	checksum := c.Param("checksum")
+	reject := false
+	if value := c.Query("reject"); value != "" {
+		var err error
+		if reject, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": fmt.Sprintf("invalid reject: %q", value)})
+			return
+		}
+	}
+
+	record, fileRemoved, err := engine.DeleteMedia(checksum, reject, uploaderName(c))
+	if record == nil && err == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "not found"})
+		return
+	}
+	if err != nil {
+		reqLog(c).Error("Error deleting media", "checksum", checksum, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+
+	status := "deleted"
+	if reject {
+		status = "rejected"
+	}
+	if !fileRemoved {
+		// Still report success: the row is gone and the file can't be found
+		reqLog(c).Warn("Deleted row, file not found", "checksum", checksum, "status", status)
+		c.JSON(http.StatusOK, gin.H{
+			"status":       status,
+			"media":        record,
+			"file_removed": false,
+			"warning":      "the file could not be found in the save directory; only its database row was deleted",
+		})
+		return
+	}
+	reqLog(c).Info("Deleted file", "stored_path", record.StoredPath, "status", status)
+	c.JSON(http.StatusOK, gin.H{"status": status, "media": record, "file_removed": true})
+}
+
+// getMediaMetadata handles GET /media/:checksum/metadata and returns every
+// metadata field stored for the file
+func getMediaMetadata(c *gin.Context) {
+	checksum := c.Param("checksum")
+	records, _, err := engine.DB.QueryMedia(sortengine.MediaQuery{Checksum: checksum, Limit: 1})
+	if err == nil && len(records) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"status": "not found"})
+		return
+	}
+	var metadata map[string]string
+	if err == nil {
+		metadata, err = engine.DB.MediaMetadata(checksum)
+	}
+	if err != nil {
+		reqLog(c).Error("Error reading metadata", "checksum", checksum, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"media": records[0], "metadata": metadata})
+}
+
+// listRejected handles GET /rejected
+func listRejected(c *gin.Context) {
+	rejected, err := engine.DB.RejectedChecksums()
+	if err != nil {
+		reqLog(c).Error("Error listing rejected checksums", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rejected": rejected})
+}
+
+// unrejectChecksum handles DELETE /rejected/:checksum
+func unrejectChecksum(c *gin.Context) {
+	found, err := engine.DB.UnrejectChecksum(c.Param("checksum"))
+	if err != nil {
+		reqLog(c).Error("Error unrejecting checksum", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"status": "not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success"})
+}
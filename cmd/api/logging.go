@@ -0,0 +1,84 @@
+package main
+
+// Request logging
+// requestLogger replaces gin's own access log. Every request gets an ID, taken
+// from the client's X-Request-ID header or generated here, which is sent back
+// in the response and attached to everything logged while handling it,
+// including by the upload worker that stores the file.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// loggerKey is the gin context key holding the request's logger
+const loggerKey = "logger"
+
+// requestLogger is middleware that gives each request an ID and logs it once it completes
+func requestLogger(c *gin.Context) {
+	start := time.Now()
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	c.Header(requestIDHeader, id)
+	log := slog.Default().With("request_id", id)
+	c.Set(loggerKey, log)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	attrs := []any{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", status,
+		"duration", time.Since(start),
+		"client", c.ClientIP(),
+	}
+	if name := uploaderName(c); name != "" {
+		attrs = append(attrs, "token", name)
+	}
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	log.Log(c.Request.Context(), level, "request", attrs...)
+}
+
+// reqLog returns the logger for a request, tagged with its request ID
+func reqLog(c *gin.Context) *slog.Logger {
+	if value, ok := c.Get(loggerKey); ok {
+		if log, ok := value.(*slog.Logger); ok {
+			return log
+		}
+	}
+	return slog.Default()
+}
+
+// validRequestID accepts IDs from clients only if they are short and plain,
+// since they end up in the log verbatim
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,171 @@
+package main
+
+// Prometheus metrics
+// GET /metrics serves counters and gauges in the Prometheus text format, so a
+// Prometheus server can scrape them and Grafana can alert when ingest stalls.
+// The format is simple enough to write by hand, which keeps the client
+// library out of the build.
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upload outcomes, the result label of gosort_uploads_total
+const (
+	uploadAccepted  = "accepted"
+	uploadDuplicate = "duplicate"
+	uploadRejected  = "rejected"
+	uploadFailed    = "failed"
+)
+
+// Metrics holds the counters behind /metrics
+// Queue and rate limiter counters live on those types; everything here is
+// safe to update from any goroutine.
+type Metrics struct {
+	uploads            map[string]*atomic.Int64 // By outcome; the keys are fixed at startup
+	bytesReceived      atomic.Int64             // Upload bodies and chunks, including failed ones
+	checksumMismatches atomic.Int64
+	lastUpload         atomic.Int64 // Unix time of the last accepted upload
+	dbInsert           *Histogram   // Time to record an upload in the database
+}
+
+var metrics = NewMetrics()
+
+// NewMetrics creates zeroed metrics
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		uploads:  make(map[string]*atomic.Int64),
+		dbInsert: NewHistogram([]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}),
+	}
+	for _, result := range []string{uploadAccepted, uploadDuplicate, uploadRejected, uploadFailed} {
+		m.uploads[result] = &atomic.Int64{}
+	}
+	return m
+}
+
+// countUpload records the outcome of an upload; "" records nothing, for
+// uploads whose outcome is counted elsewhere
+func (m *Metrics) countUpload(result string) {
+	if result == "" {
+		return
+	}
+	m.uploads[result].Add(1)
+	if result == uploadAccepted {
+		m.lastUpload.Store(time.Now().Unix())
+	}
+}
+
+// accepted returns the number of uploads stored since startup
+func (m *Metrics) accepted() int64 {
+	return m.uploads[uploadAccepted].Load()
+}
+
+// uploadOutcome maps a response from commitUpload to an upload outcome
+func uploadOutcome(status int, response gin.H) string {
+	switch {
+	case status == http.StatusOK:
+		return uploadAccepted
+	case status == http.StatusConflict && response["status"] == "rejected":
+		return uploadRejected
+	case status == http.StatusConflict:
+		return uploadDuplicate
+	}
+	return uploadFailed
+}
+
+// Histogram counts observations into buckets, as a Prometheus histogram
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64 // Upper bounds in seconds, ascending
+	counts []uint64  // Observations per bucket (not cumulative); the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the given upper bounds in seconds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe records one duration
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, seconds)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// write writes the histogram's _bucket, _sum and _count series
+func (h *Histogram) write(w *bytes.Buffer, name string, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, name, help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// serveMetrics handles GET /metrics
+func serveMetrics(c *gin.Context) {
+	var w bytes.Buffer
+
+	writeHeader(&w, "gosort_uploads_total", "Uploads by outcome.", "counter")
+	for _, result := range []string{uploadAccepted, uploadDuplicate, uploadRejected, uploadFailed} {
+		fmt.Fprintf(&w, "gosort_uploads_total{result=%q} %d\n", result, metrics.uploads[result].Load())
+	}
+	writeMetric(&w, "gosort_upload_bytes_total", "Bytes of upload data received, including uploads that failed.", "counter", metrics.bytesReceived.Load())
+	writeMetric(&w, "gosort_checksum_mismatches_total", "Uploads whose data didn't match the checksum the client sent.", "counter", metrics.checksumMismatches.Load())
+	writeMetric(&w, "gosort_last_upload_timestamp_seconds", "Unix time of the last accepted upload, 0 if none since startup.", "gauge", metrics.lastUpload.Load())
+
+	writeMetric(&w, "gosort_upload_queue_depth", "Uploads waiting for a worker.", "gauge", int64(uploadQueue.Depth()))
+	writeMetric(&w, "gosort_upload_queue_capacity", "Uploads that can wait for a worker before new ones are refused.", "gauge", int64(cap(uploadQueue.queue)))
+	writeMetric(&w, "gosort_upload_workers", "Workers storing uploads.", "gauge", int64(uploadQueue.workers))
+	writeMetric(&w, "gosort_upload_workers_busy", "Workers currently storing an upload.", "gauge", uploadQueue.Active())
+	writeMetric(&w, "gosort_upload_queue_full_total", "Uploads refused because the queue stayed full.", "counter", uploadQueue.Refused())
+	writeMetric(&w, "gosort_rate_limited_total", "Uploads refused by the rate limiter.", "counter", uploadQueue.rateLimiter.Rejected())
+
+	metrics.dbInsert.write(&w, "gosort_db_insert_duration_seconds", "Time taken to record an upload in the database.")
+	writeMetric(&w, "gosort_database_size_bytes", "Size of the database file, including its write-ahead log.", "gauge", databaseSize())
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", w.Bytes())
+}
+
+// writeHeader writes the HELP and TYPE lines for a metric
+func writeHeader(w *bytes.Buffer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeMetric writes a metric with a single unlabelled value
+func writeMetric(w *bytes.Buffer, name string, help string, kind string, value int64) {
+	writeHeader(w, name, help, kind)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// databaseSize returns the size of the database file and its WAL, which can
+// hold a good share of the data between checkpoints
+func databaseSize() int64 {
+	var size int64
+	for _, path := range []string{engine.Config.Server.DBFile, engine.Config.Server.DBFile + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
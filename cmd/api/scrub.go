@@ -0,0 +1,107 @@
+package main
+
+// Scrubbing from the command line (-scrub) and on a schedule (server.scrub_interval)
+// Scheduled scrubs only report; moving or importing files is left to an
+// admin running -scrub with -quarantine or -reimport.
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	lastScrubMu     sync.Mutex
+	lastScrubReport *sortengine.ScrubReport
+)
+
+// runScrub scrubs the library once and exits; the exit status is 2 if problems were found
+func runScrub(opts sortengine.ScrubOptions) {
+	report, err := engine.Scrub(opts)
+	if err != nil {
+		fmt.Printf("Error scrubbing library: %s\n", err.Error())
+		os.Exit(1)
+	}
+	printScrubReport(report)
+	if len(report.Issues) > 0 {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// printScrubReport lists every issue followed by a summary
+func printScrubReport(report *sortengine.ScrubReport) {
+	for _, issue := range report.Issues {
+		line := fmt.Sprintf("%-10s %s", issue.Kind, issue.Path)
+		if issue.Path == "" {
+			line = fmt.Sprintf("%-10s checksum %s", issue.Kind, issue.Checksum)
+		}
+		if issue.Detail != "" {
+			line += " (" + issue.Detail + ")"
+		}
+		if issue.Action != "" {
+			line += " [" + issue.Action + "]"
+		}
+		fmt.Println(line)
+	}
+
+	fmt.Printf("\n=== Scrub Complete (%s) ===\n", report.Finished.Sub(report.Started).Round(time.Second))
+	fmt.Printf("Verified:    %d of %d\n", report.OK, report.Checked)
+	fmt.Printf("Missing:     %d\n", report.Count(sortengine.ScrubMissing))
+	fmt.Printf("Corrupt:     %d\n", report.Count(sortengine.ScrubCorrupt))
+	fmt.Printf("Orphans:     %d\n", report.Count(sortengine.ScrubOrphan))
+	fmt.Printf("Duplicates:  %d\n", report.Count(sortengine.ScrubDuplicate))
+	fmt.Printf("Temp files:  %d\n", report.Count(sortengine.ScrubTemp))
+	fmt.Printf("Rejected:    %d\n", report.Count(sortengine.ScrubRejected))
+}
+
+// logScrubReport logs each issue of a scheduled scrub and a summary
+func logScrubReport(report *sortengine.ScrubReport) {
+	for _, issue := range report.Issues {
+		slog.Warn("Scrub found a problem", "kind", issue.Kind, "path", issue.Path, "checksum", issue.Checksum, "detail", issue.Detail)
+	}
+	slog.Info("Scheduled scrub complete",
+		"duration", report.Finished.Sub(report.Started).Round(time.Second),
+		"verified", report.OK,
+		"checked", report.Checked,
+		"issues", len(report.Issues),
+	)
+}
+
+// scheduleScrubs scrubs the library every interval while the server runs
+func scheduleScrubs(interval time.Duration) {
+	slog.Info("Library scrub scheduled", "interval", interval)
+	go func() {
+		for range time.Tick(interval) {
+			report, err := engine.Scrub(sortengine.ScrubOptions{})
+			if err != nil {
+				slog.Error("Scheduled scrub failed", "error", err)
+				continue
+			}
+			logScrubReport(report)
+
+			lastScrubMu.Lock()
+			lastScrubReport = report
+			lastScrubMu.Unlock()
+		}
+	}()
+}
+
+// getScrubReport handles GET /scrub and returns the last scheduled scrub's report
+func getScrubReport(c *gin.Context) {
+	lastScrubMu.Lock()
+	report := lastScrubReport
+	lastScrubMu.Unlock()
+
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "not found", "reason": "no scrub has run since the server started"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
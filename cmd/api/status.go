@@ -0,0 +1,54 @@
+package main
+
+// Server status
+// GET /status reports what is in the library (counts by type and by month,
+// total size, the last upload) along with what an admin checks when ingest
+// slows down: free space under SaveDir, database size and how busy the upload
+// queue is.
+
+import (
+	"net/http"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+	"github.com/gin-gonic/gin"
+)
+
+// getStatus handles GET /status
+func getStatus(c *gin.Context) {
+	library, err := engine.DB.LibraryStats()
+	if err != nil {
+		reqLog(c).Error("Error reading library statistics", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+
+	disk := gin.H{"path": engine.Config.Server.SaveDir}
+	if free, total, err := sortengine.DiskSpace(engine.Config.Server.SaveDir); err != nil {
+		// Not worth failing the whole report over
+		reqLog(c).Warn("Unable to read free disk space", "savedir", engine.Config.Server.SaveDir, "error", err)
+		disk["error"] = err.Error()
+	} else {
+		disk["free_bytes"] = free
+		disk["total_bytes"] = total
+	}
+
+	depth := uploadQueue.Depth()
+	capacity := cap(uploadQueue.queue)
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"version": Version,
+		"library": library,
+		"disk":    disk,
+		"database": gin.H{
+			"path":       engine.Config.Server.DBFile,
+			"size_bytes": databaseSize(),
+		},
+		"upload_queue": gin.H{
+			"depth":        depth,
+			"capacity":     capacity,
+			"utilization":  float64(depth) / float64(capacity),
+			"workers":      uploadQueue.workers,
+			"workers_busy": uploadQueue.Active(),
+		},
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+)
+
+// serverTLSConfig builds the server's TLS settings from server.tls_cert,
+// server.tls_key and server.tls_client_ca
+// Returns nil if TLS isn't configured, in which case the server speaks plain HTTP.
+func serverTLSConfig(config *sortengine.ServerConfig) (*tls.Config, error) {
+	if config.TLSCert == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load server.tls_cert/server.tls_key: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// With a client CA, only clients holding a certificate it signed can connect
+	if config.TLSClientCA != "" {
+		pem, err := os.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read server.tls_client_ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in server.tls_client_ca %s", config.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
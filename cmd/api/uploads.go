@@ -0,0 +1,527 @@
+package main
+
+// Resumable chunked uploads
+//
+// Large files (mostly videos) are sent in pieces instead of one POST /file:
+//
+//	POST   /uploads               - start an upload (or resume the one already open for this checksum)
+//	PUT    /uploads/:id?offset=N  - write the request body at byte offset N
+//	GET    /uploads/:id           - report the byte ranges received so far, or how finalizing went
+//	POST   /uploads/:id/finalize  - verify the checksum and store the file, in the background
+//	DELETE /uploads/:id           - abandon an upload
+//
+// Each chunk is a short request, so the server's ReadTimeout applies per chunk
+// rather than to the whole file, and a dropped connection only loses the chunk
+// in flight. Sessions live in the database, so they survive server restarts too.
+// Finalizing hashes the whole file, which takes longer than a client waits for
+// a response on a large video, so it answers 202 at once and the client polls
+// GET /uploads/:id until the file is stored.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+	"github.com/gin-gonic/gin"
+)
+
+// uploadSessionTTL is how long an upload can sit idle before it is discarded
+const uploadSessionTTL = 7 * 24 * time.Hour
+
+// maxChunkSize caps a single PUT so one chunk still fits in the server's ReadTimeout
+const maxChunkSize = 64 * 1024 * 1024
+
+// finalizeQueueTimeout is how long a finalize may wait for an upload worker
+const finalizeQueueTimeout = 10 * time.Minute
+
+// finalizeResultTTL is how long the outcome of a finished finalize is kept for
+// clients polling GET /uploads/:id
+const finalizeResultTTL = time.Hour
+
+// uploadSessionsMu serializes updates to an upload session's received ranges,
+// which are read, merged and written back. Chunk data itself is written
+// outside the lock.
+var uploadSessionsMu sync.Mutex
+
+// finalizingUploads holds the ids of uploads being finalized and
+// writingUploads counts chunks being written per upload. Both are guarded by
+// uploadSessionsMu so chunks can't be written into a file being verified.
+var finalizingUploads = make(map[string]bool)
+var writingUploads = make(map[string]int)
+
+// finalizedUploads holds the reply of each finalize that ended its session
+// (stored, already stored, or corrupted), also guarded by uploadSessionsMu.
+// A finalize that failed in a way that can be retried leaves the session open
+// instead, and the client finalizes it again.
+var finalizedUploads = make(map[string]finalizedUpload)
+
+type finalizedUpload struct {
+	UploadResponse
+	FinishedAt time.Time
+}
+
+// finalizeCtx is cancelled on shutdown so workers skip finalizes they haven't
+// started; backgroundFinalizes tracks the ones queued or running
+var finalizeCtx, stopFinalizing = context.WithCancel(context.Background())
+var backgroundFinalizes sync.WaitGroup
+
+// uploadSessionResponse is the JSON returned for an upload session
+func uploadSessionResponse(status string, session *sortengine.UploadSession) gin.H {
+	return gin.H{
+		"status":    status,
+		"upload_id": session.ID,
+		"checksum":  session.Checksum,
+		"size":      session.Size,
+		"received":  session.Received,
+		"complete":  session.Complete(),
+	}
+}
+
+// getUploadSession loads the session named in the URL, sending an error
+// response and returning nil if it can't
+func getUploadSession(c *gin.Context) *sortengine.UploadSession {
+	session, err := engine.DB.GetUploadSession(c.Param("id"))
+	if err != nil {
+		reqLog(c).Error("Error reading upload session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return nil
+	}
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "not_found", "reason": "no such upload"})
+		return nil
+	}
+	if _, err := os.Stat(session.TempPath); os.IsNotExist(err) {
+		// Temp file was removed out from under us; the client has to start over
+		reqLog(c).Warn("Temp file for upload is missing, discarding upload", "upload_id", session.ID)
+		removeUploadSession(session)
+		c.JSON(http.StatusNotFound, gin.H{"status": "not_found", "reason": "upload data is missing"})
+		return nil
+	}
+	return session
+}
+
+// removeUploadSession deletes an upload session and its temp file
+func removeUploadSession(session *sortengine.UploadSession) {
+	if err := engine.DB.DeleteUploadSession(session.ID); err != nil {
+		slog.Error("Error deleting upload session", "upload_id", session.ID, "error", err)
+	}
+	if _, err := os.Stat(session.TempPath); err == nil {
+		safeRemoveFile(session.TempPath, 3)
+	}
+}
+
+// startUpload handles POST /uploads
+// Takes the same "media" form field as POST /file. If an upload for the same
+// checksum is already open it is returned instead, with what has been received.
+func startUpload(c *gin.Context) {
+	// A started upload is counted once finalized; refusing to start one is
+	// an outcome already
+	result := uploadFailed
+	defer func() { metrics.countUpload(result) }()
+
+	var media sortengine.Media
+	if err := json.Unmarshal([]byte(c.PostForm("media")), &media); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": fmt.Sprintf("invalid media: %v", err)})
+		return
+	}
+	if media.Checksum == "" || media.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": "media must include checksum and size"})
+		return
+	}
+
+	if !checkHashAlgorithm(c, media.HashAlgorithm) {
+		return
+	}
+	media.HashAlgorithm = engine.Config.Server.HashAlgorithm
+
+	if engine.DB.ChecksumExists(media.Checksum) {
+		c.JSON(409, gin.H{"status": "exists"})
+		result = uploadDuplicate
+		return
+	}
+	if refuseRejected(c, media.Checksum) {
+		result = uploadRejected
+		return
+	}
+
+	uploadSessionsMu.Lock()
+	defer uploadSessionsMu.Unlock()
+
+	session, err := engine.DB.FindUploadSession(media.Checksum)
+	if err != nil {
+		reqLog(c).Error("Error reading upload session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	if session != nil {
+		if _, err := os.Stat(session.TempPath); err == nil && session.Size == media.Size {
+			reqLog(c).Info("Resuming upload", "upload_id", session.ID, "received", session.BytesReceived(), "size", session.Size)
+			c.JSON(http.StatusOK, uploadSessionResponse("resumed", session))
+			result = ""
+			return
+		}
+		// Missing data, or the same checksum with a different size; start over
+		removeUploadSession(session)
+	}
+
+	id, err := sortengine.NewUploadID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	now := time.Now()
+	session = &sortengine.UploadSession{
+		ID:        id,
+		Checksum:  media.Checksum,
+		Size:      media.Size,
+		Media:     media,
+		TempPath:  sortengine.UploadTempPath(engine.Config.Server.SaveDir, id),
+		Received:  make([]sortengine.ByteRange, 0),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(session.TempPath), 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	f, err := os.Create(session.TempPath)
+	if err != nil {
+		reqLog(c).Error("Error creating temp file", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	f.Close()
+
+	if err := engine.DB.CreateUploadSession(session); err != nil {
+		safeRemoveFile(session.TempPath, 3)
+		reqLog(c).Error("Error creating upload session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+
+	reqLog(c).Info("Started upload", "upload_id", session.ID, "filename", filepath.Base(media.Filename), "size", media.Size)
+	c.JSON(http.StatusCreated, uploadSessionResponse("created", session))
+	result = ""
+}
+
+// replyFinalizeStatus answers with the state of the upload's finalize if one
+// is running or has ended the session, and returns false if there is none
+// It has to be checked before the session: the session is gone once stored.
+func replyFinalizeStatus(c *gin.Context, id string) bool {
+	uploadSessionsMu.Lock()
+	finalizing := finalizingUploads[id]
+	finalized, ok := finalizedUploads[id]
+	uploadSessionsMu.Unlock()
+
+	switch {
+	case finalizing:
+		c.JSON(http.StatusAccepted, gin.H{"status": "finalizing", "upload_id": id})
+	case ok:
+		c.JSON(finalized.Status, finalized.Body)
+	default:
+		return false
+	}
+	return true
+}
+
+// getUpload handles GET /uploads/:id
+// While the upload is being finalized this answers 202 with "status":
+// "finalizing"; afterwards with what finalizing replied, e.g. 200 with
+// "status": "success".
+func getUpload(c *gin.Context) {
+	if replyFinalizeStatus(c, c.Param("id")) {
+		return
+	}
+	session := getUploadSession(c)
+	if session == nil {
+		return
+	}
+	c.JSON(http.StatusOK, uploadSessionResponse("ok", session))
+}
+
+// putUploadChunk handles PUT /uploads/:id?offset=N
+// The raw request body is written to the upload's temp file at offset N.
+// Only the bytes actually written are recorded, so a chunk cut off by a
+// dropped connection is partially kept and the rest resent later.
+func putUploadChunk(c *gin.Context) {
+	session := getUploadSession(c)
+	if session == nil {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.Query("offset"), 10, 64)
+	if err != nil || offset < 0 || offset >= session.Size {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": fmt.Sprintf("offset must be between 0 and %d", session.Size-1)})
+		return
+	}
+	length := c.Request.ContentLength
+	if length <= 0 || length > maxChunkSize || offset+length > session.Size {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": fmt.Sprintf("chunk must have a Content-Length of at most %d bytes and end within the file", maxChunkSize)})
+		return
+	}
+
+	uploadSessionsMu.Lock()
+	if finalizingUploads[session.ID] {
+		uploadSessionsMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"status": "finalizing", "reason": "upload is being finalized"})
+		return
+	}
+	writingUploads[session.ID]++
+	uploadSessionsMu.Unlock()
+	defer func() {
+		uploadSessionsMu.Lock()
+		if writingUploads[session.ID]--; writingUploads[session.ID] <= 0 {
+			delete(writingUploads, session.ID)
+		}
+		uploadSessionsMu.Unlock()
+	}()
+
+	f, err := os.OpenFile(session.TempPath, os.O_WRONLY, 0644)
+	if err != nil {
+		reqLog(c).Error("Error opening temp file for upload", "upload_id", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	written, copyErr := io.Copy(io.NewOffsetWriter(f, offset), io.LimitReader(c.Request.Body, length))
+	metrics.bytesReceived.Add(written)
+	if closeErr := f.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+
+	// Record whatever made it to disk, even if the chunk was cut short
+	uploadSessionsMu.Lock()
+	current, err := engine.DB.GetUploadSession(session.ID)
+	if err == nil && current != nil {
+		current.Received = sortengine.AddByteRange(current.Received, sortengine.ByteRange{Start: offset, End: offset + written})
+		err = engine.DB.SetUploadReceived(current.ID, current.Received)
+	}
+	uploadSessionsMu.Unlock()
+
+	if copyErr != nil {
+		reqLog(c).Warn("Error receiving chunk", "upload_id", session.ID, "offset", offset, "error", copyErr)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": copyErr.Error()})
+		return
+	}
+	if err != nil {
+		reqLog(c).Error("Error recording chunk", "upload_id", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()})
+		return
+	}
+	if current == nil {
+		// Upload was cancelled while this chunk was in flight
+		c.JSON(http.StatusNotFound, gin.H{"status": "not_found", "reason": "no such upload"})
+		return
+	}
+	if written < length {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "reason": fmt.Sprintf("chunk was cut short: received %d of %d bytes", written, length)})
+		return
+	}
+
+	c.JSON(http.StatusOK, uploadSessionResponse("ok", current))
+}
+
+// finalizeUpload handles POST /uploads/:id/finalize
+// Once every byte has arrived, the upload is handed to the upload queue like a
+// POST /file upload, so the same workers and rate limit apply to both. The
+// reply is 202 straight away; GET /uploads/:id reports the outcome. Finalizing
+// an upload that is already being finalized is answered the same way.
+func finalizeUpload(c *gin.Context) {
+	if replyFinalizeStatus(c, c.Param("id")) {
+		return
+	}
+	session := getUploadSession(c)
+	if session == nil {
+		return
+	}
+	if !session.Complete() {
+		c.JSON(http.StatusConflict, uploadSessionResponse("incomplete", session))
+		return
+	}
+
+	uploadSessionsMu.Lock()
+	if _, ok := finalizedUploads[session.ID]; ok || finalizingUploads[session.ID] {
+		// Another finalize started, or even finished, since the check above
+		uploadSessionsMu.Unlock()
+		replyFinalizeStatus(c, session.ID)
+		return
+	}
+	if writingUploads[session.ID] > 0 {
+		uploadSessionsMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"status": "busy", "reason": "chunks are still being written, try again shortly"})
+		return
+	}
+	finalizingUploads[session.ID] = true
+	uploadSessionsMu.Unlock()
+
+	req := UploadRequest{
+		Ctx:     finalizeCtx,
+		Media:   session.Media,
+		Session: session,
+		Log:     reqLog(c),
+	}
+	// Whoever completes the upload is recorded, even if someone else started it
+	req.Media.UploadedBy = uploaderName(c)
+	backgroundFinalizes.Add(1)
+	go finalizeInBackground(req)
+
+	reqLog(c).Info("Finalizing upload", "upload_id", session.ID)
+	c.JSON(http.StatusAccepted, uploadSessionResponse("finalizing", session))
+}
+
+// finalizeInBackground queues a finalize and records how it went for
+// GET /uploads/:id
+func finalizeInBackground(req UploadRequest) {
+	defer backgroundFinalizes.Done()
+	id := req.Session.ID
+
+	responseChan := make(chan UploadResponse, 1)
+	req.ResponseChan = responseChan
+	var response UploadResponse
+	if uploadQueue.Enqueue(req, true, finalizeQueueTimeout) {
+		response = <-responseChan
+	} else {
+		metrics.countUpload(uploadFailed)
+		response = UploadResponse{http.StatusServiceUnavailable, gin.H{"status": "queue_full", "reason": "Server is busy, please try again later"}}
+	}
+
+	uploadSessionsMu.Lock()
+	defer uploadSessionsMu.Unlock()
+	delete(finalizingUploads, id)
+	if current, err := engine.DB.GetUploadSession(id); err != nil || current != nil {
+		// Still open, so the client finalizes it again
+		req.Log.Warn("Finalizing upload failed", "upload_id", id, "status", response.Status, "reason", response.Body["reason"])
+		return
+	}
+	finalizedUploads[id] = finalizedUpload{response, time.Now()}
+}
+
+// waitForFinalizes is called on shutdown, before the upload queue is closed
+// Finalizes already being stored are finished; queued ones are skipped and
+// their sessions left for the client to finalize again.
+func waitForFinalizes() {
+	stopFinalizing()
+	backgroundFinalizes.Wait()
+}
+
+// processFinalizeRequest verifies a completed chunked upload and stores it
+// This is called by worker goroutines from the upload queue. The temp file's
+// checksum is checked against the one the client started the upload with,
+// then the file is stored the same way as a POST /file upload.
+// Returns the HTTP status and body to reply with.
+func processFinalizeRequest(req UploadRequest) (int, gin.H) {
+	session := req.Session
+	media := req.Media
+	log := req.Log
+
+	// Failed unless commitUpload is reached, which counts the outcome itself
+	result := uploadFailed
+	defer func() { metrics.countUpload(result) }()
+
+	hasher, err := media.Hasher()
+	if err != nil {
+		return http.StatusBadRequest, gin.H{"status": "failed", "reason": err.Error()}
+	}
+	actualChecksum, actualChecksum100k, err := sortengine.ChecksumsWith(hasher, session.TempPath)
+	if err != nil {
+		log.Error("Error hashing upload", "upload_id", session.ID, "error", err)
+		return http.StatusInternalServerError, gin.H{"status": "failed", "reason": err.Error()}
+	}
+
+	// A mismatch means some chunk was corrupted; there's no telling which,
+	// so the whole upload has to start over
+	if actualChecksum != media.Checksum {
+		log.Warn("Checksum mismatch", "upload_id", session.ID, "client_checksum", media.Checksum, "file_checksum", actualChecksum)
+		metrics.checksumMismatches.Add(1)
+		removeUploadSession(session)
+		return http.StatusBadRequest, gin.H{"status": "failed", "reason": "checksum mismatch - file may be corrupted"}
+	}
+	media.Checksum100k = actualChecksum100k
+	media.Size = session.Size
+
+	result = ""
+	status, response := commitUpload(log, &media, session.TempPath)
+	if status == http.StatusOK || status == 409 {
+		// Stored, or someone else stored it first; either way the session is done
+		removeUploadSession(session)
+	}
+	if status != http.StatusOK {
+		return status, response
+	}
+
+	log.Info("Uploaded file", "count", metrics.accepted(), "filename", filepath.Base(media.Filename), "stored_path", media.StoredPath, "chunked", true)
+	return status, response
+}
+
+// cancelUpload handles DELETE /uploads/:id
+func cancelUpload(c *gin.Context) {
+	session := getUploadSession(c)
+	if session == nil {
+		return
+	}
+
+	uploadSessionsMu.Lock()
+	defer uploadSessionsMu.Unlock()
+	if finalizingUploads[session.ID] {
+		c.JSON(http.StatusConflict, gin.H{"status": "finalizing", "reason": "upload is being finalized"})
+		return
+	}
+	// Chunks still in flight will find the session gone when they finish
+	removeUploadSession(session)
+	c.JSON(http.StatusOK, gin.H{"status": "cancelled"})
+}
+
+// expireUploadSessions discards uploads that have been idle longer than
+// uploadSessionTTL, along with their temp files, and the outcomes of finalizes
+// older than finalizeResultTTL
+func expireUploadSessions() {
+	sessions, err := engine.DB.UploadSessions()
+	if err != nil {
+		slog.Warn("Could not read upload sessions", "error", err)
+		return
+	}
+
+	uploadSessionsMu.Lock()
+	defer uploadSessionsMu.Unlock()
+
+	for id, finalized := range finalizedUploads {
+		if time.Since(finalized.FinishedAt) >= finalizeResultTTL {
+			delete(finalizedUploads, id)
+		}
+	}
+
+	count := 0
+	for _, session := range sessions {
+		if time.Since(session.UpdatedAt) < uploadSessionTTL || finalizingUploads[session.ID] || writingUploads[session.ID] > 0 {
+			continue
+		}
+		removeUploadSession(session)
+		count++
+	}
+	if count > 0 {
+		slog.Info("Discarded abandoned chunked uploads", "count", count)
+	}
+}
+
+// activeUploadTempFiles returns the temp files that belong to open upload
+// sessions, which startup cleanup must leave alone so they can be resumed
+func activeUploadTempFiles() (map[string]bool, error) {
+	sessions, err := engine.DB.UploadSessions()
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]bool)
+	for _, session := range sessions {
+		active[filepath.Clean(session.TempPath)] = true
+	}
+	return active, nil
+}
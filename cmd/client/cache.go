@@ -0,0 +1,189 @@
+package main
+
+// Local checksum cache
+// Hashing every file in full is by far the slowest part of a run, and most
+// runs are over directories that haven't changed since the last one. The
+// cache remembers the checksums of each file together with its size,
+// modification time and inode, and only trusts them while all of those still
+// match. It lives in a SQLite file next to the config file.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+	_ "modernc.org/sqlite"
+)
+
+// CacheFilename is the name of the cache database, stored next to the config file
+const CacheFilename = ".gosort-cache.db"
+
+// ChecksumCache maps files to previously computed checksums
+type ChecksumCache struct {
+	db       *sql.DB
+	filename string
+	hits     int64
+	misses   int64
+}
+
+// CachedChecksums are the values remembered for one file
+type CachedChecksums struct {
+	Checksum       string
+	Checksum100k   string
+	PerceptualHash string
+}
+
+// cacheKey identifies a version of a file. If any part of it changes the
+// file is treated as modified and hashed again.
+type cacheKey struct {
+	path      string
+	size      int64
+	mtime     int64 // Unix nanoseconds
+	inode     int64 // Stored signed; SQLite integers are 64-bit signed
+	algorithm string
+}
+
+// OpenChecksumCache opens (creating if needed) the cache database
+func OpenChecksumCache(filename string) (*ChecksumCache, error) {
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open cache %s: %v", filename, err)
+	}
+
+	// A single connection keeps concurrent workers from fighting over the
+	// write lock; lookups are fast enough that this isn't a bottleneck
+	db.SetMaxOpenConns(1)
+
+	pragmas := []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA synchronous=NORMAL",
+		"PRAGMA busy_timeout=5000",
+	}
+	for _, pragma := range pragmas {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("unable to configure cache %s: %v", filename, err)
+		}
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS
+		files (
+			path CHAR,
+			algorithm CHAR,
+			size INT,
+			mtime INT,
+			inode INT,
+			checksum CHAR,
+			checksum100k CHAR,
+			phash CHAR,
+			PRIMARY KEY (path, algorithm)
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create cache table in %s: %v", filename, err)
+	}
+
+	return &ChecksumCache{db: db, filename: filename}, nil
+}
+
+// openCache opens the client's checksum cache if it isn't open yet
+// Returns true if it was opened here, in which case the caller should
+// closeCache when done. A missing cache only costs time, so failures are
+// reported and otherwise ignored.
+func (c *Client) openCache() bool {
+	if c.cache != nil {
+		return false
+	}
+	cache, err := OpenChecksumCache(c.cachePath)
+	if err != nil {
+		slog.Warn("Checksum cache unavailable, hashing every file", "error", err)
+		return false
+	}
+	c.cache = cache
+	return true
+}
+
+// closeCache closes the client's checksum cache
+func (c *Client) closeCache() {
+	if c.cache != nil {
+		c.cache.Close()
+		c.cache = nil
+	}
+}
+
+// DefaultCachePath returns where the cache lives for a given config file
+func DefaultCachePath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), CacheFilename)
+}
+
+func newCacheKey(path string, info os.FileInfo) cacheKey {
+	return cacheKey{
+		path:      path,
+		size:      info.Size(),
+		mtime:     info.ModTime().UnixNano(),
+		inode:     int64(fileInode(path, info)),
+		algorithm: sortengine.DefaultHashAlgorithm,
+	}
+}
+
+// Get returns the cached checksums for a file, or nil if the file isn't
+// cached or has changed since it was
+func (cc *ChecksumCache) Get(path string, info os.FileInfo) *CachedChecksums {
+	key := newCacheKey(path, info)
+
+	var cached CachedChecksums
+	var size, mtime, inode int64
+	var checksum100k, phash sql.NullString
+	err := cc.db.QueryRow(
+		"SELECT size, mtime, inode, checksum, checksum100k, phash FROM files WHERE path = ? AND algorithm = ?",
+		key.path, key.algorithm,
+	).Scan(&size, &mtime, &inode, &cached.Checksum, &checksum100k, &phash)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Warn("Could not read checksum cache", "path", path, "error", err)
+		}
+		atomic.AddInt64(&cc.misses, 1)
+		return nil
+	}
+	if size != key.size || mtime != key.mtime || inode != key.inode || cached.Checksum == "" {
+		atomic.AddInt64(&cc.misses, 1)
+		return nil
+	}
+
+	cached.Checksum100k = checksum100k.String
+	cached.PerceptualHash = phash.String
+	atomic.AddInt64(&cc.hits, 1)
+	return &cached
+}
+
+// Put remembers the checksums computed for a file
+func (cc *ChecksumCache) Put(path string, info os.FileInfo, cached CachedChecksums) {
+	key := newCacheKey(path, info)
+	_, err := cc.db.Exec(`
+		INSERT INTO files (path, algorithm, size, mtime, inode, checksum, checksum100k, phash) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(path, algorithm) DO UPDATE SET
+			size = excluded.size, mtime = excluded.mtime, inode = excluded.inode,
+			checksum = excluded.checksum, checksum100k = excluded.checksum100k, phash = excluded.phash
+	`, key.path, key.algorithm, key.size, key.mtime, key.inode, cached.Checksum, cached.Checksum100k, cached.PerceptualHash)
+	if err != nil {
+		// The cache is only an optimization; the run goes on without it
+		slog.Warn("Could not update checksum cache", "path", path, "error", err)
+	}
+}
+
+// Stats returns how many lookups were answered from the cache and how many weren't
+func (cc *ChecksumCache) Stats() (hits int64, misses int64) {
+	return atomic.LoadInt64(&cc.hits), atomic.LoadInt64(&cc.misses)
+}
+
+// Close closes the cache database
+func (cc *ChecksumCache) Close() error {
+	return cc.db.Close()
+}
@@ -0,0 +1,284 @@
+package main
+
+// Chunked uploads for large files
+// Files of at least client.chunk_threshold_mb are sent in pieces through the
+// server's /uploads endpoints instead of one POST /file, as are smaller files
+// whose POST /file was cut off (see SendFile). If the connection
+// drops, only the chunk in flight is lost: the client asks the server what it
+// already has and sends the rest. Restarting the client resumes too, since the
+// server hands back the open upload for the same checksum.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+)
+
+const (
+	// uploadChunkSize is how much is sent per PUT. Small enough that a chunk
+	// fits in the server's ReadTimeout on a slow link.
+	uploadChunkSize = 4 * 1024 * 1024
+
+	// maxChunkFailures is how many requests in a row may fail before giving up
+	maxChunkFailures = 5
+
+	// finalizePollInterval is how often the client asks whether the server
+	// has stored a finalized upload
+	finalizePollInterval = 2 * time.Second
+
+	// finalizeMinRate is the slowest the server is expected to hash a
+	// finalized upload, in bytes per second; with finalizeMinWait it bounds
+	// how long the client waits for the file to be stored
+	finalizeMinRate = 10 * 1024 * 1024
+	finalizeMinWait = 10 * time.Minute
+
+	// busyUploadWait is how long the client waits for a file to show up on a
+	// server that received all of it without answering
+	busyUploadWait = time.Minute
+)
+
+// chunkThreshold returns the file size at which uploads switch to chunks
+func (c *Client) chunkThreshold() int64 {
+	return int64(c.config.Client.ChunkThresholdMB) * 1024 * 1024
+}
+
+// interruptedUpload reports whether a failed POST /file may have been cut off
+// part way, typically by the server's ReadTimeout on a slow link, or timed out
+// waiting for the reply, rather than never reaching the server
+func interruptedUpload(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// awaitBusyUpload is called when the server received all of a POST /file but
+// didn't answer. The upload is still queued or being stored, so rather than
+// sending the file again, the client checks whether it appears on the server.
+func (c *Client) awaitBusyUpload(media *sortengine.Media, err error) error {
+	slog.Warn("Server did not answer the upload in time, waiting for it to store the file", "filename", media.Filename, "error", err)
+	deadline := time.Now().Add(busyUploadWait)
+	for {
+		if c.ChecksumExists(media) {
+			slog.Info("Uploaded", "filename", media.Filename)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("server is busy and did not store %s, try again later: %v", media.Filename, err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// uploadStatus is the server's view of a chunked upload
+type uploadStatus struct {
+	Status   string                 `json:"status"`
+	Reason   string                 `json:"reason"`
+	UploadID string                 `json:"upload_id"`
+	Size     int64                  `json:"size"`
+	Received []sortengine.ByteRange `json:"received"`
+	Complete bool                   `json:"complete"`
+}
+
+// uploadRequest sends one request to the /uploads endpoints and decodes the reply
+func (c *Client) uploadRequest(method string, path string, body io.Reader, contentLength int64, contentType string) (int, *uploadStatus, error) {
+	request, err := c.newRequest(method, path, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error creating request: %v", err)
+	}
+	if contentLength >= 0 {
+		request.ContentLength = contentLength
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer response.Body.Close()
+
+	// Read response body completely to allow connection reuse
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, nil, fmt.Errorf("error reading response: %v", err)
+	}
+
+	var status uploadStatus
+	if err := json.Unmarshal(responseBody, &status); err != nil {
+		return response.StatusCode, nil, fmt.Errorf("error decoding response (HTTP %d): %v", response.StatusCode, err)
+	}
+	return response.StatusCode, &status, nil
+}
+
+// startChunkedUpload opens an upload on the server, or gets back the one
+// already open for this file
+func (c *Client) startChunkedUpload(media *sortengine.Media) (int, *uploadStatus, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	mediaJson, err := json.Marshal(media)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error marshalling media: %v", err)
+	}
+	if err := writer.WriteField("media", string(mediaJson)); err != nil {
+		return 0, nil, fmt.Errorf("error writing media field: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return 0, nil, fmt.Errorf("error closing writer: %v", err)
+	}
+	return c.uploadRequest("POST", "/uploads", &body, int64(body.Len()), writer.FormDataContentType())
+}
+
+// SendFileChunked uploads a file in chunks, resuming where the server left off
+func (c *Client) SendFileChunked(media *sortengine.Media) error {
+	file, err := os.Open(media.Filename)
+	if err != nil {
+		slog.Error("Error opening file", "filename", media.Filename, "error", err)
+		return err
+	}
+	defer file.Close()
+
+	code, upload, err := c.startChunkedUpload(media)
+	if err != nil {
+		return err
+	}
+	switch {
+	case code == http.StatusConflict && upload.Status == "exists":
+		slog.Info("Checksum already exists on server, skipping file", "filename", media.Filename)
+		return nil
+	case code == http.StatusConflict && upload.Status == "rejected":
+		slog.Info("File was deleted from the server and is rejected, skipping file", "filename", media.Filename)
+		return nil
+	case code != http.StatusOK && code != http.StatusCreated:
+		return fmt.Errorf("server refused upload (HTTP %d): %s", code, upload.Reason)
+	}
+	if upload.Status == "resumed" {
+		have := media.Size - missingBytes(upload.Received, media.Size)
+		slog.Info("Resuming upload", "filename", media.Filename, "have", have, "size", media.Size)
+	}
+
+	failures := 0
+	for {
+		// Send everything the server doesn't have yet
+		err = c.sendMissingChunks(file, upload)
+		if err == nil {
+			var done bool
+			if done, err = c.finalizeChunkedUpload(media, upload.UploadID); done {
+				return err
+			}
+		}
+
+		failures++
+		if failures >= maxChunkFailures {
+			return fmt.Errorf("giving up on %s after %d failures: %v", media.Filename, failures, err)
+		}
+		slog.Warn("Upload interrupted, retrying", "filename", media.Filename, "error", err)
+		time.Sleep(time.Duration(failures) * 2 * time.Second)
+
+		// Ask the server what it has now. An upload that vanished (expired or
+		// cancelled) is simply started again.
+		code, refreshed, rerr := c.uploadRequest("GET", "/uploads/"+upload.UploadID, nil, 0, "")
+		if rerr == nil && code == http.StatusNotFound {
+			code, refreshed, rerr = c.startChunkedUpload(media)
+			if rerr == nil && code == http.StatusConflict && refreshed.Status == "exists" {
+				slog.Info("Checksum already exists on server, skipping file", "filename", media.Filename)
+				return nil
+			}
+		}
+		// Anything else, such as a finalize still running, is left to the
+		// finalize request to sort out
+		if rerr == nil && (code == http.StatusOK || code == http.StatusCreated) && refreshed.UploadID != "" && refreshed.Status != "finalizing" {
+			upload = refreshed
+		}
+	}
+}
+
+// finalizeChunkedUpload has the server store a fully sent upload and waits
+// until it has. done is false, with the reason in err, if finalizing can be
+// tried again after refreshing what the server has received.
+// The server verifies and stores the file in the background, answering 202,
+// and reports the outcome on GET /uploads/:id; hashing a large video can take
+// minutes, so the wait grows with the file's size.
+func (c *Client) finalizeChunkedUpload(media *sortengine.Media, uploadID string) (done bool, err error) {
+	code, finalized, err := c.uploadRequest("POST", "/uploads/"+uploadID+"/finalize", nil, 0, "")
+	deadline := time.Now().Add(finalizeMinWait + time.Duration(media.Size/finalizeMinRate)*time.Second)
+	for err == nil && code == http.StatusAccepted {
+		if time.Now().After(deadline) {
+			return false, fmt.Errorf("server has not finished storing the upload")
+		}
+		time.Sleep(finalizePollInterval)
+		code, finalized, err = c.uploadRequest("GET", "/uploads/"+uploadID, nil, 0, "")
+	}
+
+	switch {
+	case err != nil:
+		return false, err
+	case code == http.StatusOK && finalized.Status == "success":
+		slog.Info("Uploaded", "filename", media.Filename)
+		return true, nil
+	case code == http.StatusConflict && finalized.Status == "exists":
+		slog.Info("Checksum already exists on server, skipping file", "filename", media.Filename)
+		return true, nil
+	case code == http.StatusConflict && finalized.Status == "rejected":
+		slog.Info("File was deleted from the server and is rejected, skipping file", "filename", media.Filename)
+		return true, nil
+	case code == http.StatusOK || code == http.StatusConflict:
+		// The upload is still open: not everything arrived, chunks are still
+		// being written, or storing it failed in a way worth another try
+		return false, fmt.Errorf("upload not finalized: %s", finalized.Status)
+	case code == http.StatusNotFound:
+		return false, fmt.Errorf("upload disappeared from server")
+	default:
+		// A checksum mismatch discards the upload server-side; don't loop on it
+		return true, fmt.Errorf("finalizing upload failed (HTTP %d): %s", code, finalized.Reason)
+	}
+}
+
+// sendMissingChunks PUTs every byte range the server hasn't received yet,
+// updating upload.Received from each reply
+func (c *Client) sendMissingChunks(file *os.File, upload *uploadStatus) error {
+	for _, missing := range sortengine.MissingByteRanges(upload.Received, upload.Size) {
+		for offset := missing.Start; offset < missing.End; offset += uploadChunkSize {
+			length := missing.End - offset
+			if length > uploadChunkSize {
+				length = uploadChunkSize
+			}
+
+			path := fmt.Sprintf("/uploads/%s?offset=%d", upload.UploadID, offset)
+			chunk := io.NewSectionReader(file, offset, length)
+			code, status, err := c.uploadRequest("PUT", path, chunk, length, "application/octet-stream")
+			if err != nil {
+				return err
+			}
+			if code != http.StatusOK {
+				return fmt.Errorf("chunk at offset %d rejected (HTTP %d): %s", offset, code, status.Reason)
+			}
+			upload.Received = status.Received
+		}
+	}
+	return nil
+}
+
+// missingBytes returns how many bytes of a file of the given size are not
+// covered by received
+func missingBytes(received []sortengine.ByteRange, size int64) int64 {
+	var total int64
+	for _, r := range sortengine.MissingByteRanges(received, size) {
+		total += r.End - r.Start
+	}
+	return total
+}
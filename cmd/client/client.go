@@ -6,11 +6,11 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/md5"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	//"net/url"
@@ -20,6 +20,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/ascheel/gosort/internal/logging"
 	"github.com/ascheel/gosort/internal/sortengine"
 	//"github.com/veandco/go-sdl2/img"
 )
@@ -35,6 +36,11 @@ type Client struct {
 	config *sortengine.Config
 	FileList []FileList
 	httpClient *http.Client // Reused HTTP client for connection pooling
+	DryRun *DryRunOptions // When set, ProcessDirectory reports what it would do instead of uploading
+	Rehash bool // Ignore cached checksums and hash every file again
+	Thin bool // Don't read metadata; files are dated by modification time and the server reads the rest
+	cache *ChecksumCache // Local checksum cache; nil if it couldn't be opened
+	cachePath string
 }
 
 type FileList struct {
@@ -56,6 +62,8 @@ func NewClient(configPath string, flags *sortengine.ConfigFlags) *Client {
 		}
 	}
 
+	client.cachePath = DefaultCachePath(configPath)
+
 	client.config, err = sortengine.LoadConfig(configPath)
 	if err != nil {
 		fmt.Printf("Error loading config: %s\n", err.Error())
@@ -68,6 +76,12 @@ func NewClient(configPath string, flags *sortengine.ConfigFlags) *Client {
 		client.config.ApplyFlags(flags)
 	}
 
+	// Records are written unbuffered, so the log file needs no closing at exit
+	if _, err := logging.Setup(client.config.Client.Log); err != nil {
+		fmt.Printf("Error setting up logging: %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	// Create a reusable HTTP client with connection pooling
 	// This allows multiple requests to reuse TCP connections, reducing latency
 	// Connection reuse eliminates TCP handshake overhead for subsequent requests
@@ -83,7 +97,7 @@ func NewClient(configPath string, flags *sortengine.ConfigFlags) *Client {
 		// Timeouts for connection establishment and responses
 		ResponseHeaderTimeout: 30 * time.Second, // Timeout for reading response headers
 		
-		// TLS settings (if HTTPS is used in future)
+		// TLS settings (used when client.host starts with https://)
 		TLSHandshakeTimeout: 10 * time.Second,
 		
 		// ExpectContinueTimeout for 100-continue requests
@@ -93,6 +107,14 @@ func NewClient(configPath string, flags *sortengine.ConfigFlags) *Client {
 		// HTTP/2 supports multiplexing and better connection reuse
 		ForceAttemptHTTP2: true,
 	}
+
+	// Custom CA bundle and client certificate, if configured
+	tlsConfig, err := clientTLSConfig(&client.config.Client)
+	if err != nil {
+		fmt.Printf("Error configuring TLS: %s\n", err.Error())
+		os.Exit(1)
+	}
+	transport.TLSClientConfig = tlsConfig
 	
 	client.httpClient = &http.Client{
 		Transport: transport,
@@ -105,23 +127,51 @@ func NewClient(configPath string, flags *sortengine.ConfigFlags) *Client {
 
 var client *Client
 
+// newRequest creates a request to the server for path (e.g. "/checksums"),
+// carrying the API token if one is configured
+func (c *Client) newRequest(method string, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, c.baseURL()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Client.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.config.Client.Token)
+	}
+	return request, nil
+}
+
 func (c *Client) AddFile(media *sortengine.Media) {
 	media.SetChecksum()
 	c.FileList = append(c.FileList, FileList{Filename: media.Filename, Media: *media, Upload: false})
 }
 
+// ServerInfo is what the server reports from GET /version
+type ServerInfo struct {
+	Version       string `json:"version"`
+	HashAlgorithm string `json:"hash_algorithm"`
+}
+
 func (c *Client) GetVersion() (string, error) {
-	var body bytes.Buffer
-	request, err := http.NewRequest("GET", fmt.Sprintf("http://%s/version", c.config.Client.Host), &body)
+	info, err := c.GetServerInfo()
 	if err != nil {
-		fmt.Printf("Error creating request: %s\n", err.Error())
 		return "", err
 	}
+	return info.Version, nil
+}
+
+// GetServerInfo asks the server for its version and the checksum algorithm it uses
+func (c *Client) GetServerInfo() (*ServerInfo, error) {
+	var body bytes.Buffer
+	request, err := c.newRequest("GET", "/version", &body)
+	if err != nil {
+		slog.Error("Error creating request", "error", err)
+		return nil, err
+	}
 	request.Header.Set("Content-Type", "application/json")
 	response, err := c.httpClient.Do(request)
 	if err != nil {
-		fmt.Printf("Error sending request: %s\n", err)
-		return "", err
+		slog.Error("Error sending request", "error", err)
+		return nil, err
 	}
 	defer response.Body.Close()
 
@@ -129,20 +179,24 @@ func (c *Client) GetVersion() (string, error) {
 	// If body is not fully read, connection cannot be reused
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		return "", fmt.Errorf("error reading response body: %v", err)
+		return nil, fmt.Errorf("error reading response body: %v", err)
 	}
 
-	type ServerVersion struct {
-		Version string `json:"version"`
+	if response.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("server requires a valid API token; set client.token in the config file")
 	}
-	var sver ServerVersion
 
-	err = json.Unmarshal(responseBody, &sver)
+	var info ServerInfo
+	err = json.Unmarshal(responseBody, &info)
 	if err != nil {
-		fmt.Printf("Error unmarshalling response: %s\n", err.Error())
-		return "", err
+		slog.Error("Error unmarshalling response", "error", err)
+		return nil, err
+	}
+	if info.HashAlgorithm == "" {
+		// Servers that predate algorithm negotiation always used MD5
+		info.HashAlgorithm = sortengine.LegacyHashAlgorithm
 	}
-	return sver.Version, nil
+	return &info, nil
 }
 
 func (c *Client) CheckForChecksums(medias []sortengine.Media) (map[string]bool, error) {
@@ -161,34 +215,37 @@ func (c *Client) CheckForChecksums(medias []sortengine.Media) (map[string]bool,
 	checksumList := ChecksumList{Checksums: make([]string, 0)}
 
 	for _, media := range medias {
-		md5sum, err := checksum(media.Filename)
+		sum, err := sortengine.Checksum(media.Filename)
 		if err != nil {
-			fmt.Printf("Error calculating checksum for %s: %s\n", media.Filename, err.Error())
+			slog.Error("Error calculating checksum", "filename", media.Filename, "error", err)
 			return make(map[string]bool, 0), err
 		}
-		fileMap[md5sum] = media
-		checksumList.Checksums = append(checksumList.Checksums, md5sum)
+		fileMap[sum] = media
+		checksumList.Checksums = append(checksumList.Checksums, sum)
 	}
 
 	dataBytes, err := json.Marshal(checksumList)
 	if err != nil {
-		fmt.Printf("Error marshalling checksums: %s\n", err.Error())
+		slog.Error("Error marshalling checksums", "error", err)
 		return make(map[string]bool, 0), err
 	}
 
 	dataPart, err := writer.CreateFormField("checksums")
 	if err != nil {
-		fmt.Printf("Error creating form field: %s\n", err.Error())
+		slog.Error("Error creating form field", "error", err)
 		return make(map[string]bool, 0), err
 	}
 
 	dataPart.Write(dataBytes)
 
+	// Tell the server which algorithm the checksums were computed with
+	writer.WriteField("algorithm", sortengine.DefaultHashAlgorithm)
+
 	writer.Close()
 
-	request, err := http.NewRequest("POST", fmt.Sprintf("http://%s/checksums", c.config.Client.Host), &body)
+	request, err := c.newRequest("POST", "/checksums", &body)
 	if err != nil {
-		fmt.Printf("Error creating request: %s\n", err.Error())
+		slog.Error("Error creating request", "error", err)
 		return make(map[string]bool, 0), err
 	}
 
@@ -197,7 +254,7 @@ func (c *Client) CheckForChecksums(medias []sortengine.Media) (map[string]bool,
 	// Send it using the shared HTTP client
 	response, err := c.httpClient.Do(request)
 	if err != nil {
-		fmt.Printf("Error sending request: %s\n", err.Error())
+		slog.Error("Error sending request", "error", err)
 		return make(map[string]bool, 0), err
 	}
 	defer response.Body.Close()
@@ -234,34 +291,37 @@ func (c *Client) CheckForChecksum100ks(medias []sortengine.Media) (map[string]bo
 	checksumList := ChecksumList{Checksums: make([]string, 0)}
 
 	for _, media := range medias {
-		md5sum, err := checksum100k(media.Filename)
+		sum, err := sortengine.Checksum(media.Filename, true)
 		if err != nil {
-			fmt.Printf("Error calculating checksum for %s: %s\n", media.Filename, err.Error())
+			slog.Error("Error calculating checksum", "filename", media.Filename, "error", err)
 			return make(map[string]bool, 0), err
 		}
-		fileMap[md5sum] = media
-		checksumList.Checksums = append(checksumList.Checksums, md5sum)
+		fileMap[sum] = media
+		checksumList.Checksums = append(checksumList.Checksums, sum)
 	}
 
 	dataBytes, err := json.Marshal(checksumList)
 	if err != nil {
-		fmt.Printf("Error marshalling checksums: %s\n", err.Error())
+		slog.Error("Error marshalling checksums", "error", err)
 		return make(map[string]bool, 0), err
 	}
 
 	dataPart, err := writer.CreateFormField("checksums")
 	if err != nil {
-		fmt.Printf("Error creating form field: %s\n", err.Error())
+		slog.Error("Error creating form field", "error", err)
 		return make(map[string]bool, 0), err
 	}
 
 	dataPart.Write(dataBytes)
 
+	// Tell the server which algorithm the checksums were computed with
+	writer.WriteField("algorithm", sortengine.DefaultHashAlgorithm)
+
 	writer.Close()
 
-	request, err := http.NewRequest("POST", fmt.Sprintf("http://%s/checksum100k", c.config.Client.Host), &body)
+	request, err := c.newRequest("POST", "/checksum100k", &body)
 	if err != nil {
-		fmt.Printf("Error creating request: %s\n", err.Error())
+		slog.Error("Error creating request", "error", err)
 		return make(map[string]bool, 0), err
 	}
 
@@ -270,7 +330,7 @@ func (c *Client) CheckForChecksum100ks(medias []sortengine.Media) (map[string]bo
 	// Send it using the shared HTTP client
 	response, err := c.httpClient.Do(request)
 	if err != nil {
-		fmt.Printf("Error sending request: %s\n", err.Error())
+		slog.Error("Error sending request", "error", err)
 		return make(map[string]bool, 0), err
 	}
 	defer response.Body.Close()
@@ -294,7 +354,7 @@ func (c *Client) CheckForChecksum100ks(medias []sortengine.Media) (map[string]bo
 func (c *Client) ChecksumExists(media *sortengine.Media) bool {
 	checksums, err := c.CheckForChecksums([]sortengine.Media{*media})
 	if err != nil {
-		fmt.Printf("Error checking for checksums: %s\n", err.Error())
+		slog.Error("Error checking for checksums", "error", err)
 		return false
 	}
 	for _, v := range checksums {
@@ -307,7 +367,7 @@ func (c *Client) ChecksumExists(media *sortengine.Media) bool {
 func (c *Client) Checksum100kExists(media *sortengine.Media) bool {
 	checksums, err := c.CheckForChecksum100ks([]sortengine.Media{*media})
 	if err != nil {
-		fmt.Printf("Error checking for checksums: %s\n", err.Error())
+		slog.Error("Error checking for checksums", "error", err)
 		return false
 	}
 	for _, v := range checksums {
@@ -322,17 +382,23 @@ func (c *Client) SendFile(media *sortengine.Media) error {
 	// Open the file
 	file, err := os.Open(media.Filename)
 	if err != nil {
-		fmt.Printf("Error opening file: %s\n", err.Error())
+		slog.Error("Error opening file", "filename", media.Filename, "error", err)
 		return err
 	}
 	defer file.Close()
 
 	// Check if checksum100k already exists on host
 	if c.Checksum100kExists(media) && c.ChecksumExists(media) {
-		fmt.Printf("Checksum already exists on server.  Skipping file %s.\n", media.Filename)
+		slog.Info("Checksum already exists on server, skipping file", "filename", media.Filename)
 		return nil
 	}
 
+	// Large files go up in resumable chunks (see chunked.go)
+	if media.Size >= c.chunkThreshold() {
+		file.Close()
+		return c.SendFileChunked(media)
+	}
+
 	// Use io.Pipe() for streaming uploads instead of buffering in memory
 	// This allows large files to be uploaded without consuming excessive RAM
 	// The pipe connects the multipart writer to the HTTP request body
@@ -395,8 +461,7 @@ func (c *Client) SendFile(media *sortengine.Media) error {
 
 	// Create the POST request with pipe reader as body
 	// The HTTP client will read from the pipe as data becomes available
-	url := fmt.Sprintf("http://%s/file", c.config.Client.Host)
-	request, err := http.NewRequest("POST", url, pipeReader)
+	request, err := c.newRequest("POST", "/file", pipeReader)
 	if err != nil {
 		pipeReader.Close()
 		return fmt.Errorf("error creating request: %v", err)
@@ -409,8 +474,24 @@ func (c *Client) SendFile(media *sortengine.Media) error {
 	response, err := c.httpClient.Do(request)
 	if err != nil {
 		pipeReader.Close()
-		// Wait for goroutine to finish
-		<-errChan
+		// Wait for goroutine to finish. It only succeeds if the HTTP client
+		// read the whole body, since closing the pipe fails its writes.
+		bodySent := <-errChan == nil
+		if interruptedUpload(err) {
+			if bodySent {
+				// Typically the response header timeout: the server has
+				// the file but is busy, e.g. waiting for an upload worker,
+				// and may still store it. Sending it again only adds load.
+				file.Close()
+				return c.awaitBusyUpload(media, err)
+			}
+			// The whole file has to arrive within the server's ReadTimeout,
+			// which a slow link may not manage; chunks are short requests
+			// and resume
+			slog.Warn("Upload interrupted, sending it in chunks instead", "filename", media.Filename, "error", err)
+			file.Close()
+			return c.SendFileChunked(media)
+		}
 		return fmt.Errorf("error sending request: %v", err)
 	}
 	defer response.Body.Close()
@@ -436,8 +517,12 @@ func (c *Client) SendFile(media *sortengine.Media) error {
 	if err != nil {
 		return fmt.Errorf("error decoding response: %v", err)
 	}
+	if responseMap["status"] == "rejected" {
+		slog.Info("File was deleted from the server and is rejected, skipping file", "filename", media.Filename)
+		return nil
+	}
 
-	fmt.Printf("Uploaded: %s\n", media.Filename)
+	slog.Info("Uploaded", "filename", media.Filename)
 	
 	return nil
 }
@@ -465,23 +550,6 @@ func TestChecksum() {
 	client.CheckForChecksums([]sortengine.Media{*media})
 }
 
-func checksum(filename string) (string, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	h := md5.New()
-
-	// Get the file's checksum
-	_, err = io.Copy(h, f)
-	if err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
-
 // Goroutines Explained:
 // Goroutines are lightweight threads managed by the Go runtime. They allow concurrent execution
 // of functions without the overhead of traditional OS threads. Key benefits:
@@ -506,6 +574,7 @@ type ProcessStats struct {
 	Processed     int64
 	Uploaded      int64
 	Skipped       int64
+	Unrecognized  int64
 	Errors        int64
 }
 
@@ -598,8 +667,8 @@ func (pr *ProgressReporter) printProgress(processed int64) {
 		remainingStr = "calculating..."
 	}
 	
-	// Print progress line (overwrite previous line)
-	fmt.Printf("\r%s [%s] %3.1f%% (%d/%d) | Elapsed: %s | Remaining: %s",
+	// Draw the progress line in place; log records are written above it
+	logging.SetStatus(fmt.Sprintf("%s [%s] %3.1f%% (%d/%d) | Elapsed: %s | Remaining: %s",
 		pr.phase,
 		string(bar),
 		percentage,
@@ -607,7 +676,7 @@ func (pr *ProgressReporter) printProgress(processed int64) {
 		pr.total,
 		formatDuration(elapsed),
 		remainingStr,
-	)
+	))
 }
 
 // Finish completes the progress display
@@ -617,8 +686,9 @@ func (pr *ProgressReporter) Finish() {
 	
 	processed := atomic.LoadInt64(pr.processed)
 	pr.printProgress(processed)
+	logging.EndStatus()
 	elapsed := time.Since(pr.startTime)
-	fmt.Printf("\n%s completed in %s\n", pr.phase, formatDuration(elapsed))
+	fmt.Printf("%s completed in %s\n", pr.phase, formatDuration(elapsed))
 }
 
 // formatDuration formats a duration in a human-readable way
@@ -638,6 +708,7 @@ type FileWithChecksums struct {
 	Media       *sortengine.Media
 	Checksum    string
 	Checksum100k string
+	Note        string // Non-fatal problem reading the file, e.g. unreadable metadata
 }
 
 // BatchCheckResult holds the result of a batch checksum check
@@ -748,7 +819,7 @@ func (c *Client) scanDirectory(ctx context.Context, dirPath string, filesChan ch
 				continue
 			}
 			// Last attempt failed, log and return
-			fmt.Printf("Error opening directory %s (after %d retries): %s\n", dirPath, maxRetries, err.Error())
+			slog.Error("Error opening directory", "path", dirPath, "retries", maxRetries, "error", err)
 			return
 		}
 		
@@ -761,7 +832,7 @@ func (c *Client) scanDirectory(ctx context.Context, dirPath string, filesChan ch
 				continue
 			}
 			// Last attempt failed, log and return
-			fmt.Printf("Error reading directory %s (after %d retries): %s\n", dirPath, maxRetries, err.Error())
+			slog.Error("Error reading directory", "path", dirPath, "retries", maxRetries, "error", err)
 			return
 		}
 		
@@ -823,9 +894,10 @@ func (c *Client) BatchCheckChecksums(checksums []string, endpoint string) (map[s
 	}
 
 	dataPart.Write(dataBytes)
+	writer.WriteField("algorithm", sortengine.DefaultHashAlgorithm)
 	writer.Close()
 
-	request, err := http.NewRequest("POST", fmt.Sprintf("http://%s%s", c.config.Client.Host, endpoint), &body)
+	request, err := c.newRequest("POST", endpoint, &body)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %v", err)
 	}
@@ -852,6 +924,85 @@ func (c *Client) BatchCheckChecksums(checksums []string, endpoint string) (map[s
 	return responseData["results"], nil
 }
 
+// loadFile reads a file's metadata and checksums, ready to check and upload
+// Unchanged files get their checksums from the local cache instead of being
+// read again (see cache.go). If the file can't be uploaded, nil is returned
+// with the decision (DecisionUnrecognized or DecisionError) and the reason.
+func (c *Client) loadFile(path string) (*FileWithChecksums, string, string) {
+	// Only pictures and videos are sorted; anything else
+	// (sidecar files, thumbnails databases, ...) is left alone
+	if !sortengine.IsRecognizedFile(path) {
+		return nil, DecisionUnrecognized, "not a picture or video"
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, DecisionError, err.Error()
+	}
+	statInfo, err := os.Stat(absPath)
+	if err != nil {
+		return nil, DecisionError, err.Error()
+	}
+	media := &sortengine.Media{Filename: absPath}
+	var cached *CachedChecksums
+	if c.cache != nil && !c.Rehash {
+		cached = c.cache.Get(absPath, statInfo)
+	}
+	if cached != nil {
+		// The cache is keyed by the algorithm in use, so say which one it was
+		media.HashAlgorithm = sortengine.DefaultHashAlgorithm
+		media.Checksum = cached.Checksum
+		media.Checksum100k = cached.Checksum100k
+		media.PerceptualHash = cached.PerceptualHash
+	}
+
+	// Calculate checksums for this file
+	// Metadata problems aren't fatal: the file is still uploaded,
+	// dated by its modification time
+	var note string
+	load := media.Init
+	if c.Thin {
+		load = media.InitStat
+	}
+	if loadErr := load(); loadErr != nil {
+		note = fmt.Sprintf("metadata: %s", loadErr.Error())
+	}
+	
+	if media.Checksum == "" {
+		if err := media.SetChecksum(); err != nil {
+			slog.Error("Error calculating checksum", "path", path, "error", err)
+			return nil, DecisionError, fmt.Sprintf("checksum: %s", err.Error())
+		}
+	}
+	
+	// Calculate checksum100k, unless Init already did
+	checksum100k := media.Checksum100k
+	if checksum100k == "" {
+		checksum100k, err = sortengine.Checksum(path, true)
+		if err != nil {
+			slog.Error("Error calculating checksum100k", "path", path, "error", err)
+			return nil, DecisionError, fmt.Sprintf("checksum100k: %s", err.Error())
+		}
+		media.Checksum100k = checksum100k
+	}
+
+	if c.cache != nil && cached == nil {
+		c.cache.Put(absPath, statInfo, CachedChecksums{
+			Checksum:       media.Checksum,
+			Checksum100k:   checksum100k,
+			PerceptualHash: media.PerceptualHash,
+		})
+	}
+
+	return &FileWithChecksums{
+		Path:        path,
+		Media:       media,
+		Checksum:    media.Checksum,
+		Checksum100k: checksum100k,
+		Note:        note,
+	}, DecisionNew, ""
+}
+
 // ProcessDirectory processes files in a directory using a two-phase approach:
 // Phase 1: Collect all files and calculate checksums in parallel
 // Phase 2: Batch check all checksums, then upload only files that don't exist
@@ -861,6 +1012,10 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 	
 	// Statistics tracking
 	stats := &ProcessStats{}
+
+	if c.openCache() {
+		defer c.closeCache()
+	}
 	
 	// Context for cancellation support
 	ctx, cancel := context.WithCancel(context.Background())
@@ -877,6 +1032,15 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 	phase1Reporter := NewProgressReporter("Phase 1", 0, &phase1Processed) // Total unknown initially
 	
 	var collectWg sync.WaitGroup
+
+	// Files that won't be uploaded at all, with the reason, for -dry-run
+	var skippedMu sync.Mutex
+	var skippedFiles []DryRunEntry
+	skipFile := func(path string, size int64, decision string, reason string) {
+		skippedMu.Lock()
+		skippedFiles = append(skippedFiles, DryRunEntry{Path: path, Decision: decision, Reason: reason, Size: size})
+		skippedMu.Unlock()
+	}
 	
 	// Start workers to calculate checksums in parallel
 	for i := 0; i < numWorkers; i++ {
@@ -888,36 +1052,21 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 				case <-ctx.Done():
 					return
 				default:
-					// Calculate checksums for this file
-					media := sortengine.NewMediaFile(fileInfo.Path)
-					if media == nil {
-						atomic.AddInt64(&stats.Errors, 1)
-						continue
-					}
-					
-					if err := media.SetChecksum(); err != nil {
-						fmt.Printf("Error calculating checksum for %s: %s\n", fileInfo.Path, err.Error())
-						atomic.AddInt64(&stats.Errors, 1)
-						continue
-					}
-					
-					// Calculate checksum100k
-					checksum100k, err := checksum100k(fileInfo.Path)
-					if err != nil {
-						fmt.Printf("Error calculating checksum100k for %s: %s\n", fileInfo.Path, err.Error())
-						atomic.AddInt64(&stats.Errors, 1)
+					file, decision, reason := c.loadFile(fileInfo.Path)
+					if file == nil {
+						if decision == DecisionUnrecognized {
+							atomic.AddInt64(&stats.Unrecognized, 1)
+						} else {
+							atomic.AddInt64(&stats.Errors, 1)
+						}
+						skipFile(fileInfo.Path, fileInfo.Info.Size(), decision, reason)
 						continue
 					}
 					
 					atomic.AddInt64(&stats.TotalFiles, 1)
 					atomic.AddInt64(&phase1Processed, 1)
 					phase1Reporter.Update()
-					resultsChan <- FileWithChecksums{
-						Path:        fileInfo.Path,
-						Media:       media,
-						Checksum:    media.Checksum,
-						Checksum100k: checksum100k,
-					}
+					resultsChan <- *file
 				}
 			}
 		}()
@@ -933,7 +1082,7 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 		
 		// Use parallel directory walker instead of synchronous filepath.Walk
 		if err := c.parallelWalkDir(ctx, dir, filesChan, numWorkers); err != nil {
-			fmt.Printf("Error walking directory: %s\n", err.Error())
+			slog.Error("Error walking directory", "error", err)
 		}
 	}()
 	
@@ -956,8 +1105,12 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 	// Update Phase 1 total and finish
 	phase1Reporter.total = int64(totalFiles)
 	phase1Reporter.Finish()
+	if c.cache != nil && !c.Rehash {
+		hits, misses := c.cache.Stats()
+		fmt.Printf("Checksum cache: %d unchanged files reused, %d hashed\n", hits, misses)
+	}
 	
-	if totalFiles == 0 {
+	if totalFiles == 0 && c.DryRun == nil {
 		fmt.Printf("No files to process.\n")
 		return nil
 	}
@@ -998,7 +1151,7 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 		batch := checksums[i:end]
 		batchResults, err := c.BatchCheckChecksums(batch, "/checksums")
 		if err != nil {
-			fmt.Printf("\nError batch checking checksums: %s\n", err.Error())
+			slog.Error("Error batch checking checksums", "error", err)
 			// Fall back to individual checks if batch fails
 			for _, cs := range batch {
 				existsMap[cs] = false
@@ -1021,7 +1174,7 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 		batch := checksums100k[i:end]
 		batchResults, err := c.BatchCheckChecksums(batch, "/checksum100k")
 		if err != nil {
-			fmt.Printf("\nError batch checking checksums100k: %s\n", err.Error())
+			slog.Error("Error batch checking checksums100k", "error", err)
 			// Fall back to individual checks if batch fails
 			for _, cs := range batch {
 				exists100kMap[cs] = false
@@ -1036,6 +1189,38 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 	}
 	
 	phase2Reporter.Finish()
+
+	// -dry-run stops here and reports the decision for every file
+	if c.DryRun != nil {
+		entries := append(make([]DryRunEntry, 0, len(skippedFiles)+totalFiles), skippedFiles...)
+		var newMedia []*sortengine.Media
+		var newIndexes []int
+		firstSeen := make(map[string]string)
+		for i := range allFiles {
+			file := &allFiles[i]
+			entry := DryRunEntry{
+				Path:         file.Path,
+				Decision:     DecisionNew,
+				Reason:       file.Note,
+				Size:         file.Media.Size,
+				Checksum:     file.Checksum,
+				CreationDate: file.Media.CreationDate.Format("2006-01-02 15:04:05"),
+			}
+			if existsMap[file.Checksum] && exists100kMap[file.Checksum100k] {
+				entry.Decision = DecisionDuplicate
+				entry.Reason = "already on server"
+			} else if first, ok := firstSeen[file.Checksum]; ok {
+				entry.Decision = DecisionDuplicate
+				entry.Reason = fmt.Sprintf("same as %s", first)
+			} else {
+				firstSeen[file.Checksum] = file.Path
+				newMedia = append(newMedia, file.Media)
+				newIndexes = append(newIndexes, len(entries))
+			}
+			entries = append(entries, entry)
+		}
+		return c.finishDryRun(entries, newMedia, newIndexes)
+	}
 	
 	// Phase 3: Upload only files that don't exist
 	fmt.Printf("\nPhase 3: Uploading files that don't exist...\n")
@@ -1121,6 +1306,7 @@ func (c *Client) ProcessDirectory(dir string, numWorkers int) error {
 	fmt.Printf("Total files:    %d\n", atomic.LoadInt64(&stats.TotalFiles))
 	fmt.Printf("Uploaded:       %d\n", atomic.LoadInt64(&stats.Uploaded))
 	fmt.Printf("Skipped:        %d\n", atomic.LoadInt64(&stats.Skipped))
+	fmt.Printf("Unrecognized:   %d\n", atomic.LoadInt64(&stats.Unrecognized))
 	fmt.Printf("Errors:         %d\n", atomic.LoadInt64(&stats.Errors))
 	
 	return nil
@@ -1138,43 +1324,18 @@ func WalkDir(dir string) (error) {
 	return nil
 }
 
-func checksum100k(filename string) (string, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	// Set the checksum function
-	h := md5.New()
-
-	// Get the file's checksum
-	var BUFSIZE int64 = 102400
-	finfo, err := os.Stat(filename)
-	if err != nil {
-		return "", err
-	}
-	if finfo.Size() < BUFSIZE {
-		BUFSIZE = finfo.Size()
-	}
-	_, err = io.CopyN(h, f, BUFSIZE)
-	if err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
-
 func printVersion() {
 	fmt.Printf("GoSort Client Version: %s\n", Version)
 }
 
 func CheckVersion() {
 	// Get version from server and compare with client version.
-	serverVersion, err := client.GetVersion()
+	info, err := client.GetServerInfo()
 	if err != nil {
 		fmt.Printf("Error getting version: %s\n", err.Error())
 		os.Exit(1)
 	}
+	serverVersion := info.Version
 	var compareString string
 	if serverVersion == Version {
 		compareString = "=="
@@ -1187,6 +1348,14 @@ func CheckVersion() {
 	if serverVersion != Version {
 		os.Exit(1)
 	}
+
+	// Compute checksums the same way the server stores them
+	if _, err := sortengine.GetHasher(info.HashAlgorithm); err != nil {
+		fmt.Printf("Server uses an unsupported checksum algorithm: %s\n", err.Error())
+		os.Exit(1)
+	}
+	sortengine.DefaultHashAlgorithm = info.HashAlgorithm
+	fmt.Printf("Using %s checksums.\n", info.HashAlgorithm)
 }
 
 func main() {
@@ -1199,6 +1368,17 @@ func main() {
 	flag.StringVar(&configPath, "config", "", "Path to config file (default: ~/.gosort.yml)")
 	flag.StringVar(&flags.Host, "host", "", "Server host address (overrides config)")
 	flag.BoolVar(&flags.InitConfig, "init", false, "Create default config file and exit")
+	similar := flag.Bool("similar", false, "Print clusters of visually similar images stored on the server and exit")
+	distance := flag.Int("distance", -1, "Maximum perceptual hash distance for -similar (default: server setting)")
+	dryRun := flag.Bool("dry-run", false, "Scan and check against the server, then report what would be uploaded instead of uploading")
+	format := flag.String("format", "text", "Report format for -dry-run: text, json or csv")
+	output := flag.String("output", "", "Write the -dry-run report to this file instead of stdout")
+	rehash := flag.Bool("rehash", false, "Ignore the local checksum cache and hash every file again")
+	thin := flag.Bool("thin", false, "Don't read metadata with exiftool; date files by modification time and let the server read their metadata")
+	watch := flag.Bool("watch", false, "After processing the directory, keep watching it and upload new or modified files")
+	settle := flag.Duration("settle", 2*time.Second, "With -watch, how long a file must stop changing before it is uploaded")
+	flag.StringVar(&flags.LogLevel, "log-level", "", "Log level: debug, info, warn or error (overrides config)")
+	flag.StringVar(&flags.LogFormat, "log-format", "", "Log format: text or json (overrides config)")
 	flag.Parse()
 
 	// Handle -init flag
@@ -1219,10 +1399,23 @@ func main() {
 		os.Exit(0)
 	}
 
+	// The similar-image report only talks to the server, no directory needed
+	if *similar {
+		client = NewClient(configPath, flags)
+		CheckVersion()
+		if err := client.PrintSimilarReport(*distance); err != nil {
+			fmt.Printf("Error getting similar images: %s\n", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Check for directory argument
 	args := flag.Args()
 	if len(args) < 1 {
 		fmt.Println("Usage: client [flags] <directory>")
+		fmt.Println("       client [flags] -watch <directory>")
+		fmt.Println("       client [flags] -similar [-distance N]")
 		fmt.Println("\nFlags:")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -1230,6 +1423,23 @@ func main() {
 
 	// Initialize client with config
 	client = NewClient(configPath, flags)
+	if *dryRun {
+		if err := ValidateDryRunFormat(*format); err != nil {
+			fmt.Printf("Invalid -format: %s\n", err.Error())
+			os.Exit(1)
+		}
+		client.DryRun = &DryRunOptions{Format: *format, Output: *output}
+	}
+	client.Rehash = *rehash
+	client.Thin = *thin || client.config.Client.Thin
+	if *watch && *dryRun {
+		fmt.Println("-watch and -dry-run can't be used together")
+		os.Exit(1)
+	}
+	if *settle <= 0 {
+		fmt.Println("-settle must be positive")
+		os.Exit(1)
+	}
 
 	//TestChecksum()
 	// TestUpload()
@@ -1238,11 +1448,27 @@ func main() {
 	CheckVersion()
 
 	dir := args[0]
+
+	// One exiftool process per worker, so metadata is read in parallel too
+	sortengine.SetMetadataReaderSize(*numWorkers)
+	defer sortengine.CloseMetadataReader()
 	
+	// Watch runs the initial pass itself, once the watcher is in place, so
+	// files created while it runs aren't missed
+	if *watch {
+		if err := client.Watch(dir, *numWorkers, *settle); err != nil {
+			fmt.Printf("Error watching directory: %s\n", err.Error())
+			sortengine.CloseMetadataReader()
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Use parallel processing with configurable number of workers
 	// Goroutines allow concurrent file processing, dramatically improving performance
 	if err := client.ProcessDirectory(dir, *numWorkers); err != nil {
 		fmt.Printf("Error processing directory: %s\n", err.Error())
+		sortengine.CloseMetadataReader()
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+)
+
+// Per-file decisions made by ProcessDirectory
+const (
+	DecisionNew          = "new"          // Would be uploaded
+	DecisionDuplicate    = "duplicate"    // Already on the server, or repeated in this directory
+	DecisionUnrecognized = "unrecognized" // Not a picture or video, never uploaded
+	DecisionError        = "error"        // Could not be read or hashed
+)
+
+// DryRunOptions selects how a -dry-run report is written
+type DryRunOptions struct {
+	Format string // text, json or csv
+	Output string // File to write to; empty means stdout
+}
+
+// DryRunEntry is the decision for one file
+type DryRunEntry struct {
+	Path         string `json:"path"`
+	Decision     string `json:"decision"`
+	Reason       string `json:"reason,omitempty"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum,omitempty"`
+	CreationDate string `json:"creation_date,omitempty"`
+	Destination  string `json:"destination,omitempty"` // Where the server would store it (new files only)
+}
+
+// DryRunFormats lists the supported -format values
+var DryRunFormats = []string{"text", "json", "csv"}
+
+// ValidateDryRunFormat checks a -format value
+func ValidateDryRunFormat(format string) error {
+	for _, f := range DryRunFormats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q (supported: %s)", format, strings.Join(DryRunFormats, ", "))
+}
+
+// PredictFilenames asks the server where it would store each file if they were
+// uploaded now, in this order. Nothing is stored.
+func (c *Client) PredictFilenames(medias []*sortengine.Media) ([]string, error) {
+	if len(medias) == 0 {
+		return []string{}, nil
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	mediaJson, err := json.Marshal(medias)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling media: %v", err)
+	}
+	if err := writer.WriteField("media", string(mediaJson)); err != nil {
+		return nil, fmt.Errorf("error writing media field: %v", err)
+	}
+	writer.Close()
+
+	request, err := c.newRequest("POST", "/predict", &body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %d: %s", response.StatusCode, string(responseBody))
+	}
+
+	var responseData struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.Unmarshal(responseBody, &responseData); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+	if len(responseData.Paths) != len(medias) {
+		return nil, fmt.Errorf("server predicted %d paths for %d files", len(responseData.Paths), len(medias))
+	}
+	return responseData.Paths, nil
+}
+
+// finishDryRun fills in destinations for new files and writes the report
+func (c *Client) finishDryRun(entries []DryRunEntry, newMedia []*sortengine.Media, newIndexes []int) error {
+	fmt.Printf("\nPredicting destinations for %d new files...\n", len(newMedia))
+	paths, err := c.PredictFilenames(newMedia)
+	if err != nil {
+		// The decisions are still useful without destinations
+		slog.Warn("Could not predict destinations", "error", err)
+	} else {
+		for i, path := range paths {
+			entries[newIndexes[i]].Destination = path
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	out := io.Writer(os.Stdout)
+	if c.DryRun.Output != "" {
+		f, err := os.Create(c.DryRun.Output)
+		if err != nil {
+			return fmt.Errorf("error creating report file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	} else {
+		fmt.Println()
+	}
+
+	switch c.DryRun.Format {
+	case "json":
+		err = writeDryRunJSON(out, entries)
+	case "csv":
+		err = writeDryRunCSV(out, entries)
+	default:
+		err = writeDryRunText(out, entries)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+
+	counts := countDecisions(entries)
+	fmt.Printf("\n=== Dry Run Complete (nothing was uploaded) ===\n")
+	fmt.Printf("New:            %d\n", counts[DecisionNew])
+	fmt.Printf("Duplicate:      %d\n", counts[DecisionDuplicate])
+	fmt.Printf("Unrecognized:   %d\n", counts[DecisionUnrecognized])
+	fmt.Printf("Errors:         %d\n", counts[DecisionError])
+	if c.DryRun.Output != "" {
+		fmt.Printf("Report written to %s\n", c.DryRun.Output)
+	}
+	return nil
+}
+
+func countDecisions(entries []DryRunEntry) map[string]int {
+	counts := make(map[string]int)
+	for _, e := range entries {
+		counts[e.Decision]++
+	}
+	return counts
+}
+
+func writeDryRunJSON(out io.Writer, entries []DryRunEntry) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{
+		"summary": countDecisions(entries),
+		"files":   entries,
+	})
+}
+
+func writeDryRunCSV(out io.Writer, entries []DryRunEntry) error {
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"path", "decision", "reason", "size", "checksum", "creation_date", "destination"})
+	for _, e := range entries {
+		writer.Write([]string{e.Path, e.Decision, e.Reason, strconv.FormatInt(e.Size, 10), e.Checksum, e.CreationDate, e.Destination})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeDryRunText(out io.Writer, entries []DryRunEntry) error {
+	for _, e := range entries {
+		line := fmt.Sprintf("%-12s %s", strings.ToUpper(e.Decision), e.Path)
+		if e.Destination != "" {
+			line += " -> " + e.Destination
+		}
+		if e.Reason != "" {
+			line += " (" + e.Reason + ")"
+		}
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the NTFS file index of a file, which plays the role of an
+// inode number, or 0 if it isn't available
+func fileInode(path string, info os.FileInfo) uint64 {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0
+	}
+	handle, err := syscall.CreateFile(pathp, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0
+	}
+	defer syscall.CloseHandle(handle)
+
+	var data syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(handle, &data); err != nil {
+		return 0
+	}
+	return uint64(data.FileIndexHigh)<<32 | uint64(data.FileIndexLow)
+}
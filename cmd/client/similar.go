@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+)
+
+// SimilarReport is the server's response from GET /similar
+type SimilarReport struct {
+	Distance int                         `json:"distance"`
+	Clusters []sortengine.SimilarCluster `json:"clusters"`
+}
+
+// GetSimilar asks the server for clusters of visually similar images
+// A negative distance uses the server's configured default
+func (c *Client) GetSimilar(distance int) (*SimilarReport, error) {
+	endpoint := "/similar"
+	if distance >= 0 {
+		endpoint += "?" + url.Values{"distance": {strconv.Itoa(distance)}}.Encode()
+	}
+
+	request, err := c.newRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %d: %s", response.StatusCode, string(responseBody))
+	}
+
+	var report SimilarReport
+	if err := json.Unmarshal(responseBody, &report); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+	return &report, nil
+}
+
+// PrintSimilarReport prints each cluster of similar images with where the
+// server stored them, largest clusters first
+func (c *Client) PrintSimilarReport(distance int) error {
+	report, err := c.GetSimilar(distance)
+	if err != nil {
+		return err
+	}
+
+	if len(report.Clusters) == 0 {
+		fmt.Printf("No similar images found within distance %d.\n", report.Distance)
+		return nil
+	}
+
+	total := 0
+	for i, cluster := range report.Clusters {
+		fmt.Printf("\nCluster %d: %d images (max distance %d)\n", i+1, len(cluster.Media), cluster.MaxDistance)
+		for _, m := range cluster.Media {
+			location := m.StoredPath
+			if location == "" {
+				location = m.Filename
+			}
+			fmt.Printf("  %s  %s  %d bytes  %s\n", m.PerceptualHash, m.CreateDate.Format("2006-01-02 15:04:05"), m.Size, location)
+		}
+		total += len(cluster.Media)
+	}
+	fmt.Printf("\n%d clusters, %d images within distance %d.\n", len(report.Clusters), total, report.Distance)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ascheel/gosort/internal/sortengine"
+)
+
+// baseURL returns the scheme and host requests are sent to
+// client.host may name the scheme; without one, plain HTTP is used as always
+func (c *Client) baseURL() string {
+	host := strings.TrimSuffix(c.config.Client.Host, "/")
+	if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
+		return host
+	}
+	return "http://" + host
+}
+
+// clientTLSConfig builds the TLS settings for connections to the server from
+// client.tls_ca, client.tls_cert and client.tls_key
+// Returns nil when none are set, which keeps Go's defaults (system roots, no client certificate).
+func clientTLSConfig(config *sortengine.ClientConfig) (*tls.Config, error) {
+	if config.TLSCA == "" && config.TLSCert == "" && config.TLSKey == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.TLSCA != "" {
+		pem, err := os.ReadFile(config.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client.tls_ca: %v", err)
+		}
+		// Trust the bundle on top of the system roots, so a server with a
+		// public certificate keeps working too
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client.tls_ca %s", config.TLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLSCert != "" || config.TLSKey != "" {
+		if config.TLSCert == "" || config.TLSKey == "" {
+			return nil, fmt.Errorf("client.tls_cert and client.tls_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client.tls_cert/client.tls_key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
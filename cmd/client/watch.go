@@ -0,0 +1,198 @@
+package main
+
+// Watch mode
+// The client processes the directory like a normal run, then keeps running and
+// uploads new or modified pictures and videos as they appear, which turns a
+// camera import or phone sync folder into an always-on ingest. Files are only
+// picked up once they have stopped changing for the settle time, so copies
+// that are still being written aren't uploaded half-finished.
+// The watcher is started before the initial pass, so a file created during a
+// long pass is seen by one or the other. One seen by both is only uploaded
+// once, since the server already has it the second time.
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pendingFile is a file with recent activity, waiting to settle
+type pendingFile struct {
+	lastEvent time.Time
+	size      int64
+	modTime   time.Time
+}
+
+// Watch uploads everything under dir with ProcessDirectory, and then the
+// pictures and videos created or modified under it, until interrupted
+// settle is how long a file must go without changes before it is uploaded
+func (c *Client) Watch(dir string, numWorkers int, settle time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to start watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	if c.openCache() {
+		defer c.closeCache()
+	}
+
+	// Files found while watching new directories are queued like any other event
+	pending := make(map[string]*pendingFile)
+	touch := func(path string) {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Already gone again, e.g. a temp file renamed into place
+			return
+		}
+		pending[path] = &pendingFile{lastEvent: time.Now(), size: info.Size(), modTime: info.ModTime()}
+	}
+
+	// fsnotify only watches single directories, so add every one under dir
+	watchTree := func(root string, queueFiles bool) {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // Continue on errors
+			}
+			if d.IsDir() {
+				if err := watcher.Add(path); err != nil {
+					slog.Warn("Unable to watch directory", "path", path, "error", err)
+				}
+			} else if queueFiles {
+				touch(path)
+			}
+			return nil
+		})
+	}
+	watchTree(dir, false)
+
+	// Uploads run in their own workers so a large video doesn't stop
+	// events from being read
+	uploadChan := make(chan string, numWorkers*2)
+	var uploadWg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		uploadWg.Add(1)
+		go func() {
+			defer uploadWg.Done()
+			for path := range uploadChan {
+				c.watchUpload(path)
+			}
+		}()
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	defer signal.Stop(quit)
+
+	ticker := time.NewTicker(settle / 2)
+	defer ticker.Stop()
+
+	// The initial pass runs alongside the event loop, so events aren't left
+	// to pile up in the kernel while it works through a large directory
+	scanDone := make(chan error, 1)
+	go func() {
+		scanDone <- c.ProcessDirectory(dir, numWorkers)
+	}()
+
+	for {
+		select {
+		case err := <-scanDone:
+			if err != nil {
+				close(uploadChan)
+				uploadWg.Wait()
+				return fmt.Errorf("error processing directory: %v", err)
+			}
+			scanDone = nil
+			fmt.Printf("\nWatching %s for new files (settle time %s, Ctrl-C to stop)...\n", dir, settle)
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				close(uploadChan)
+				uploadWg.Wait()
+				return nil
+			}
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+				info, err := os.Stat(event.Name)
+				if err != nil {
+					// Already gone again, e.g. a temp file renamed into place
+					continue
+				}
+				if info.IsDir() {
+					// New directories may already contain files (moved in
+					// rather than written), so queue those too
+					if event.Has(fsnotify.Create) {
+						watchTree(event.Name, true)
+					}
+					continue
+				}
+				touch(event.Name)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				close(uploadChan)
+				uploadWg.Wait()
+				return nil
+			}
+			slog.Error("Watch error", "error", err)
+
+		case <-ticker.C:
+			// A file is ready once there have been no events for the settle
+			// time and its size and modification time have stopped changing.
+			// The second check catches writers that don't generate events,
+			// e.g. on some network filesystems.
+			now := time.Now()
+			for path, p := range pending {
+				if now.Sub(p.lastEvent) < settle {
+					continue
+				}
+				info, err := os.Stat(path)
+				if err != nil {
+					delete(pending, path)
+					continue
+				}
+				if info.Size() != p.size || !info.ModTime().Equal(p.modTime) {
+					p.size = info.Size()
+					p.modTime = info.ModTime()
+					p.lastEvent = now
+					continue
+				}
+				// If every worker is busy, try again on the next tick rather
+				// than stop reading events
+				select {
+				case uploadChan <- path:
+					delete(pending, path)
+				default:
+				}
+			}
+
+		case <-quit:
+			fmt.Printf("\nStopping watch, waiting for uploads in progress...\n")
+			close(uploadChan)
+			uploadWg.Wait()
+			return nil
+		}
+	}
+}
+
+// watchUpload checksums and uploads one settled file
+// Unrecognized files are ignored quietly; SendFile skips files the server has
+func (c *Client) watchUpload(path string) {
+	file, decision, reason := c.loadFile(path)
+	if file == nil {
+		if decision == DecisionError {
+			slog.Warn("Skipping file", "path", path, "reason", reason)
+		}
+		return
+	}
+	if err := c.SendFile(file.Media); err != nil {
+		slog.Error("Error uploading file", "path", path, "error", err)
+	}
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// console writes log records to stderr, sharing the terminal with a status
+// line such as the client's progress bar. The status line is redrawn in
+// place with \r; a record written while it is shown clears it first and
+// draws it again underneath, so the two never end up on one line.
+var console = &consoleWriter{out: os.Stderr}
+
+type consoleWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	status string // Line currently drawn, without the leading \r
+}
+
+// clearLine returns the cursor to the start of the line and erases it
+const clearLine = "\r\033[K"
+
+// Write writes one log record
+func (c *consoleWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status != "" {
+		io.WriteString(c.out, clearLine)
+	}
+	n, err := c.out.Write(p)
+	if c.status != "" {
+		io.WriteString(c.out, c.status)
+	}
+	return n, err
+}
+
+// SetStatus draws line as the status line, replacing the previous one
+func SetStatus(line string) {
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	io.WriteString(console.out, clearLine+line)
+	console.status = line
+}
+
+// EndStatus leaves the current status line on screen and moves past it
+// Log records written afterwards no longer redraw it.
+func EndStatus() {
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	if console.status != "" {
+		io.WriteString(console.out, "\n")
+	}
+	console.status = ""
+}
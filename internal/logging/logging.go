@@ -0,0 +1,106 @@
+// Package logging sets up the structured logger shared by the api and client
+// binaries. Records go through log/slog, as text or JSON, either to the
+// console or to a log file that is rotated by size.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Defaults for log file rotation
+const (
+	DefaultMaxSizeMB  = 100
+	DefaultMaxBackups = 5
+)
+
+// Config is the log section of the server and client config
+type Config struct {
+	Level      string `yaml:"level"`       // debug, info, warn or error (default: info)
+	Format     string `yaml:"format"`      // text or json (default: text)
+	File       string `yaml:"file"`        // Write records here instead of the console
+	MaxSizeMB  int    `yaml:"max_size_mb"` // Rotate File once it grows past this (default: 100)
+
+	// Rotated files to keep, as File.1 (newest) to File.N (default: 5)
+	// A pointer so that 0, keeping no backups, can be told apart from unset.
+	MaxBackups *int `yaml:"max_backups"`
+}
+
+// Validate checks the level and format
+func (c Config) Validate() error {
+	if _, err := parseLevel(c.Level); err != nil {
+		return err
+	}
+	switch strings.ToLower(c.Format) {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown log format %q (valid: text, json)", c.Format)
+	}
+	if c.MaxSizeMB < 0 || (c.MaxBackups != nil && *c.MaxBackups < 0) {
+		return fmt.Errorf("max_size_mb and max_backups may not be negative")
+	}
+	return nil
+}
+
+// Setup makes a logger for c the slog default and returns a function that
+// closes the log file, if there is one
+func Setup(c Config) (func() error, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	level, _ := parseLevel(c.Level)
+
+	var out io.Writer = console
+	closeFn := func() error { return nil }
+	if c.File != "" {
+		maxSize := c.MaxSizeMB
+		if maxSize == 0 {
+			maxSize = DefaultMaxSizeMB
+		}
+		maxBackups := DefaultMaxBackups
+		if c.MaxBackups != nil {
+			maxBackups = *c.MaxBackups
+		}
+		file, err := OpenRotatingFile(c.File, int64(maxSize)*1024*1024, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = file
+		closeFn = file.Close
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.EqualFold(c.Format, "json") {
+		handler = slog.NewJSONHandler(out, opts)
+	} else {
+		handler = slog.NewTextHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return closeFn, nil
+}
+
+// parseLevel turns a level name into a slog level; empty means info
+func parseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (valid: debug, info, warn, error)", name)
+}
+
+// Fatal logs an error and exits with status 1
+// slog has no fatal level; this replaces log.Fatalf once logging is set up.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingFile is a log file that is rotated once it grows past a size limit
+// The current file keeps its name; older ones are renamed to name.1 (newest)
+// through name.N, and the oldest is removed.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens or creates path for appending
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create log directory: %v", err)
+	}
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write appends p, rotating first if it would take the file past the limit
+// A record is never split between two files.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, fmt.Errorf("log file %s is closed", r.path)
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the oversized file rather than losing records
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file %s: %v\n", r.path, err)
+			if r.file == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// open opens the current file and records its size
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to open log file: %v", err)
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+// rotate shifts name.N-1 to name.N and so on, moves the current file to
+// name.1 and starts a new one
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", r.path, i) }
+	if r.maxBackups > 0 {
+		os.Remove(backup(r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(backup(i), backup(i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return errors.Join(err, r.open())
+			}
+		}
+		if err := os.Rename(r.path, backup(1)); err != nil {
+			return errors.Join(err, r.open())
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return errors.Join(err, r.open())
+	}
+	return r.open()
+}
@@ -5,6 +5,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/ascheel/gosort/internal/logging"
 	"gopkg.in/yaml.v3"
 )
 
@@ -14,16 +17,52 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	DBFile  string `yaml:"database_file"`
-	SaveDir string `yaml:"savedir"`
-	IP      string `yaml:"ip"`
-	Port    int    `yaml:"port"`
+	DBFile             string `yaml:"database_file"`
+	SaveDir            string `yaml:"savedir"`
+	IP                 string `yaml:"ip"`
+	Port               int    `yaml:"port"`
+	HashAlgorithm      string `yaml:"hash_algorithm"`
+	SimilarityDistance int    `yaml:"similarity_distance"` // Default Hamming distance for GET /similar
+	TLSCert            string `yaml:"tls_cert"`            // PEM certificate; serve HTTPS when set together with TLSKey
+	TLSKey             string `yaml:"tls_key"`
+	TLSClientCA        string `yaml:"tls_client_ca"`  // PEM CA bundle; when set, clients must present a certificate it signed
+	Layout             string `yaml:"layout"`         // Where uploads are stored under SaveDir (see layout.go)
+	ScrubInterval      string `yaml:"scrub_interval"` // How often the server scrubs the library, e.g. "168h"; empty disables
+
+	Log logging.Config `yaml:"log"` // Level, format and log file for the api
+
+	// AuthTokens (the default) requires an API token on every request;
+	// AuthDisabled lets anyone who can reach the server use it
+	Auth string `yaml:"auth"`
 }
 
+// Values for ServerConfig.Auth
+const (
+	AuthTokens   = "tokens"
+	AuthDisabled = "disabled"
+)
+
 type ClientConfig struct {
-	Host string `yaml:"host"`
+	Host    string `yaml:"host"`     // host:port, or https://host:port for a TLS server
+	Token   string `yaml:"token"`    // API token from the server's -add-token; empty if its auth is disabled
+	TLSCA   string `yaml:"tls_ca"`   // PEM CA bundle to trust in addition to the system roots
+	TLSCert string `yaml:"tls_cert"` // PEM client certificate, for servers that require one
+	TLSKey  string `yaml:"tls_key"`
+
+	Log logging.Config `yaml:"log"` // Level, format and log file for the client
+
+	// Don't read metadata with exiftool; upload files dated by modification
+	// time and leave the metadata to the server
+	Thin bool `yaml:"thin"`
+
+	// Files of at least this many MB are uploaded in resumable chunks
+	ChunkThresholdMB int `yaml:"chunk_threshold_mb"`
 }
 
+// DefaultChunkThresholdMB is small enough that a single-request upload fits
+// in the server's 30 second ReadTimeout on a slow link
+const DefaultChunkThresholdMB = 4
+
 // ConfigFlags holds command-line flag values that can override config file settings
 type ConfigFlags struct {
 	ConfigFile  string
@@ -33,6 +72,8 @@ type ConfigFlags struct {
 	Port        int
 	Host        string
 	InitConfig  bool
+	LogLevel    string
+	LogFormat   string
 }
 
 // GetDefaultConfigPath returns the default config file path (~/.gosort.yml)
@@ -53,13 +94,18 @@ func CreateDefaultConfig(configPath string) error {
 
 	defaultConfig := Config{
 		Server: ServerConfig{
-			DBFile:  "%SAVEDIR%/gosort.db",
-			SaveDir: "%HOME%/pictures",
-			IP:      "localhost",
-			Port:    8080,
+			DBFile:             "%SAVEDIR%/gosort.db",
+			SaveDir:            "%HOME%/pictures",
+			IP:                 "localhost",
+			Port:               8080,
+			HashAlgorithm:      "sha256",
+			SimilarityDistance: DefaultSimilarityDistance,
+			Layout:             DefaultLayout,
+			Auth:               AuthTokens,
 		},
 		Client: ClientConfig{
-			Host: "localhost:8080",
+			Host:             "localhost:8080",
+			ChunkThresholdMB: DefaultChunkThresholdMB,
 		},
 	}
 
@@ -124,10 +170,82 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 	c.Server.SaveDir = strings.Replace(c.Server.SaveDir, "%HOME%", homeDir, 1)
 	c.Server.DBFile = strings.Replace(c.Server.DBFile, "%SAVEDIR%", c.Server.SaveDir, 1)
+	for _, path := range []*string{&c.Server.TLSCert, &c.Server.TLSKey, &c.Server.TLSClientCA, &c.Client.TLSCA, &c.Client.TLSCert, &c.Client.TLSKey, &c.Server.Log.File, &c.Client.Log.File} {
+		*path = strings.Replace(*path, "%HOME%", homeDir, 1)
+	}
+
+	// Config files written before hash_algorithm existed describe libraries
+	// checksummed with MD5, so keep using it until the admin opts in
+	if c.Server.HashAlgorithm == "" {
+		c.Server.HashAlgorithm = LegacyHashAlgorithm
+	}
+	c.Server.HashAlgorithm = strings.ToLower(c.Server.HashAlgorithm)
+
+	if c.Server.SimilarityDistance <= 0 {
+		c.Server.SimilarityDistance = DefaultSimilarityDistance
+	}
+
+	if c.Server.Layout == "" {
+		c.Server.Layout = DefaultLayout
+	}
+
+	// Turning authentication off has to be asked for
+	if c.Server.Auth == "" {
+		c.Server.Auth = AuthTokens
+	}
+	c.Server.Auth = strings.ToLower(c.Server.Auth)
+
+	if c.Client.ChunkThresholdMB <= 0 {
+		c.Client.ChunkThresholdMB = DefaultChunkThresholdMB
+	}
 
 	return &c, nil
 }
 
+// Validate checks config values that would otherwise only fail once the server is running
+func (c *Config) Validate() error {
+	if _, err := GetHasher(c.Server.HashAlgorithm); err != nil {
+		return fmt.Errorf("server.hash_algorithm: %v", err)
+	}
+	if c.Server.Auth != AuthTokens && c.Server.Auth != AuthDisabled {
+		return fmt.Errorf("server.auth: must be %q or %q, got %q", AuthTokens, AuthDisabled, c.Server.Auth)
+	}
+	if c.Server.SimilarityDistance > 64 {
+		return fmt.Errorf("server.similarity_distance: must be between 1 and 64, got %d", c.Server.SimilarityDistance)
+	}
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		return fmt.Errorf("server.tls_cert and server.tls_key must be set together")
+	}
+	if c.Server.TLSClientCA != "" && c.Server.TLSCert == "" {
+		return fmt.Errorf("server.tls_client_ca requires server.tls_cert and server.tls_key")
+	}
+	if _, err := ParseLayout(c.Server.Layout); err != nil {
+		return fmt.Errorf("server.layout: %v", err)
+	}
+	if _, err := c.ScrubInterval(); err != nil {
+		return fmt.Errorf("server.scrub_interval: %v", err)
+	}
+	if err := c.Server.Log.Validate(); err != nil {
+		return fmt.Errorf("server.log: %v", err)
+	}
+	return nil
+}
+
+// ScrubInterval returns server.scrub_interval as a duration, or 0 if scheduled scrubs are off
+func (c *Config) ScrubInterval() (time.Duration, error) {
+	if c.Server.ScrubInterval == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(c.Server.ScrubInterval)
+	if err != nil {
+		return 0, err
+	}
+	if interval < time.Hour {
+		return 0, fmt.Errorf("must be at least 1h, got %s", interval)
+	}
+	return interval, nil
+}
+
 // ApplyFlags applies command-line flags to the config, overriding file values
 func (c *Config) ApplyFlags(flags *ConfigFlags) {
 	if flags.DBFile != "" {
@@ -156,4 +274,12 @@ func (c *Config) ApplyFlags(flags *ConfigFlags) {
 	if flags.Host != "" {
 		c.Client.Host = flags.Host
 	}
+	if flags.LogLevel != "" {
+		c.Server.Log.Level = flags.LogLevel
+		c.Client.Log.Level = flags.LogLevel
+	}
+	if flags.LogFormat != "" {
+		c.Server.Log.Format = flags.LogFormat
+		c.Client.Log.Format = flags.LogFormat
+	}
 }
@@ -5,8 +5,10 @@ import (
 	_ "modernc.org/sqlite"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 	// m "github.com/ascheel/gosort/internal/media"
 )
@@ -30,7 +32,9 @@ func NewDB(filename string, config *Config) *DB {
 	db := &DB{}
 	db.filename = filename
 	db.config = config
-	db.Init()
+	if err := db.Init(); err != nil {
+		log.Fatalf("Unable to initialize database %s: %v", filename, err)
+	}
 	return db
 }
 
@@ -44,17 +48,19 @@ func (d *DB) AddFileToDB(media *Media) error {
 		return fmt.Errorf("database not properly initialized: AddFile statement is nil")
 	}
 	
-	_, err := d.stmtAddFile.Exec(
-		media.Filename,
-		media.Checksum,
-		media.Checksum100k,
-		media.Size,
-		media.CreationDate,
-	)
+	// The row and its metadata go in together
+	tx, err := d.db.Begin()
 	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmt(d.stmtAddFile).Exec(mediaValues(media)...); err != nil {
 		return err
 	}
-	return nil
+	if err := insertMetadata(tx, media.Checksum, media.Metadata); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // AddFilesToDBBatch inserts multiple files in a single transaction
@@ -69,11 +75,14 @@ func (d *DB) AddFilesToDBBatch(mediaList []*Media, batchSize int) error {
 		batchSize = 100 // Default batch size
 	}
 	
-	// Ensure all media have checksums
+	// Ensure all media have checksums and record which algorithm produced them
 	for _, media := range mediaList {
 		if len(media.Checksum) == 0 {
 			media.SetChecksum()
 		}
+		if media.HashAlgorithm == "" {
+			media.HashAlgorithm = DefaultHashAlgorithm
+		}
 	}
 	
 	// Process in batches
@@ -93,7 +102,7 @@ func (d *DB) AddFilesToDBBatch(mediaList []*Media, batchSize int) error {
 		// Prepare statement for this transaction
 		// Use INSERT OR IGNORE to handle duplicates gracefully (atomic operation)
 		// This prevents entire batch rollback on duplicate entries
-		stmt, err := tx.Prepare("INSERT OR IGNORE INTO media (filename, checksum, checksum100k, size, create_date) VALUES (?, ?, ?, ?, ?)")
+		stmt, err := tx.Prepare("INSERT OR IGNORE INTO media (" + mediaColumns + ") VALUES (" + placeholders(strings.Count(mediaColumns, ",")+1) + ")")
 		if err != nil {
 			tx.Rollback()
 			return fmt.Errorf("error preparing batch insert statement: %v", err)
@@ -109,13 +118,7 @@ func (d *DB) AddFilesToDBBatch(mediaList []*Media, batchSize int) error {
 		// Insert all files in this batch
 		// Individual errors are handled gracefully - batch continues processing
 		for _, media := range batch {
-			result, err := stmt.Exec(
-				media.Filename,
-				media.Checksum,
-				media.Checksum100k,
-				media.Size,
-				media.CreationDate,
-			)
+			result, err := stmt.Exec(mediaValues(media)...)
 			if err != nil {
 				// Log error but continue with other files in batch
 				failed = append(failed, struct {
@@ -132,6 +135,11 @@ func (d *DB) AddFilesToDBBatch(mediaList []*Media, batchSize int) error {
 				// This is expected behavior, not an error
 				continue
 			}
+
+			// The row is in without its metadata; still better than no row
+			if err := insertMetadata(tx, media.Checksum, media.Metadata); err != nil {
+				slog.Warn("Failed to insert metadata", "filename", media.Filename, "error", err)
+			}
 			
 			successful = append(successful, media)
 		}
@@ -148,7 +156,7 @@ func (d *DB) AddFilesToDBBatch(mediaList []*Media, batchSize int) error {
 		// Log any failures but commit successful inserts
 		if len(failed) > 0 {
 			for _, f := range failed {
-				fmt.Printf("Warning: Failed to insert file %s: %v\n", f.media.Filename, f.err)
+				slog.Warn("Failed to insert file", "filename", f.media.Filename, "error", f.err)
 			}
 		}
 		
@@ -159,7 +167,7 @@ func (d *DB) AddFilesToDBBatch(mediaList []*Media, batchSize int) error {
 		
 		// Log success
 		if len(successful) > 0 {
-			fmt.Printf("Successfully inserted %d files in batch (skipped %d duplicates/failures)\n", len(successful), len(failed))
+			slog.Debug("Inserted files in batch", "inserted", len(successful), "failed", len(failed))
 		}
 	}
 	
@@ -225,6 +233,243 @@ func (d *DB) ChecksumExists(checksum string) (bool) {
 	return result > 0
 }
 
+// MediaRecord is a single row of the media table as returned by QueryMedia
+type MediaRecord struct {
+	Filename       string    `json:"filename"`
+	Checksum       string    `json:"checksum"`
+	Checksum100k   string    `json:"checksum100k"`
+	Size           int64     `json:"size"`
+	CreateDate     time.Time `json:"create_date"`
+	StoredPath     string    `json:"stored_path"`
+	HashAlgorithm  string    `json:"hash_algorithm"`
+	PerceptualHash string    `json:"phash,omitempty"`
+	UploadedBy     string    `json:"uploaded_by,omitempty"`
+
+	PromotedMetadata // Only filled in by QueryMedia
+}
+
+// MediaQuery holds the filters and pagination settings for QueryMedia
+// Zero values mean "no filter" for every field
+type MediaQuery struct {
+	CreatedFrom time.Time // Inclusive lower bound on create_date
+	CreatedTo   time.Time // Exclusive upper bound on create_date
+	MinSize     int64
+	MaxSize     int64
+	Extension   string // Without the leading dot, matched case-insensitively
+	Checksum    string
+	UploadedBy  string // Token name; matches exactly
+	CameraMake  string // Camera make, model and lens match case-insensitively anywhere in the value
+	CameraModel string
+	Lens        string
+	Limit       int
+	Offset      int
+}
+
+// QueryMedia returns the media records matching the query along with the total
+// number of matching rows (ignoring Limit/Offset) so callers can paginate
+func (d *DB) QueryMedia(q MediaQuery) ([]MediaRecord, int, error) {
+	var where []string
+	var args []interface{}
+
+	// create_date is stored as text ("2006-01-02 15:04:05 ..."), so comparing against
+	// the same prefix format sorts correctly and still uses idx_create_date
+	if !q.CreatedFrom.IsZero() {
+		where = append(where, "create_date >= ?")
+		args = append(args, q.CreatedFrom.Format("2006-01-02 15:04:05"))
+	}
+	if !q.CreatedTo.IsZero() {
+		where = append(where, "create_date < ?")
+		args = append(args, q.CreatedTo.Format("2006-01-02 15:04:05"))
+	}
+	if q.MinSize > 0 {
+		where = append(where, "size >= ?")
+		args = append(args, q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		where = append(where, "size <= ?")
+		args = append(args, q.MaxSize)
+	}
+	if q.Extension != "" {
+		// LIKE is case-insensitive for ASCII in SQLite, which is what we want for extensions
+		where = append(where, "filename LIKE ?")
+		args = append(args, "%."+q.Extension)
+	}
+	if q.Checksum != "" {
+		where = append(where, "checksum = ?")
+		args = append(args, q.Checksum)
+	}
+	if q.UploadedBy != "" {
+		where = append(where, "uploaded_by = ?")
+		args = append(args, q.UploadedBy)
+	}
+	// "canon" should find "Canon" and "Canon EOS R5" alike. Wildcards in the
+	// value are escaped so they match literally.
+	for _, filter := range [][2]string{{"camera_make", q.CameraMake}, {"camera_model", q.CameraModel}, {"lens", q.Lens}} {
+		if filter[1] != "" {
+			where = append(where, filter[0]+` LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+likeEscaper.Replace(filter[1])+"%")
+		}
+	}
+
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	err := d.db.QueryRow("SELECT count(*) FROM media"+whereClause, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting media: %v", err)
+	}
+
+	stmt := "SELECT filename, checksum, checksum100k, size, create_date, stored_path, hash_algorithm, phash, uploaded_by, " + promotedColumns + " FROM media" + whereClause + " ORDER BY create_date, rowid"
+	if q.Limit > 0 {
+		stmt += " LIMIT ? OFFSET ?"
+		args = append(args, q.Limit, q.Offset)
+	}
+
+	rows, err := d.db.Query(stmt, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying media: %v", err)
+	}
+	defer rows.Close()
+
+	records := make([]MediaRecord, 0)
+	for rows.Next() {
+		var r MediaRecord
+		var checksum100k, storedPath, hashAlgorithm, phash, uploadedBy sql.NullString
+		promoted, finish := scanPromoted(&r.PromotedMetadata)
+		dest := append([]interface{}{&r.Filename, &r.Checksum, &checksum100k, &r.Size, &r.CreateDate, &storedPath, &hashAlgorithm, &phash, &uploadedBy}, promoted...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, 0, fmt.Errorf("error reading media row: %v", err)
+		}
+		finish()
+		r.Checksum100k = checksum100k.String
+		r.StoredPath = storedPath.String
+		r.HashAlgorithm = hashAlgorithm.String
+		r.PerceptualHash = phash.String
+		r.UploadedBy = uploadedBy.String
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating media rows: %v", err)
+	}
+
+	return records, total, nil
+}
+
+// MediaWithPerceptualHash returns every row that has a perceptual hash
+// These are the candidates for near-duplicate clustering (see ClusterSimilar)
+func (d *DB) MediaWithPerceptualHash() ([]MediaRecord, error) {
+	rows, err := d.db.Query("SELECT filename, checksum, size, create_date, stored_path, phash FROM media WHERE phash IS NOT NULL AND phash != ''")
+	if err != nil {
+		return nil, fmt.Errorf("error querying perceptual hashes: %v", err)
+	}
+	defer rows.Close()
+
+	records := make([]MediaRecord, 0)
+	for rows.Next() {
+		var r MediaRecord
+		var storedPath sql.NullString
+		if err := rows.Scan(&r.Filename, &r.Checksum, &r.Size, &r.CreateDate, &storedPath, &r.PerceptualHash); err != nil {
+			return nil, fmt.Errorf("error reading media row: %v", err)
+		}
+		r.StoredPath = storedPath.String
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// MediaNeedingRehash returns rows whose checksums were computed with an
+// algorithm other than the given one
+func (d *DB) MediaNeedingRehash(algorithm string) ([]MediaRecord, error) {
+	rows, err := d.db.Query("SELECT checksum, size, stored_path, hash_algorithm FROM media WHERE hash_algorithm IS NULL OR hash_algorithm != ?", algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("error querying media to rehash: %v", err)
+	}
+	defer rows.Close()
+
+	records := make([]MediaRecord, 0)
+	for rows.Next() {
+		var r MediaRecord
+		var storedPath, hashAlgorithm sql.NullString
+		if err := rows.Scan(&r.Checksum, &r.Size, &storedPath, &hashAlgorithm); err != nil {
+			return nil, fmt.Errorf("error reading media row: %v", err)
+		}
+		r.StoredPath = storedPath.String
+		r.HashAlgorithm = hashAlgorithm.String
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// UpdateChecksums replaces a row's checksums after rehashing it with a different algorithm
+// Metadata rows are keyed by checksum, so they move along.
+func (d *DB) UpdateChecksums(oldChecksum string, algorithm string, checksum string, checksum100k string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE media SET checksum = ?, checksum100k = ?, hash_algorithm = ? WHERE checksum = ?", checksum, checksum100k, algorithm, oldChecksum)
+	if err != nil {
+		return fmt.Errorf("error updating checksums for %s: %v", oldChecksum, err)
+	}
+	if _, err := tx.Exec("UPDATE media_metadata SET checksum = ? WHERE checksum = ?", checksum, oldChecksum); err != nil {
+		return fmt.Errorf("error updating metadata for %s: %v", oldChecksum, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// SetStoredPath records where a file now lives under SaveDir
+func (d *DB) SetStoredPath(checksum string, storedPath string) error {
+	_, err := d.db.Exec("UPDATE media SET stored_path = ? WHERE checksum = ?", storedPath, checksum)
+	if err != nil {
+		return fmt.Errorf("error updating stored path for %s: %v", checksum, err)
+	}
+	return nil
+}
+
+// StoredPathExists reports whether a row records storedPath as its file
+func (d *DB) StoredPathExists(storedPath string) (bool, error) {
+	var count int
+	err := d.db.QueryRow("SELECT count(*) FROM media WHERE stored_path = ?", storedPath).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error looking up stored path %s: %v", storedPath, err)
+	}
+	return count > 0, nil
+}
+
+// DeleteMedia removes a row, so the same file can be uploaded again
+func (d *DB) DeleteMedia(checksum string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if err := deleteMediaRow(tx, checksum); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// deleteMediaRow removes a row along with its metadata
+func deleteMediaRow(tx *sql.Tx, checksum string) error {
+	if _, err := tx.Exec("DELETE FROM media_metadata WHERE checksum = ?", checksum); err != nil {
+		return fmt.Errorf("error deleting metadata for %s: %v", checksum, err)
+	}
+	if _, err := tx.Exec("DELETE FROM media WHERE checksum = ?", checksum); err != nil {
+		return fmt.Errorf("error deleting media %s: %v", checksum, err)
+	}
+	return nil
+}
+
 // openDBWithRetry attempts to open database connection with retry logic
 // This handles transient connection errors and network issues
 func (d *DB) openDBWithRetry(maxRetries int, retryDelay time.Duration) error {
@@ -242,8 +487,8 @@ func (d *DB) openDBWithRetry(maxRetries int, retryDelay time.Duration) error {
 		}
 		
 		if i < maxRetries-1 {
-			fmt.Printf("Database connection attempt %d/%d failed: %v, retrying in %v...\n", 
-				i+1, maxRetries, err, retryDelay)
+			slog.Warn("Database connection attempt failed, retrying",
+				"attempt", i+1, "max_attempts", maxRetries, "error", err, "delay", retryDelay)
 			time.Sleep(retryDelay)
 			retryDelay *= 2 // Exponential backoff
 		}
@@ -251,12 +496,26 @@ func (d *DB) openDBWithRetry(maxRetries int, retryDelay time.Duration) error {
 	return fmt.Errorf("failed to open database after %d attempts: %v", maxRetries, err)
 }
 
-func (d *DB)Init() error {
+// OpenDB opens the database and applies connection settings without running
+// migrations or preparing statements
+// Maintenance commands such as -migrate-status use this so they never change the schema
+func OpenDB(filename string, config *Config) (*DB, error) {
+	db := &DB{}
+	db.filename = filename
+	db.config = config
+	if err := db.open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// open connects to the database file and configures the connection pool and pragmas
+func (d *DB) open() error {
 	// Open database with retry logic for better resilience
 	// Retry up to 3 times with exponential backoff (100ms, 200ms, 400ms)
 	err := d.openDBWithRetry(3, 100*time.Millisecond)
 	if err != nil {
-		fmt.Printf("Error opening database: %v\n", err)
+		slog.Error("Error opening database", "error", err)
 		return err
 	}
 
@@ -274,7 +533,7 @@ func (d *DB)Init() error {
 	// - Atomic transactions even on crashes
 	_, err = d.db.Exec("PRAGMA journal_mode=WAL")
 	if err != nil {
-		fmt.Printf("Warning: Could not enable WAL mode: %v\n", err)
+		slog.Warn("Could not enable WAL mode", "error", err)
 		// Continue anyway - WAL is not strictly required but highly recommended
 	}
 	
@@ -283,49 +542,38 @@ func (d *DB)Init() error {
 	// WAL + NORMAL provides durability guarantees while being faster than default
 	_, err = d.db.Exec("PRAGMA synchronous=NORMAL")
 	if err != nil {
-		fmt.Printf("Warning: Could not set synchronous mode: %v\n", err)
+		slog.Warn("Could not set synchronous mode", "error", err)
 	}
 	
 	// Enable foreign key constraints (if needed in future)
 	_, err = d.db.Exec("PRAGMA foreign_keys=ON")
 	if err != nil {
-		fmt.Printf("Warning: Could not enable foreign keys: %v\n", err)
+		slog.Warn("Could not enable foreign keys", "error", err)
 	}
 
-	// Create tables
-	stmt := `
-	CREATE TABLE IF NOT EXISTS
-		settings (
-			setting CHAR UNIQUE,
-			value CHAR
-		)
-	`
-	err = d.DbExec(stmt)
+	return nil
+}
+
+func (d *DB)Init() error {
+	err := d.open()
 	if err != nil {
 		return err
 	}
 
-	stmt = `
-	CREATE TABLE IF NOT EXISTS
-		media (
-			filename CHAR,
-			checksum CHAR UNIQUE,
-			checksum100k CHAR,
-			size INT,
-			create_date TIMESTAMP
-		)
-	`
-	err = d.DbExec(stmt)
+	// Bring the schema up to date before touching any tables
+	// See migrate.go for the ordered list of schema changes
+	err = d.Migrate()
 	if err != nil {
+		slog.Error("Error migrating database", "error", err)
 		return err
 	}
-	
+
 	// Ensure UNIQUE constraint is enforced (atomic operation prevents race conditions)
 	// This constraint is critical for preventing duplicate files
 	// SQLite will automatically create an index for UNIQUE constraints, but we verify it exists
 	err = d.DbExec("CREATE UNIQUE INDEX IF NOT EXISTS idx_checksum_unique ON media(checksum)")
 	if err != nil {
-		fmt.Printf("Warning: Could not create unique index on checksum: %v\n", err)
+		slog.Warn("Could not create unique index on checksum", "error", err)
 		// Continue - the UNIQUE constraint in table definition should still work
 	}
 
@@ -338,7 +586,7 @@ func (d *DB)Init() error {
 	err = d.createIndexes()
 	if err != nil {
 		// Index creation failure is not fatal, but log it
-		fmt.Printf("Warning: Some indexes could not be created: %v\n", err)
+		slog.Warn("Some indexes could not be created", "error", err)
 	}
 
 	// Prepare all statements once during initialization
@@ -356,7 +604,7 @@ func (d *DB)Init() error {
 		return fmt.Errorf("unable to prepare Checksum100kExists statement: %v", err)
 	}
 
-	d.stmtAddFile, err = d.db.Prepare("INSERT INTO media (filename, checksum, checksum100k, size, create_date) VALUES (?, ?, ?, ?, ?)")
+	d.stmtAddFile, err = d.db.Prepare("INSERT INTO media (" + mediaColumns + ") VALUES (" + placeholders(strings.Count(mediaColumns, ",")+1) + ")")
 	if err != nil {
 		return fmt.Errorf("unable to prepare AddFile statement: %v", err)
 	}
@@ -421,13 +669,18 @@ func (d *DB) createIndexes() error {
 			stmt:    "CREATE INDEX IF NOT EXISTS idx_filename ON media(filename)",
 			purpose: "Speeds up filename lookups (if needed for future features)",
 		},
+		{
+			name:    "idx_stored_path",
+			stmt:    "CREATE INDEX IF NOT EXISTS idx_stored_path ON media(stored_path)",
+			purpose: "Speeds up finding the DB row for a file under SaveDir",
+		},
 	}
 
 	var lastErr error
 	for _, idx := range indexes {
 		err := d.DbExec(idx.stmt)
 		if err != nil {
-			fmt.Printf("Warning: Could not create index %s (%s): %v\n", idx.name, idx.purpose, err)
+			slog.Warn("Could not create index", "index", idx.name, "purpose", idx.purpose, "error", err)
 			lastErr = err
 		}
 	}
@@ -442,6 +695,7 @@ func (d *DB) VerifyIndexes() (map[string]bool, error) {
 		"idx_checksum100k": false,
 		"idx_create_date":  false,
 		"idx_filename":     false,
+		"idx_stored_path":  false,
 	}
 
 	// SQLite stores index information in sqlite_master table
@@ -469,6 +723,79 @@ func (d *DB) VerifyIndexes() (map[string]bool, error) {
 	return indexes, nil
 }
 
+// backfillStoredPaths sets stored_path on rows that predate the column by walking
+// saveDir and matching files to rows by checksum.
+// Only files whose size matches a row still missing a path are hashed, so the
+// walk stays cheap on large libraries.
+func backfillStoredPaths(db dbExecutor, dbFilename string, saveDir string) error {
+	rows, err := db.Query("SELECT checksum, size FROM media WHERE stored_path IS NULL")
+	if err != nil {
+		return fmt.Errorf("error querying rows without stored_path: %v", err)
+	}
+	pending := make(map[string]bool)
+	sizes := make(map[int64]bool)
+	for rows.Next() {
+		var checksum string
+		var size int64
+		if err := rows.Scan(&checksum, &size); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning media row: %v", err)
+		}
+		pending[checksum] = true
+		sizes[size] = true
+	}
+	rows.Close()
+
+	if len(pending) == 0 || len(saveDir) == 0 {
+		return nil
+	}
+
+	slog.Info("Backfilling stored paths", "files", len(pending), "savedir", saveDir)
+
+	dbFile, _ := filepath.Abs(dbFilename)
+	updated := 0
+	err = filepath.Walk(saveDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // Continue on errors
+		}
+		if info.IsDir() || !sizes[info.Size()] {
+			return nil
+		}
+		if strings.HasSuffix(path, ".download") {
+			return nil
+		}
+		if absPath, _ := filepath.Abs(path); strings.HasPrefix(absPath, dbFile) {
+			// Skip the database itself (and its -wal/-shm files)
+			return nil
+		}
+
+		// Rows that predate stored_path also predate per-row hash algorithms
+		sum, err := ChecksumWith(hashers[LegacyHashAlgorithm], path, false)
+		if err != nil {
+			slog.Warn("Unable to checksum file", "path", path, "error", err)
+			return nil
+		}
+		if !pending[sum] {
+			return nil
+		}
+
+		_, err = db.Exec("UPDATE media SET stored_path = ? WHERE checksum = ? AND stored_path IS NULL", path, sum)
+		if err != nil {
+			slog.Warn("Unable to record stored path", "path", path, "error", err)
+			return nil
+		}
+		delete(pending, sum)
+		updated++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Backfilled stored paths", "updated", updated, "unmatched", len(pending))
+	return nil
+}
+
 func (d *DB) Open() (error) {
 	var err error
 	d.db, err = sql.Open("sqlite3", d.filename)
@@ -0,0 +1,252 @@
+package sortengine
+
+// Deleting media
+// DeleteMedia removes a file from SaveDir together with its row. Deleting with
+// reject also records the checksum in the rejected table, so junk that was
+// cleaned out (screenshots, blurry shots) isn't uploaded again the next time
+// a client syncs the folder it came from.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RejectedChecksum is a file that was deleted with reject and is refused if uploaded again
+type RejectedChecksum struct {
+	Checksum     string    `json:"checksum"`
+	Checksum100k string    `json:"checksum100k"`
+	Filename     string    `json:"filename"` // The client path it was originally uploaded from
+	RejectedBy   string    `json:"rejected_by,omitempty"`
+	RejectedAt   time.Time `json:"rejected_at"`
+
+	HashAlgorithm string `json:"hash_algorithm"`        // Algorithm Checksum was computed with; empty if unknown
+	StoredPath    string `json:"stored_path,omitempty"` // Where the file was under SaveDir before it was deleted
+}
+
+// DeleteMedia removes the file with the given checksum from SaveDir and the
+// database, returning its record, or nil if there is no such file. With reject
+// set the checksum is refused from then on.
+// fileRemoved is false if only the row was deleted because the file wasn't
+// found: a row that predates stored_path is looked up by checksum first.
+// The row goes first: if the file can't be removed afterwards it is left
+// behind as an orphan for scrub to find, rather than a row without a file.
+func (e *Engine) DeleteMedia(checksum string, reject bool, rejectedBy string) (record *MediaRecord, fileRemoved bool, err error) {
+	records, _, err := e.DB.QueryMedia(MediaQuery{Checksum: checksum})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(records) == 0 {
+		return nil, false, nil
+	}
+	r := records[0]
+
+	saveDir := filepath.Clean(e.Config.Server.SaveDir)
+	if r.StoredPath == "" {
+		if r.StoredPath, err = e.findStoredFile(r); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if reject {
+		err = e.DB.RejectMedia(r, rejectedBy)
+	} else {
+		err = e.DB.DeleteMedia(r.Checksum)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if r.StoredPath == "" {
+		slog.Warn("Deleted row whose file could not be found", "checksum", r.Checksum, "filename", r.Filename)
+		return &r, false, nil
+	}
+	if !strings.HasPrefix(filepath.Clean(r.StoredPath), saveDir+string(filepath.Separator)) {
+		return &r, false, fmt.Errorf("removed from the database, but not deleting %s: it is outside the save directory", r.StoredPath)
+	}
+	if err := os.Remove(r.StoredPath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Deleted row whose file was already gone", "checksum", r.Checksum, "stored_path", r.StoredPath)
+			return &r, false, nil
+		}
+		return &r, false, fmt.Errorf("removed from the database, but the file could not be deleted: %v", err)
+	}
+	removeEmptyDirs(filepath.Dir(r.StoredPath), saveDir)
+	return &r, true, nil
+}
+
+// findStoredFile looks for the file of a row without a stored_path, one the
+// stored_path backfill couldn't match, by hashing the files under SaveDir
+// that have its size. It returns "" if there is none.
+func (e *Engine) findStoredFile(r MediaRecord) (string, error) {
+	algorithm := r.HashAlgorithm
+	if algorithm == "" {
+		algorithm = LegacyHashAlgorithm
+	}
+	h, err := GetHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	saveDir := filepath.Clean(e.Config.Server.SaveDir)
+	found := ""
+	err = filepath.WalkDir(saveDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Continue on errors
+		}
+		if d.IsDir() {
+			if path != saveDir && (d.Name() == QuarantineDirName || d.Name() == UploadsDirName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".download") {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() != r.Size {
+			return nil
+		}
+		sum, err := ChecksumWith(h, path, false)
+		if err != nil {
+			slog.Warn("Unable to checksum file", "path", path, "error", err)
+			return nil
+		}
+		if sum == r.Checksum {
+			found = path
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error walking %s: %v", saveDir, err)
+	}
+	return found, nil
+}
+
+// removeRejectedFile deletes a file found under SaveDir whose checksum was
+// rejected: DeleteMedia removed its row but couldn't remove the file. The file
+// must not be indexed again, so removing it is retried instead.
+func (e *Engine) removeRejectedFile(path string) error {
+	saveDir := filepath.Clean(e.Config.Server.SaveDir)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Unable to remove rejected file", "path", path, "error", err)
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(path), saveDir)
+	slog.Info("Removed rejected file", "path", path)
+	return nil
+}
+
+// RejectMedia deletes a row and records its checksum as rejected, in one transaction
+func (d *DB) RejectMedia(r MediaRecord, rejectedBy string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteMediaRow(tx, r.Checksum); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO rejected (checksum, checksum100k, filename, rejected_by, rejected_at, hash_algorithm, stored_path) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(checksum) DO UPDATE SET rejected_by = excluded.rejected_by, rejected_at = excluded.rejected_at, stored_path = excluded.stored_path
+	`, r.Checksum, r.Checksum100k, r.Filename, rejectedBy, time.Now().Unix(), r.HashAlgorithm, r.StoredPath)
+	if err != nil {
+		return fmt.Errorf("error rejecting %s: %v", r.Checksum, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// ChecksumRejected reports whether a checksum computed with algorithm was
+// deleted with reject. Rows hashed with another algorithm don't count until
+// -rehash has converted them.
+// Like ChecksumExists, errors count as "no" so uploads aren't blocked by them.
+func (d *DB) ChecksumRejected(checksum string, algorithm string) bool {
+	var count int
+	if err := d.db.QueryRow("SELECT count(*) FROM rejected WHERE checksum = ? AND hash_algorithm = ?", checksum, algorithm).Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// Checksum100kRejected reports whether a rejected file hashed with algorithm has the given checksum100k
+func (d *DB) Checksum100kRejected(checksum100k string, algorithm string) bool {
+	var count int
+	if err := d.db.QueryRow("SELECT count(*) FROM rejected WHERE checksum100k = ? AND hash_algorithm = ?", checksum100k, algorithm).Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// RejectedChecksums returns every rejected checksum, most recently rejected first
+func (d *DB) RejectedChecksums() ([]RejectedChecksum, error) {
+	return d.queryRejected("ORDER BY rejected_at DESC")
+}
+
+// RejectedNeedingRehash returns rejected checksums computed with an algorithm
+// other than the given one, or with an unknown one
+func (d *DB) RejectedNeedingRehash(algorithm string) ([]RejectedChecksum, error) {
+	return d.queryRejected("WHERE hash_algorithm IS NULL OR hash_algorithm != ? ORDER BY rejected_at DESC", algorithm)
+}
+
+// queryRejected reads rejected rows; clauses is appended to the SELECT
+func (d *DB) queryRejected(clauses string, args ...interface{}) ([]RejectedChecksum, error) {
+	rows, err := d.db.Query("SELECT checksum, checksum100k, filename, rejected_by, rejected_at, hash_algorithm, stored_path FROM rejected "+clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying rejected checksums: %v", err)
+	}
+	defer rows.Close()
+
+	rejected := make([]RejectedChecksum, 0)
+	for rows.Next() {
+		var r RejectedChecksum
+		var checksum100k, filename, rejectedBy, hashAlgorithm, storedPath sql.NullString
+		var rejectedAt int64
+		if err := rows.Scan(&r.Checksum, &checksum100k, &filename, &rejectedBy, &rejectedAt, &hashAlgorithm, &storedPath); err != nil {
+			return nil, fmt.Errorf("error reading rejected row: %v", err)
+		}
+		r.Checksum100k = checksum100k.String
+		r.Filename = filename.String
+		r.RejectedBy = rejectedBy.String
+		r.RejectedAt = time.Unix(rejectedAt, 0).UTC()
+		r.HashAlgorithm = hashAlgorithm.String
+		r.StoredPath = storedPath.String
+		rejected = append(rejected, r)
+	}
+	return rejected, rows.Err()
+}
+
+// UpdateRejectedChecksums replaces a rejected row's checksums after rehashing
+// its file with a different algorithm. If the new checksum is already
+// rejected the old row is simply dropped.
+func (d *DB) UpdateRejectedChecksums(oldChecksum string, algorithm string, checksum string, checksum100k string) error {
+	_, err := d.db.Exec("UPDATE OR REPLACE rejected SET checksum = ?, checksum100k = ?, hash_algorithm = ? WHERE checksum = ?", checksum, checksum100k, algorithm, oldChecksum)
+	if err != nil {
+		return fmt.Errorf("error updating rejected checksums for %s: %v", oldChecksum, err)
+	}
+	return nil
+}
+
+// UnrejectChecksum allows a rejected checksum to be uploaded again
+// Returns false if the checksum wasn't rejected.
+func (d *DB) UnrejectChecksum(checksum string) (bool, error) {
+	result, err := d.db.Exec("DELETE FROM rejected WHERE checksum = ?", checksum)
+	if err != nil {
+		return false, fmt.Errorf("error unrejecting %s: %v", checksum, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error unrejecting %s: %v", checksum, err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package sortengine
+
+import (
+	"syscall"
+)
+
+// DiskSpace returns the bytes available to this process and the total size
+// of the filesystem holding path
+func DiskSpace(path string) (free uint64, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
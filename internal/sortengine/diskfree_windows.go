@@ -0,0 +1,24 @@
+//go:build windows
+
+package sortengine
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// DiskSpace returns the bytes available to this process and the total size
+// of the volume holding path
+func DiskSpace(path string) (free uint64, total uint64, err error) {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	ret, _, callErr := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathp)), uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), 0)
+	if ret == 0 {
+		return 0, 0, callErr
+	}
+	return free, total, nil
+}
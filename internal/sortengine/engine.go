@@ -1,17 +1,19 @@
 package sortengine
 
 import (
+	"errors"
 	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"fmt"
-	"io"
-	"crypto/sha256"
-	"crypto/md5"
-	"hash"
 )
 
+// ErrAlreadyStored is returned by GetNewFilename when the file being stored is
+// already on disk under the name it would get, but has no database row
+var ErrAlreadyStored = errors.New("the same file is already stored")
+
 func FileOrDirExists(path string) bool {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return false
@@ -44,6 +46,13 @@ func NewEngineWithConfig(config *Config) *Engine {
 	engine.report["duplicate"] = make([]string, 0)
 	engine.report["unsorted"]  = make([]string, 0)
 	engine.count               = 0
+
+	// Config.Validate has normally rejected a bad layout already
+	layout, err := ParseLayout(engine.Config.Server.Layout)
+	if err != nil {
+		log.Fatalf("Invalid server.layout %q: %v", engine.Config.Server.Layout, err)
+	}
+	engine.layout = layout
 	return engine
 }
 
@@ -53,57 +62,95 @@ type Engine struct {
 	report map[string][]string
 	count uint64
 	Config *Config
+	layout *Layout // Parsed server.layout
 }
 
-func (e *Engine) GetNewFilename(m *Media) (string) {
+func (e *Engine) GetNewFilename(m *Media) (string, error) {
 	// fmt.Printf("  Getting new filename: %s\n",
-	dst := e.Config.Server.SaveDir
-
-	TimeDirFormat := "2006-01"
-	TimeFormat := "2006-01-02 15.04.05"
-	num := 0
-
-	dirname := filepath.Join(dst, m.CreationDate.Format(TimeDirFormat))
+	dirname := e.newFileDir(m)
 	
 	// Ensure directory exists
 	if err := os.MkdirAll(dirname, 0755); err != nil {
-		panic(fmt.Sprintf("Cannot create directory %s: %v", dirname, err))
+		return "", fmt.Errorf("cannot create directory %s: %v", dirname, err)
 	}
 	
+	return e.nextFreeFilename(m, dirname, nil, true, "")
+}
+
+// PredictNewFilename returns the path GetNewFilename would choose for m right
+// now, without creating any directories. Names in reserved count as taken and
+// the chosen name is added to it, so predicting a whole batch gives each file
+// the name it would get if the batch were uploaded in order.
+func (e *Engine) PredictNewFilename(m *Media, reserved map[string]bool) (string, error) {
+	filename, err := e.nextFreeFilename(m, e.newFileDir(m), reserved, false, "")
+	if err != nil {
+		return "", err
+	}
+	if reserved != nil {
+		reserved[filename] = true
+	}
+	return filename, nil
+}
+
+// newFileDir returns the directory under SaveDir a file is sorted into
+func (e *Engine) newFileDir(m *Media) string {
+	return filepath.Join(e.Config.Server.SaveDir, e.layout.Dir(m))
+}
+
+// nextFreeFilename finds the first unused name for m in dirname, counting up
+// the layout's {seq} (.1, .2, ...) for files that would get the same name.
+// With verify set, an existing file is hashed to make sure it isn't the same
+// file, which the DB should have caught. current is where the file already is,
+// if anywhere; that name counts as free (see Reorganize).
+// Returns ErrAlreadyStored if verify finds the same file already there.
+func (e *Engine) nextFreeFilename(m *Media, dirname string, reserved map[string]bool, verify bool, current string) (string, error) {
+	dst := e.Config.Server.SaveDir
+
+	num := 0
+
 	for {
-		shortname := m.CreationDate.Format(TimeFormat)
-		if num > 0 {
-			shortname = fmt.Sprintf("%s.%d", shortname, num)
-		}
-		shortname = fmt.Sprintf("%s.%s", shortname, m.Ext())
-		filename := filepath.Join(dirname, shortname)
+		filename := filepath.Join(dirname, e.layout.Filename(m, num))
 		
 		// CRITICAL: Validate path to prevent path traversal attacks
 		// Ensure the generated path is within the save directory
 		absFilename, err := filepath.Abs(filename)
 		if err != nil {
-			panic(fmt.Sprintf("Cannot get absolute path for %s: %v", filename, err))
+			return "", fmt.Errorf("cannot get absolute path for %s: %v", filename, err)
 		}
 		absSaveDir, err := filepath.Abs(dst)
 		if err != nil {
-			panic(fmt.Sprintf("Cannot get absolute path for save directory %s: %v", dst, err))
+			return "", fmt.Errorf("cannot get absolute path for save directory %s: %v", dst, err)
 		}
-		if !strings.HasPrefix(absFilename, absSaveDir) {
-			panic(fmt.Sprintf("Path traversal detected: %s is outside save directory %s", absFilename, absSaveDir))
+		if !strings.HasPrefix(absFilename, absSaveDir+string(filepath.Separator)) {
+			return "", fmt.Errorf("path traversal detected: %s is outside save directory %s", absFilename, absSaveDir)
 		}
 
+		if current != "" && filename == current {
+			return filename, nil
+		}
+		if reserved[filename] {
+			num += 1
+			continue
+		}
 		if FileOrDirExists(filename) {
-			sum, err := checksum(filename)
-			if err != nil {
-				panic(err)
-			}
-			if m.Checksum == sum {
-				panic("Shouldn't be able to hit this.  Existing checksum should have been found in the DB.")
+			if verify {
+				h, err := m.Hasher()
+				if err != nil {
+					return "", err
+				}
+				sum, err := ChecksumWith(h, filename, false)
+				if err != nil {
+					return "", fmt.Errorf("cannot checksum existing file %s: %v", filename, err)
+				}
+				if m.Checksum == sum {
+					// The DB should have caught this; the file is on disk without a row
+					return "", fmt.Errorf("%w: %s", ErrAlreadyStored, filename)
+				}
 			}
 			num += 1
 			continue
 		} else {
-			return filename
+			return filename, nil
 		}
 	}
 }
@@ -199,56 +246,101 @@ func (e *Engine) GetNewFilename(m *Media) (string) {
 // 	return nil
 // }
 
-func (e *Engine) Report() {
-	for k, v := range e.report {
-		fmt.Printf("\n%s:\n", k)
-		var count uint64 = 0
-		for _, item := range v {
-			count += 1
-			fmt.Printf("%10d: %s\n", count, item)
-		}
-	}
+// RehashResult counts what Rehash did
+type RehashResult struct {
+	Updated  int
+	Skipped  int
+	Rejected int // Rejected checksums converted to the new algorithm
+
+	// StaleRejected are rejected checksums that couldn't be converted because
+	// their file is gone. They no longer match uploads, so these files can be
+	// uploaded again until an admin deletes them with reject once more.
+	StaleRejected []RejectedChecksum
 }
 
-func checksum100k(filename string) (string, error) {
-	f, err := os.Open(filename)
+// Rehash recomputes checksums for every row that was hashed with a different
+// algorithm than the configured one, reading each file from its stored_path.
+// This is the migration path when switching server.hash_algorithm (e.g. MD5 -> SHA-256).
+// Rows whose file cannot be found are left untouched and counted as skipped.
+// Rejected checksums are converted the same way when their file is still
+// there; the others are returned in StaleRejected.
+func (e *Engine) Rehash() (RehashResult, error) {
+	var result RehashResult
+	algorithm := e.Config.Server.HashAlgorithm
+	h, err := GetHasher(algorithm)
 	if err != nil {
-		return "", err
+		return result, err
 	}
-	defer f.Close()
-
-	// Set the checksum function
-	h := md5.New()
 
-	// Get the file's checksum
-	var BUFSIZE int64 = 102400
-	_, err = io.CopyN(h, f, BUFSIZE)
+	records, err := e.DB.MediaNeedingRehash(algorithm)
 	if err != nil {
-		return "", err
+		return result, err
 	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
+	slog.Info("Rehashing files", "files", len(records), "algorithm", algorithm)
 
-func checksum(filename string) (string, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
+	for i, r := range records {
+		if r.StoredPath == "" || !FileOrDirExists(r.StoredPath) {
+			slog.Warn("No stored file for checksum, skipping", "checksum", r.Checksum)
+			result.Skipped++
+			continue
+		}
 
-	// Set the checksum function
-	ChecksumFunctions := map[string]func() hash.Hash {
-		"sha256": sha256.New,
-		"md5":    md5.New,
+		sum, sum100k, err := ChecksumsWith(h, r.StoredPath)
+		if err != nil {
+			slog.Warn("Unable to checksum file", "path", r.StoredPath, "error", err)
+			result.Skipped++
+			continue
+		}
+
+		if err := e.DB.UpdateChecksums(r.Checksum, algorithm, sum, sum100k); err != nil {
+			slog.Warn("Unable to update checksums", "checksum", r.Checksum, "error", err)
+			result.Skipped++
+			continue
+		}
+		result.Updated++
+
+		if (i+1)%100 == 0 {
+			slog.Info("Rehash progress", "done", i+1, "total", len(records))
+		}
 	}
-	checksumFormat := "sha256"
-	h := ChecksumFunctions[checksumFormat]()
 
-	// Get the file's checksum
-	_, err = io.Copy(h, f)
+	rejected, err := e.DB.RejectedNeedingRehash(algorithm)
 	if err != nil {
-		return "", err
+		return result, err
 	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	saveDir := filepath.Clean(e.Config.Server.SaveDir)
+	for _, r := range rejected {
+		// Only files still in the library are read; the client's path means
+		// nothing on the server
+		if r.StoredPath == "" || !strings.HasPrefix(filepath.Clean(r.StoredPath), saveDir+string(filepath.Separator)) || !FileOrDirExists(r.StoredPath) {
+			result.StaleRejected = append(result.StaleRejected, r)
+			continue
+		}
+		sum, sum100k, err := ChecksumsWith(h, r.StoredPath)
+		if err == nil {
+			err = e.DB.UpdateRejectedChecksums(r.Checksum, algorithm, sum, sum100k)
+		}
+		if err != nil {
+			slog.Warn("Unable to rehash rejected file", "path", r.StoredPath, "error", err)
+			result.StaleRejected = append(result.StaleRejected, r)
+			continue
+		}
+		result.Rejected++
+	}
+	if len(result.StaleRejected) > 0 {
+		slog.Warn("Rejected checksums could not be rehashed, their files are gone", "count", len(result.StaleRejected), "algorithm", algorithm)
+	}
+
+	return result, nil
 }
 
+func (e *Engine) Report() {
+	for k, v := range e.report {
+		fmt.Printf("\n%s:\n", k)
+		var count uint64 = 0
+		for _, item := range v {
+			count += 1
+			fmt.Printf("%10d: %s\n", count, item)
+		}
+	}
+}
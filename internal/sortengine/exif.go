@@ -0,0 +1,296 @@
+package sortengine
+
+// EXIF parsing for NativeReader
+// EXIF data is a TIFF structure: a header giving the byte order, then
+// directories (IFDs) of tagged values pointing at each other. JPEG keeps it in
+// an APP1 segment, HEIC in an "Exif" item, and TIFF files are one. Only the
+// tags below are read, under the names exiftool gives them, formatted the
+// way exiftool prints them so PromoteMetadata and GetDate handle both alike.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// EXIF tags pointing at other directories
+const (
+	exifIFDPointer = 0x8769
+	gpsIFDPointer  = 0x8825
+)
+
+// exifTags names the tags read from IFD0 and the Exif IFD
+var exifTags = map[uint16]string{
+	0x0100: "ImageWidth",
+	0x0101: "ImageHeight",
+	0x010F: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x0131: "Software",
+	0x0132: "ModifyDate",
+	0x013B: "Artist",
+	0x829A: "ExposureTime",
+	0x829D: "FNumber",
+	0x8827: "ISO",
+	0x9003: "DateTimeOriginal",
+	0x9004: "CreateDate",
+	0x9010: "OffsetTime",
+	0x9011: "OffsetTimeOriginal",
+	0x920A: "FocalLength",
+	0xA002: "ExifImageWidth",
+	0xA003: "ExifImageHeight",
+	0xA433: "LensMake",
+	0xA434: "LensModel",
+}
+
+// gpsTags names the tags read from the GPS IFD
+var gpsTags = map[uint16]string{
+	0x0001: "GPSLatitudeRef",
+	0x0002: "GPSLatitude",
+	0x0003: "GPSLongitudeRef",
+	0x0004: "GPSLongitude",
+	0x0006: "GPSAltitude",
+}
+
+// orientationNames are exiftool's names for the EXIF orientation values
+var orientationNames = []string{
+	1: "Horizontal (normal)",
+	2: "Mirror horizontal",
+	3: "Rotate 180",
+	4: "Mirror vertical",
+	5: "Mirror horizontal and rotate 270 CW",
+	6: "Rotate 90 CW",
+	7: "Mirror horizontal and rotate 90 CW",
+	8: "Rotate 270 CW",
+}
+
+// TIFF field types and their sizes in bytes
+const (
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffUndefined = 7
+	tiffSLong     = 9
+	tiffSRational = 10
+)
+
+var tiffTypeSizes = map[uint16]int64{
+	tiffByte:      1,
+	tiffASCII:     1,
+	tiffShort:     2,
+	tiffLong:      4,
+	tiffRational:  8,
+	tiffUndefined: 1,
+	tiffSLong:     4,
+	tiffSRational: 8,
+}
+
+// Limits against corrupt or hostile files
+const (
+	maxIFDEntries = 1000
+	maxTIFFValue  = 64 * 1024
+)
+
+// tiffField is one directory entry with its raw value
+type tiffField struct {
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+// tiffReader reads a TIFF structure starting at base in r
+type tiffReader struct {
+	r     io.ReaderAt
+	base  int64
+	order binary.ByteOrder
+}
+
+// readEXIF reads the EXIF tags of a TIFF structure starting at base in r
+// into metadata
+func readEXIF(r io.ReaderAt, base int64, metadata map[string]string) error {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, base); err != nil {
+		return fmt.Errorf("unable to read TIFF header: %v", err)
+	}
+	t := &tiffReader{r: r, base: base}
+	switch string(header[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return errors.New("not a TIFF header")
+	}
+	if t.order.Uint16(header[2:]) != 42 {
+		return errors.New("not a TIFF header")
+	}
+
+	ifd0, err := t.readIFD(t.order.Uint32(header[4:]))
+	if err != nil {
+		return err
+	}
+	t.addFields(ifd0, exifTags, metadata)
+	// The sub-directories are optional; a broken one leaves the rest usable
+	if offset, ok := t.pointer(ifd0[exifIFDPointer]); ok {
+		if fields, err := t.readIFD(offset); err == nil {
+			t.addFields(fields, exifTags, metadata)
+		}
+	}
+	if offset, ok := t.pointer(ifd0[gpsIFDPointer]); ok {
+		if fields, err := t.readIFD(offset); err == nil {
+			t.addFields(fields, gpsTags, metadata)
+		}
+	}
+	return nil
+}
+
+// readIFD reads the directory at offset (from the TIFF header)
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]tiffField, error) {
+	buf := make([]byte, 2)
+	if _, err := t.r.ReadAt(buf, t.base+int64(offset)); err != nil {
+		return nil, fmt.Errorf("unable to read IFD: %v", err)
+	}
+	n := int(t.order.Uint16(buf))
+	if n > maxIFDEntries {
+		return nil, fmt.Errorf("IFD has %d entries", n)
+	}
+	entries := make([]byte, n*12)
+	if _, err := t.r.ReadAt(entries, t.base+int64(offset)+2); err != nil {
+		return nil, fmt.Errorf("unable to read IFD: %v", err)
+	}
+
+	fields := make(map[uint16]tiffField, n)
+	for i := 0; i < n; i++ {
+		entry := entries[i*12 : (i+1)*12]
+		tag := t.order.Uint16(entry)
+		f := tiffField{typ: t.order.Uint16(entry[2:]), count: t.order.Uint32(entry[4:])}
+		size, ok := tiffTypeSizes[f.typ]
+		if !ok || int64(f.count)*size > maxTIFFValue {
+			continue
+		}
+		length := int64(f.count) * size
+		if length <= 4 {
+			f.data = entry[8 : 8+length]
+		} else {
+			f.data = make([]byte, length)
+			if _, err := t.r.ReadAt(f.data, t.base+int64(t.order.Uint32(entry[8:]))); err != nil {
+				continue
+			}
+		}
+		fields[tag] = f
+	}
+	return fields, nil
+}
+
+// pointer returns the offset held by a sub-directory pointer
+func (t *tiffReader) pointer(f tiffField) (uint32, bool) {
+	if (f.typ != tiffLong && f.typ != tiffUndefined) || len(f.data) < 4 {
+		return 0, false
+	}
+	return t.order.Uint32(f.data), true
+}
+
+// addFields formats the named fields into metadata
+func (t *tiffReader) addFields(fields map[uint16]tiffField, names map[uint16]string, metadata map[string]string) {
+	for tag, f := range fields {
+		name, ok := names[tag]
+		if !ok {
+			continue
+		}
+		if value := t.format(name, f); value != "" {
+			metadata[name] = value
+		}
+	}
+}
+
+// format prints a field the way exiftool does
+func (t *tiffReader) format(name string, f tiffField) string {
+	switch name {
+	case "Orientation":
+		if n := t.integer(f, 0); n >= 1 && n < int64(len(orientationNames)) {
+			return orientationNames[n]
+		}
+		return ""
+	case "GPSLatitudeRef", "GPSLongitudeRef":
+		return map[string]string{"N": "North", "S": "South", "E": "East", "W": "West"}[t.ascii(f)]
+	case "GPSLatitude", "GPSLongitude":
+		if f.count < 3 {
+			return ""
+		}
+		// Cameras may write fractional degrees or minutes, so normalize
+		total := t.rational(f, 0) + t.rational(f, 1)/60 + t.rational(f, 2)/3600
+		degrees := math.Floor(total)
+		minutes := math.Floor((total - degrees) * 60)
+		seconds := ((total-degrees)*60 - minutes) * 60
+		return fmt.Sprintf("%d deg %d' %.2f\"", int(degrees), int(minutes), seconds)
+	case "GPSAltitude":
+		return fmt.Sprintf("%.1f m", t.rational(f, 0))
+	case "ExposureTime":
+		exposure := t.rational(f, 0)
+		if exposure > 0 && exposure < 0.25 {
+			return fmt.Sprintf("1/%d", int(math.Round(1/exposure)))
+		}
+		return fmt.Sprintf("%g", exposure)
+	case "FNumber":
+		return fmt.Sprintf("%.1f", t.rational(f, 0))
+	case "FocalLength":
+		return fmt.Sprintf("%.1f mm", t.rational(f, 0))
+	}
+
+	switch f.typ {
+	case tiffASCII, tiffUndefined:
+		return t.ascii(f)
+	case tiffRational, tiffSRational:
+		return fmt.Sprintf("%g", t.rational(f, 0))
+	case tiffByte, tiffShort, tiffLong, tiffSLong:
+		if f.count == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d", t.integer(f, 0))
+	}
+	return ""
+}
+
+// ascii returns a text field without its padding
+func (t *tiffReader) ascii(f tiffField) string {
+	return strings.TrimSpace(strings.TrimRight(string(f.data), "\x00"))
+}
+
+// integer returns the i-th value of an integer field
+func (t *tiffReader) integer(f tiffField, i int) int64 {
+	switch {
+	case f.typ == tiffByte && i < len(f.data):
+		return int64(f.data[i])
+	case f.typ == tiffShort && len(f.data) >= 2*(i+1):
+		return int64(t.order.Uint16(f.data[2*i:]))
+	case f.typ == tiffLong && len(f.data) >= 4*(i+1):
+		return int64(t.order.Uint32(f.data[4*i:]))
+	case f.typ == tiffSLong && len(f.data) >= 4*(i+1):
+		return int64(int32(t.order.Uint32(f.data[4*i:])))
+	}
+	return 0
+}
+
+// rational returns the i-th value of a rational field
+func (t *tiffReader) rational(f tiffField, i int) float64 {
+	if len(f.data) < 8*(i+1) {
+		return 0
+	}
+	if f.typ == tiffSRational {
+		num, den := int32(t.order.Uint32(f.data[8*i:])), int32(t.order.Uint32(f.data[8*i+4:]))
+		if den == 0 {
+			return 0
+		}
+		return float64(num) / float64(den)
+	}
+	num, den := t.order.Uint32(f.data[8*i:]), t.order.Uint32(f.data[8*i+4:])
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
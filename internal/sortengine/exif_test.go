@@ -0,0 +1,353 @@
+package sortengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// byteOrder is implemented by binary.LittleEndian and binary.BigEndian
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// tiffEntry is a directory entry for buildTIFF; values longer than 4 bytes
+// are placed after the directories
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func tiffASCIIEntry(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag: tag, typ: tiffASCII, count: uint32(len(s) + 1), value: []byte(s + "\x00")}
+}
+
+func tiffShortEntry(order byteOrder, tag uint16, n uint16) tiffEntry {
+	return tiffEntry{tag: tag, typ: tiffShort, count: 1, value: order.AppendUint16(nil, n)}
+}
+
+// tiffRationalEntry takes numerator, denominator pairs
+func tiffRationalEntry(order byteOrder, tag uint16, values ...uint32) tiffEntry {
+	var value []byte
+	for _, v := range values {
+		value = order.AppendUint32(value, v)
+	}
+	return tiffEntry{tag: tag, typ: tiffRational, count: uint32(len(values) / 2), value: value}
+}
+
+// buildTIFF lays out a TIFF structure: the header, IFD0, then the Exif and
+// GPS IFDs if given (with pointers to them added to IFD0), then the values
+// that don't fit in their entries
+func buildTIFF(order byteOrder, ifd0 []tiffEntry, exif []tiffEntry, gps []tiffEntry) []byte {
+	ifd0 = append([]tiffEntry(nil), ifd0...)
+	ifds := [][]tiffEntry{ifd0}
+	pointers := map[uint16]int{}
+	for _, sub := range []struct {
+		tag     uint16
+		entries []tiffEntry
+	}{{exifIFDPointer, exif}, {gpsIFDPointer, gps}} {
+		if sub.entries == nil {
+			continue
+		}
+		pointers[sub.tag] = len(ifds)
+		ifds[0] = append(ifds[0], tiffEntry{tag: sub.tag, typ: tiffLong, count: 1})
+		ifds = append(ifds, sub.entries)
+	}
+
+	offsets := make([]int, len(ifds))
+	offset := 8
+	for i, ifd := range ifds {
+		offsets[i] = offset
+		offset += 2 + 12*len(ifd) + 4
+	}
+
+	var out, data []byte
+	if order == binary.LittleEndian {
+		out = append(out, "II"...)
+	} else {
+		out = append(out, "MM"...)
+	}
+	out = order.AppendUint16(out, 42)
+	out = order.AppendUint32(out, 8)
+	for i, ifd := range ifds {
+		out = order.AppendUint16(out, uint16(len(ifd)))
+		for _, e := range ifd {
+			out = order.AppendUint16(out, e.tag)
+			out = order.AppendUint16(out, e.typ)
+			out = order.AppendUint32(out, e.count)
+			value := e.value
+			if sub, ok := pointers[e.tag]; ok && i == 0 {
+				value = order.AppendUint32(nil, uint32(offsets[sub]))
+			}
+			if len(value) > 4 {
+				out = order.AppendUint32(out, uint32(offset+len(data)))
+				data = append(data, value...)
+				if len(data)%2 == 1 {
+					data = append(data, 0)
+				}
+				continue
+			}
+			out = append(out, value...)
+			out = append(out, make([]byte, 4-len(value))...)
+		}
+		out = order.AppendUint32(out, 0)
+	}
+	return append(out, data...)
+}
+
+func TestReadEXIF(t *testing.T) {
+	tests := []struct {
+		name    string
+		tiff    func(o byteOrder) []byte
+		base    int64
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "ifd0",
+			tiff: func(o byteOrder) []byte {
+				return buildTIFF(o, []tiffEntry{
+					tiffASCIIEntry(0x010F, "Canon"),
+					tiffASCIIEntry(0x0110, "Canon EOS R5"),
+					tiffShortEntry(o, 0x0112, 6),
+					tiffASCIIEntry(0x0132, "2021:02:03 04:05:06"),
+					tiffASCIIEntry(0x9999, "not read"),
+				}, nil, nil)
+			},
+			want: map[string]string{
+				"Make":        "Canon",
+				"Model":       "Canon EOS R5",
+				"Orientation": "Rotate 90 CW",
+				"ModifyDate":  "2021:02:03 04:05:06",
+			},
+		},
+		{
+			name: "inline values",
+			tiff: func(o byteOrder) []byte {
+				return buildTIFF(o, []tiffEntry{
+					tiffASCIIEntry(0x010F, "LG"),
+					{tag: 0x0100, typ: tiffLong, count: 1, value: o.AppendUint32(nil, 4032)},
+					{tag: 0x0101, typ: tiffShort, count: 1, value: o.AppendUint16(nil, 3024)},
+				}, nil, nil)
+			},
+			want: map[string]string{"Make": "LG", "ImageWidth": "4032", "ImageHeight": "3024"},
+		},
+		{
+			name: "exif ifd",
+			tiff: func(o byteOrder) []byte {
+				return buildTIFF(o, []tiffEntry{tiffASCIIEntry(0x010F, "Nikon")}, []tiffEntry{
+					tiffASCIIEntry(0x9003, "2019:07:04 18:30:00"),
+					tiffShortEntry(o, 0x8827, 400),
+					tiffRationalEntry(o, 0x829A, 1, 250),
+					tiffRationalEntry(o, 0x829D, 28, 10),
+					tiffRationalEntry(o, 0x920A, 50, 1),
+					tiffASCIIEntry(0xA434, "NIKKOR Z 50mm f/1.8 S"),
+				}, nil)
+			},
+			want: map[string]string{
+				"Make":             "Nikon",
+				"DateTimeOriginal": "2019:07:04 18:30:00",
+				"ISO":              "400",
+				"ExposureTime":     "1/250",
+				"FNumber":          "2.8",
+				"FocalLength":      "50.0 mm",
+				"LensModel":        "NIKKOR Z 50mm f/1.8 S",
+			},
+		},
+		{
+			name: "gps ifd",
+			tiff: func(o byteOrder) []byte {
+				return buildTIFF(o, nil, nil, []tiffEntry{
+					tiffASCIIEntry(0x0001, "N"),
+					tiffRationalEntry(o, 0x0002, 37, 1, 46, 1, 2964, 100),
+					tiffASCIIEntry(0x0003, "W"),
+					// Fractional minutes are normalized to seconds
+					tiffRationalEntry(o, 0x0004, 122, 1, 2516, 100, 0, 1),
+					tiffRationalEntry(o, 0x0006, 12, 1),
+				})
+			},
+			want: map[string]string{
+				"GPSLatitudeRef":  "North",
+				"GPSLatitude":     `37 deg 46' 29.64"`,
+				"GPSLongitudeRef": "West",
+				"GPSLongitude":    `122 deg 25' 9.60"`,
+				"GPSAltitude":     "12.0 m",
+			},
+		},
+		{
+			name: "base offset",
+			tiff: func(o byteOrder) []byte {
+				return append([]byte("0123456789"), buildTIFF(o, []tiffEntry{tiffASCIIEntry(0x010F, "Fujifilm")}, nil, nil)...)
+			},
+			base: 10,
+			want: map[string]string{"Make": "Fujifilm"},
+		},
+		{
+			name: "bad values",
+			tiff: func(o byteOrder) []byte {
+				return buildTIFF(o, []tiffEntry{
+					tiffASCIIEntry(0x010F, "Sony"),
+					tiffShortEntry(o, 0x0112, 9),                             // No such orientation
+					tiffRationalEntry(o, 0x829D, 28, 0),                      // Division by zero
+					{tag: 0x0110, typ: 99, count: 1, value: []byte("A\x00")}, // Unknown type
+					{tag: 0x0131, typ: tiffASCII, count: maxTIFFValue + 1},   // Too large
+					{tag: 0x8827, typ: tiffShort, count: 0},                  // No values
+				}, nil, nil)
+			},
+			want: map[string]string{"Make": "Sony", "FNumber": "0.0"},
+		},
+		{
+			name: "value outside the file",
+			tiff: func(o byteOrder) []byte {
+				data := buildTIFF(o, []tiffEntry{
+					tiffASCIIEntry(0x010F, "Canon"),
+					tiffASCIIEntry(0x0110, "Canon EOS R5"),
+				}, nil, nil)
+				// Model's value offset is in the second entry
+				o.PutUint32(data[8+2+12+8:], 1<<30)
+				return data
+			},
+			want: map[string]string{"Make": "Canon"},
+		},
+		{
+			name: "exif pointer loops back to ifd0",
+			tiff: func(o byteOrder) []byte {
+				data := buildTIFF(o, []tiffEntry{tiffASCIIEntry(0x010F, "Canon")}, []tiffEntry{}, nil)
+				// The pointer is IFD0's last entry
+				o.PutUint32(data[8+2+12+8:], 8)
+				return data
+			},
+			want: map[string]string{"Make": "Canon"},
+		},
+		{
+			name: "exif pointer points at itself",
+			tiff: func(o byteOrder) []byte {
+				data := buildTIFF(o, []tiffEntry{tiffASCIIEntry(0x010F, "Canon")}, []tiffEntry{tiffASCIIEntry(0x9003, "2019:07:04 18:30:00")}, nil)
+				o.PutUint32(data[8+2+12+8:], 8+2+12)
+				return data
+			},
+			want: map[string]string{"Make": "Canon"},
+		},
+		{
+			name: "broken sub-directories ignored",
+			tiff: func(o byteOrder) []byte {
+				data := buildTIFF(o, []tiffEntry{tiffASCIIEntry(0x010F, "Canon")}, []tiffEntry{}, []tiffEntry{})
+				o.PutUint32(data[8+2+12+8:], 1<<30)
+				o.PutUint32(data[8+2+24+8:], uint32(len(data)-1))
+				return data
+			},
+			want: map[string]string{"Make": "Canon"},
+		},
+		{
+			name: "truncated ifd",
+			tiff: func(o byteOrder) []byte {
+				data := buildTIFF(o, []tiffEntry{
+					tiffShortEntry(o, 0x0112, 1),
+					tiffShortEntry(o, 0x0112, 1),
+				}, nil, nil)
+				return data[:8+2+12+6]
+			},
+			wantErr: "unable to read IFD",
+		},
+		{
+			name: "truncated entry count",
+			tiff: func(o byteOrder) []byte {
+				return buildTIFF(o, []tiffEntry{tiffShortEntry(o, 0x0112, 1)}, nil, nil)[:9]
+			},
+			wantErr: "unable to read IFD",
+		},
+		{
+			name: "ifd0 outside the file",
+			tiff: func(o byteOrder) []byte {
+				data := buildTIFF(o, []tiffEntry{tiffShortEntry(o, 0x0112, 1)}, nil, nil)
+				o.PutUint32(data[4:], 0xFFFFFFF0)
+				return data
+			},
+			wantErr: "unable to read IFD",
+		},
+		{
+			name: "too many entries",
+			tiff: func(o byteOrder) []byte {
+				data := buildTIFF(o, []tiffEntry{tiffShortEntry(o, 0x0112, 1)}, nil, nil)
+				o.PutUint16(data[8:], maxIFDEntries+1)
+				return data
+			},
+			wantErr: "entries",
+		},
+		{
+			name:    "truncated header",
+			tiff:    func(o byteOrder) []byte { return buildTIFF(o, nil, nil, nil)[:6] },
+			wantErr: "unable to read TIFF header",
+		},
+		{
+			name: "wrong magic number",
+			tiff: func(o byteOrder) []byte {
+				data := buildTIFF(o, nil, nil, nil)
+				o.PutUint16(data[2:], 43)
+				return data
+			},
+			wantErr: "not a TIFF header",
+		},
+		{
+			name:    "not tiff",
+			tiff:    func(o byteOrder) []byte { return []byte("GIF89a\x00\x00\x00\x00") },
+			wantErr: "not a TIFF header",
+		},
+	}
+	orders := []struct {
+		name  string
+		order byteOrder
+	}{{"little endian", binary.LittleEndian}, {"big endian", binary.BigEndian}}
+	for _, tt := range tests {
+		for _, o := range orders {
+			t.Run(tt.name+"/"+o.name, func(t *testing.T) {
+				metadata := make(map[string]string)
+				err := readEXIF(bytes.NewReader(tt.tiff(o.order)), tt.base, metadata)
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("readEXIF error = %v, want one containing %q", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("readEXIF returned error: %v", err)
+				}
+				if !reflect.DeepEqual(metadata, tt.want) {
+					t.Errorf("readEXIF = %v, want %v", metadata, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func FuzzReadEXIF(f *testing.F) {
+	for _, o := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		f.Add(buildTIFF(o, []tiffEntry{
+			tiffASCIIEntry(0x010F, "Canon"),
+			tiffShortEntry(o, 0x0112, 6),
+		}, []tiffEntry{
+			tiffASCIIEntry(0x9003, "2019:07:04 18:30:00"),
+			tiffRationalEntry(o, 0x829A, 1, 250),
+		}, []tiffEntry{
+			tiffASCIIEntry(0x0001, "S"),
+			tiffRationalEntry(o, 0x0002, 33, 1, 51, 1, 36, 1),
+		}))
+	}
+	f.Add([]byte("II*\x00\x08\x00\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metadata := make(map[string]string)
+		if err := readEXIF(bytes.NewReader(data), 0, metadata); err != nil && len(metadata) > 0 {
+			t.Errorf("readEXIF returned fields and an error: %v", err)
+		}
+		for name, value := range metadata {
+			if value == "" {
+				t.Errorf("readEXIF returned an empty %s", name)
+			}
+		}
+	})
+}
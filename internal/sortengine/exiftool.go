@@ -1,46 +1,104 @@
 package sortengine
 
 import (
-	"github.com/barasher/go-exiftool"
-	"sync"
+	"errors"
 	"fmt"
+	"github.com/barasher/go-exiftool"
+	"io/fs"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"time"
 )
 
-var lock = &sync.Mutex{}
+// exiftoolReadTimeout is how long a file may take to read before the process
+// is given up on. go-exiftool waits forever for a reply from a process that
+// died part way through a file.
+const exiftoolReadTimeout = time.Minute
+
+// Exiftool is a MetadataReader backed by a stay-open exiftool process
+// It reads one file at a time; ExiftoolPool runs several for concurrent use.
 type Exiftool struct {
-	et *exiftool.Exiftool
+	et     *exiftool.Exiftool
+	broken bool // The process died or its output got out of step; restart it
+	hung   bool // A read never returned and still holds go-exiftool's lock
 }
 
-var et *Exiftool
+// NewExiftool starts an exiftool process
+func NewExiftool() (*Exiftool, error) {
+	et, err := exiftool.NewExiftool()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start exiftool: %v", err)
+	}
+	return &Exiftool{et: et}, nil
+}
 
-func GetExiftool() *Exiftool {
-	// This is our singleton
-	if et == nil {
-		lock.Lock()
-		defer lock.Unlock()
+// ExiftoolAvailable reports whether the exiftool binary can be found
+func ExiftoolAvailable() bool {
+	_, err := exec.LookPath("exiftool")
+	return err == nil
+}
 
-		et = &Exiftool{}
-		var err error
-		et.et, err = exiftool.NewExiftool()
-		if err != nil {
-			fmt.Printf("Error creating exiftool: %s\n", err)
-			panic(err)
-		}
+func (e *Exiftool) Close() error {
+	if e.hung {
+		// Closing would wait for the lost read; the process is left behind
+		return errors.New("exiftool stopped responding")
 	}
-	return et
+	return e.et.Close()
 }
 
-func (e *Exiftool) Close() {
-	e.et.Close()
-}
+// ReadMetadata returns every field exiftool reports for filename as text
+func (e *Exiftool) ReadMetadata(filename string) (map[string]string, error) {
+	results := make(chan []exiftool.FileMetadata, 1)
+	go func() {
+		results <- e.et.ExtractMetadata(filename)
+	}()
+	timer := time.NewTimer(exiftoolReadTimeout)
+	defer timer.Stop()
+	var fileInfos []exiftool.FileMetadata
+	select {
+	case fileInfos = <-results:
+	case <-timer.C:
+		e.broken = true
+		e.hung = true
+		return nil, fmt.Errorf("exiftool took more than %s to read %s", exiftoolReadTimeout, filename)
+	}
 
-func (e *Exiftool) ReadMetadata(filename string) map[string]string {
 	output := make(map[string]string)
-	metadata := e.et.ExtractMetadata(filename)
-	for _, fileInfo := range metadata {
-		for k, v := range fileInfo.Fields {
-			output[k] = fmt.Sprintf("%v", v)
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Err != nil {
+			if !fileError(fileInfo.Err) {
+				e.broken = true
+			}
+			return nil, fmt.Errorf("unable to read metadata: %v", fileInfo.Err)
+		}
+		for key, value := range fileInfo.Fields {
+			switch v := value.(type) {
+			case string:
+				output[key] = v
+			case int:
+				output[key] = strconv.Itoa(v)
+			case float64:
+				output[key] = strconv.FormatFloat(v, 'f', -1, 64)
+			case bool:
+				output[key] = strconv.FormatBool(v)
+			default:
+				output[key] = fmt.Sprintf("<Unsupported field of type %s>", reflect.TypeOf(v))
+			}
 		}
 	}
-	return output
+	return output, nil
+}
+
+// fileError reports whether err is about the file rather than the process
+// go-exiftool stats the file before asking exiftool about it. Any other error
+// comes from talking to the process, and once that fails the process is gone
+// or its replies no longer match the questions.
+func fileError(err error) bool {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		// Writes to a dead process's stdin are PathErrors too
+		return pathErr.Op == "stat"
+	}
+	return errors.Is(err, exiftool.ErrNotExist) || errors.Is(err, exiftool.ErrNotFile)
 }
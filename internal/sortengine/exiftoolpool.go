@@ -0,0 +1,219 @@
+package sortengine
+
+// exiftool process pool
+// An exiftool process reads one file at a time, so with a single process the
+// client's workers and the server's upload workers all queue behind it. The
+// pool runs up to one process per worker. Processes are started as they are
+// needed, so a pool sized for ten workers that only ever sees two at once
+// runs two. A process that dies (or whose output stops making sense) is
+// restarted, either when a read fails or by the periodic health check.
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	exiftoolCheckInterval = time.Minute      // How often idle processes are checked
+	exiftoolCloseTimeout  = 30 * time.Second // How long Close waits for reads in progress
+)
+
+var errPoolClosed = errors.New("exiftool pool is closed")
+
+// ExiftoolPool is a MetadataReader spreading reads over several exiftool
+// processes
+type ExiftoolPool struct {
+	size int
+
+	// instances holds one entry per process the pool may run. nil entries
+	// are processes not started yet (or that failed to restart); taking an
+	// entry is what allows a reader to use the process.
+	instances chan *Exiftool
+
+	probe     string // A small file read by health checks
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewExiftoolPool creates a pool of up to size exiftool processes
+// One process is started and read from straight away, so a broken exiftool
+// install is found here rather than on the first file.
+func NewExiftoolPool(size int) (*ExiftoolPool, error) {
+	if size < 1 {
+		size = 1
+	}
+	probe, err := os.CreateTemp("", "gosort-exiftool-probe-*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create exiftool probe file: %v", err)
+	}
+	probe.WriteString("gosort\n")
+	probe.Close()
+
+	et, err := NewExiftool()
+	if err == nil {
+		_, err = et.ReadMetadata(probe.Name())
+		if err != nil {
+			et.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(probe.Name())
+		return nil, err
+	}
+
+	p := &ExiftoolPool{
+		size:      size,
+		instances: make(chan *Exiftool, size),
+		probe:     probe.Name(),
+		done:      make(chan struct{}),
+	}
+	p.instances <- et
+	for i := 1; i < size; i++ {
+		p.instances <- nil
+	}
+	go p.healthCheck()
+	return p, nil
+}
+
+// ReadMetadata reads filename with whichever process is free, waiting if
+// none is. If the process turns out to be broken it is restarted and the
+// file is read once more.
+func (p *ExiftoolPool) ReadMetadata(filename string) (map[string]string, error) {
+	for attempt := 1; ; attempt++ {
+		et, err := p.acquire()
+		if err != nil {
+			return nil, err
+		}
+		metadata, err := et.ReadMetadata(filename)
+		broken := et.broken
+		p.instances <- et
+		if !broken || attempt == 2 {
+			return metadata, err
+		}
+		slog.Warn("exiftool process failed, restarting it", "file", filename, "error", err)
+	}
+}
+
+// acquire takes a process from the pool, starting or restarting it if needed
+// The caller must put it back in p.instances when done.
+func (p *ExiftoolPool) acquire() (*Exiftool, error) {
+	var et *Exiftool
+	select {
+	case et = <-p.instances:
+	case <-p.done:
+		return nil, errPoolClosed
+	}
+	// Close may have started while this was waiting
+	select {
+	case <-p.done:
+		p.instances <- et
+		return nil, errPoolClosed
+	default:
+	}
+
+	if et != nil && !et.broken {
+		return et, nil
+	}
+	if et != nil {
+		et.Close()
+	}
+	et, err := NewExiftool()
+	if err != nil {
+		p.instances <- nil
+		return nil, err
+	}
+	return et, nil
+}
+
+// healthCheck periodically restarts idle processes that have died, so the
+// next file doesn't have to wait for it
+func (p *ExiftoolPool) healthCheck() {
+	ticker := time.NewTicker(exiftoolCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkIdle()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// checkIdle reads the probe file with every idle process, restarting the
+// ones that fail. Processes busy with a file are left alone.
+func (p *ExiftoolPool) checkIdle() {
+	var idle []*Exiftool
+take:
+	for len(idle) < p.size {
+		select {
+		case et := <-p.instances:
+			idle = append(idle, et)
+		default:
+			break take
+		}
+	}
+
+	for i, et := range idle {
+		if et == nil {
+			continue
+		}
+		// A process already known to be broken isn't asked again; if it hung,
+		// asking would wait for the read it lost
+		if !et.broken {
+			et.ReadMetadata(p.probe)
+		}
+		if !et.broken {
+			continue
+		}
+		slog.Warn("exiftool process failed health check, restarting it")
+		et.Close()
+		idle[i] = nil
+		if restarted, err := NewExiftool(); err == nil {
+			idle[i] = restarted
+		} else {
+			// Left as nil, it will be started again when it is next needed
+			slog.Error("Unable to restart exiftool", "error", err)
+		}
+	}
+
+	for _, et := range idle {
+		p.instances <- et
+	}
+}
+
+// Close waits for reads in progress and stops every process
+// Reads after Close return an error.
+func (p *ExiftoolPool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		defer os.Remove(p.probe)
+
+		timeout := time.After(exiftoolCloseTimeout)
+		var errs []string
+		for i := 0; i < p.size; i++ {
+			select {
+			case et := <-p.instances:
+				if et == nil {
+					continue
+				}
+				if err := et.Close(); err != nil {
+					errs = append(errs, err.Error())
+				}
+			case <-timeout:
+				p.closeErr = fmt.Errorf("timed out waiting for %d exiftool processes to finish", p.size-i)
+				return
+			}
+		}
+		if len(errs) > 0 {
+			p.closeErr = fmt.Errorf("error stopping exiftool: %s", strings.Join(errs, "; "))
+		}
+	})
+	return p.closeErr
+}
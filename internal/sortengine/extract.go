@@ -0,0 +1,114 @@
+package sortengine
+
+// Server-side metadata extraction
+// Uploads arrive with the client's idea of the file's metadata and creation
+// date. A client without exiftool files everything by modification time, and
+// a malicious one can claim anything, so the server reads both again from the
+// data it received. Only the client's creation date is used, as a hint for
+// files that don't carry one; the metadata it sent is always discarded.
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempFileFields are exiftool fields describing the file on disk rather than
+// its content; for an upload they would describe the temp file
+var tempFileFields = []string{
+	"SourceFile",
+	"FileName",
+	"Directory",
+	"FileModifyDate",
+	"FileAccessDate",
+	"FileInodeChangeDate",
+	"FilePermissions",
+}
+
+// maxDateSkew is how far in the future a client's creation date may be before
+// it is treated as bogus; cameras with the wrong timezone are common
+const maxDateSkew = 24 * time.Hour
+
+// ExtractedMetadata describes where an upload's metadata came from
+type ExtractedMetadata struct {
+	MetadataFromFile bool // The metadata was read from the received data
+	DateFromFile     bool // The creation date was read from the received data
+	ClientDate       time.Time
+}
+
+// ExtractReceived reads the metadata and creation date of m from path, which
+// holds m's data under another name (uploads arrive in temp files). The type
+// of file comes from m.Filename, the client's path.
+// The client's metadata is dropped: m.Metadata holds only what the file says,
+// and stays empty if it can't be read or says nothing. The client's creation
+// date is kept when the file has none. If the metadata can't be read the
+// error is returned for logging; m is always usable.
+func (m *Media) ExtractReceived(path string) (ExtractedMetadata, error) {
+	result := ExtractedMetadata{ClientDate: m.CreationDate}
+	m.Metadata = nil
+	if !sanePastDate(m.CreationDate) {
+		// Nothing better may turn up, and the upload time is at least true
+		m.CreationDate = time.Now()
+	}
+
+	image := hasExtension(m.Filename, ImageExtensions)
+	video := hasExtension(m.Filename, VideoExtensions)
+	if !image && !video {
+		return result, fmt.Errorf("file is neither picture or video: %s", filepath.Base(m.Filename))
+	}
+
+	metadata, err := GetMetadataReader().ReadMetadata(path)
+	if err != nil {
+		return result, err
+	}
+	for _, field := range tempFileFields {
+		delete(metadata, field)
+	}
+	if len(metadata) == 0 {
+		return result, nil
+	}
+	m.Metadata = metadata
+	result.MetadataFromFile = true
+
+	if date, ok := dateFromMetadata(metadata, dateFields(image, video)); ok {
+		m.CreationDate = date
+		result.DateFromFile = true
+	}
+	return result, nil
+}
+
+// dateFromMetadata returns the first of fields holding a usable date
+// Unlike GetDate it skips values it can't use, such as the
+// "0000:00:00 00:00:00" videos carry when the camera had no clock set.
+func dateFromMetadata(metadata map[string]string, fields []string) (time.Time, bool) {
+	for _, field := range fields {
+		value := strings.TrimSpace(metadata[field])
+		if len(value) < 19 {
+			continue
+		}
+		// Trailing timezones and subseconds ("+02:00", ".123") are dropped so
+		// the date reads as local time, as GetDate's dates do
+		date, err := time.Parse("2006:01:02 15:04:05", value[:19])
+		if err == nil && sanePastDate(date) {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// sanePastDate reports whether t could be when a picture was taken
+func sanePastDate(t time.Time) bool {
+	return t.Year() >= 1900 && t.Before(time.Now().Add(maxDateSkew))
+}
+
+// hasExtension is MatchesExtensions for files that aren't on this machine
+func hasExtension(filename string, exts []string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	for _, e := range exts {
+		if ext != "" && strings.EqualFold(ext, e) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package sortengine
+
+// Upload intents
+// Storing an upload takes two steps that can't share a transaction: inserting
+// its row and renaming its temp file into place. An intent row is written
+// before either step and marked committed in the same transaction as the
+// media insert, so after a crash RecoverUploads knows which step was reached:
+//
+//	pending    the media row was never inserted: roll back
+//	committed  the row exists: finish the rename, or drop the row if the
+//	           temp file is gone
+//
+// The intent is removed once the file is in place.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Upload intent states
+const (
+	IntentPending   = "pending"
+	IntentCommitted = "committed"
+)
+
+// UploadIntent is an upload that was being stored when the server stopped
+type UploadIntent struct {
+	ID         int64
+	Checksum   string
+	TempPath   string
+	StoredPath string
+	State      string
+	CreatedAt  time.Time
+}
+
+// BeginUploadIntent records that tempPath is about to be stored at storedPath
+// Returns the intent's id for the calls that follow.
+func (d *DB) BeginUploadIntent(checksum string, tempPath string, storedPath string) (int64, error) {
+	result, err := d.db.Exec(
+		"INSERT INTO upload_intents (checksum, temp_path, stored_path, state, created_at) VALUES (?, ?, ?, ?, ?)",
+		checksum, tempPath, storedPath, IntentPending, time.Now().Unix(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error recording upload intent: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error recording upload intent: %v", err)
+	}
+	return id, nil
+}
+
+// CommitUploadIntent inserts the media row and marks the intent committed in
+// one transaction. Returns false, with nothing changed, if another upload
+// stored the same checksum first.
+func (d *DB) CommitUploadIntent(id int64, media *Media) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	values := append(mediaValues(media), time.Now().Unix())
+	result, err := tx.Exec("INSERT OR IGNORE INTO media ("+mediaColumns+", uploaded_at) VALUES ("+placeholders(len(values))+")", values...)
+	if err != nil {
+		return false, fmt.Errorf("error inserting media: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return false, nil
+	}
+	if err := insertMetadata(tx, media.Checksum, media.Metadata); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE upload_intents SET state = ? WHERE id = ?", IntentCommitted, id); err != nil {
+		return false, fmt.Errorf("error committing upload intent: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error committing transaction: %v", err)
+	}
+	return true, nil
+}
+
+// FinishUploadIntent removes an intent once its file is in place
+func (d *DB) FinishUploadIntent(id int64) error {
+	if _, err := d.db.Exec("DELETE FROM upload_intents WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error removing upload intent: %v", err)
+	}
+	return nil
+}
+
+// AbortUploadIntent removes an intent along with the media row it inserted, if any
+func (d *DB) AbortUploadIntent(id int64) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"media_metadata", "media"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE checksum = (SELECT checksum FROM upload_intents WHERE id = ? AND state = ?)", id, IntentCommitted)
+		if err != nil {
+			return fmt.Errorf("error removing media for upload intent: %v", err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM upload_intents WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error removing upload intent: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+// UploadIntents returns every intent left behind, oldest first
+func (d *DB) UploadIntents() ([]UploadIntent, error) {
+	rows, err := d.db.Query("SELECT id, checksum, temp_path, stored_path, state, created_at FROM upload_intents ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error querying upload intents: %v", err)
+	}
+	defer rows.Close()
+
+	intents := make([]UploadIntent, 0)
+	for rows.Next() {
+		var intent UploadIntent
+		var createdAt int64
+		if err := rows.Scan(&intent.ID, &intent.Checksum, &intent.TempPath, &intent.StoredPath, &intent.State, &createdAt); err != nil {
+			return nil, fmt.Errorf("error reading upload intent: %v", err)
+		}
+		intent.CreatedAt = time.Unix(createdAt, 0)
+		intents = append(intents, intent)
+	}
+	return intents, rows.Err()
+}
+
+// RecoverUploads finishes or undoes every upload interrupted by a crash
+// It must run before temp files are cleaned up, since rolling forward needs
+// them, and before the server accepts uploads.
+func (e *Engine) RecoverUploads() (rolledForward int, rolledBack int, err error) {
+	intents, err := e.DB.UploadIntents()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, intent := range intents {
+		if intent.State != IntentCommitted {
+			// The client never got a success response and will send the file
+			// again; the temp file is cleaned up with the other leftovers
+			slog.Info("Recovery: rolling back upload (not yet recorded)", "stored_path", intent.StoredPath)
+			if err := e.DB.AbortUploadIntent(intent.ID); err != nil {
+				return rolledForward, rolledBack, err
+			}
+			rolledBack++
+			continue
+		}
+
+		if err := finishIntentRename(intent); err != nil {
+			slog.Warn("Recovery: rolling back upload", "stored_path", intent.StoredPath, "error", err)
+			if err := e.DB.AbortUploadIntent(intent.ID); err != nil {
+				return rolledForward, rolledBack, err
+			}
+			rolledBack++
+			continue
+		}
+		slog.Info("Recovery: completed upload", "stored_path", intent.StoredPath)
+		if err := e.DB.FinishUploadIntent(intent.ID); err != nil {
+			return rolledForward, rolledBack, err
+		}
+		// A chunked upload's session is done once its file is stored
+		if session, err := e.DB.FindUploadSession(intent.Checksum); err == nil && session != nil {
+			e.DB.DeleteUploadSession(session.ID)
+		}
+		rolledForward++
+	}
+	return rolledForward, rolledBack, nil
+}
+
+// finishIntentRename moves a committed intent's temp file into place, if that
+// hadn't happened yet
+func finishIntentRename(intent UploadIntent) error {
+	_, tempErr := os.Stat(intent.TempPath)
+	_, storedErr := os.Stat(intent.StoredPath)
+	tempExists := tempErr == nil
+	storedExists := storedErr == nil
+
+	switch {
+	case storedExists && !tempExists:
+		// Renamed before the crash; only the intent was left
+		return nil
+	case tempExists && !storedExists:
+		if err := os.MkdirAll(filepath.Dir(intent.StoredPath), 0755); err != nil {
+			return fmt.Errorf("unable to create directory: %v", err)
+		}
+		return os.Rename(intent.TempPath, intent.StoredPath)
+	case tempExists && storedExists:
+		return fmt.Errorf("another file was stored at %s", intent.StoredPath)
+	case errors.Is(tempErr, fs.ErrNotExist):
+		return fmt.Errorf("temp file %s is gone", intent.TempPath)
+	default:
+		return tempErr
+	}
+}
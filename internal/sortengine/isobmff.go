@@ -0,0 +1,441 @@
+package sortengine
+
+// MP4, MOV and HEIC parsing for NativeReader
+// All three are ISO base media files: a tree of boxes ("atoms" in QuickTime),
+// each a size and a four-letter type. Videos keep their dates and duration in
+// moov/mvhd and per track in tkhd and mdhd; HEIC keeps EXIF as an item listed
+// in meta/iinf and located by meta/iloc. Only the boxes on the way there are
+// read; the media data is skipped over.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// maxBoxRead is the largest box read into memory; everything read is a
+// header or an index, far smaller than this
+const maxBoxRead = 1 << 20
+
+// maxBoxDepth stops runaway recursion in corrupt files
+const maxBoxDepth = 8
+
+// quickTimeEpoch is when QuickTime times count from
+var quickTimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// heicBrands are the ftyp brands of HEIF/HEIC pictures
+var heicBrands = map[string]bool{"heic": true, "heix": true, "heim": true, "heis": true, "mif1": true, "msf1": true, "avif": true}
+
+// box is a box's type and where its payload is in the file
+type box struct {
+	typ   string
+	start int64 // First byte after the header
+	end   int64
+}
+
+// walkBoxes calls fn for each box between start and end
+func walkBoxes(r io.ReaderAt, start int64, end int64, fn func(b box) error) error {
+	header := make([]byte, 16)
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return fmt.Errorf("unable to read box header: %v", err)
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		b := box{typ: string(header[4:8]), start: offset + 8}
+		switch size {
+		case 0:
+			// Extends to the end of the file (or parent)
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return fmt.Errorf("unable to read box header: %v", err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			b.start += 8
+		}
+		if size < b.start-offset || size > end-offset {
+			return fmt.Errorf("box %q has a bad size", b.typ)
+		}
+		b.end = offset + size
+		if err := fn(b); err != nil {
+			return err
+		}
+		offset = b.end
+	}
+	return nil
+}
+
+// readBox returns a box's payload
+func readBox(r io.ReaderAt, b box) ([]byte, error) {
+	if b.end-b.start > maxBoxRead {
+		return nil, fmt.Errorf("box %q is too large", b.typ)
+	}
+	data := make([]byte, b.end-b.start)
+	if _, err := r.ReadAt(data, b.start); err != nil {
+		return nil, fmt.Errorf("unable to read box %q: %v", b.typ, err)
+	}
+	return data, nil
+}
+
+// readISOBMFF reads the metadata of an MP4, MOV or HEIC file of the given size
+func readISOBMFF(r io.ReaderAt, size int64, metadata map[string]string) error {
+	return walkBoxes(r, 0, size, func(b box) error {
+		switch b.typ {
+		case "ftyp":
+			data, err := readBox(r, b)
+			if err != nil || len(data) < 4 {
+				return err
+			}
+			switch brand := string(data[:4]); {
+			case heicBrands[brand]:
+				metadata["FileType"] = "HEIC"
+			case brand == "qt  ":
+				metadata["FileType"] = "MOV"
+			default:
+				metadata["FileType"] = "MP4"
+			}
+		case "moov":
+			return readMovie(r, b, metadata)
+		case "meta":
+			// A picture's EXIF is optional; without it the file is still fine
+			readHEIFExif(r, b, metadata)
+		}
+		return nil
+	})
+}
+
+// readMovie reads the movie header, the first video track and the location
+// from a moov box
+func readMovie(r io.ReaderAt, moov box, metadata map[string]string) error {
+	trackRead := false
+	return walkBoxes(r, moov.start, moov.end, func(b box) error {
+		switch b.typ {
+		case "mvhd":
+			data, err := readBox(r, b)
+			if err != nil {
+				return err
+			}
+			created, modified, timescale, duration, ok := parseMediaHeader(data)
+			if !ok {
+				return nil
+			}
+			metadata["CreateDate"] = formatQuickTime(created)
+			metadata["ModifyDate"] = formatQuickTime(modified)
+			if timescale > 0 {
+				metadata["Duration"] = formatDuration(float64(duration) / float64(timescale))
+			}
+		case "trak":
+			if trackRead {
+				return nil
+			}
+			track := make(map[string]string)
+			if err := readTrack(r, b, 0, track); err != nil {
+				return nil
+			}
+			// Audio tracks have no size; keep looking for the video
+			if track["ImageWidth"] == "" || track["ImageWidth"] == "0" {
+				return nil
+			}
+			for k, v := range track {
+				metadata[k] = v
+			}
+			trackRead = true
+		case "udta":
+			readUserData(r, b, metadata)
+		}
+		return nil
+	})
+}
+
+// readTrack reads tkhd and mdia/mdhd from a trak box
+func readTrack(r io.ReaderAt, parent box, depth int, metadata map[string]string) error {
+	if depth > maxBoxDepth {
+		return errors.New("boxes nested too deeply")
+	}
+	return walkBoxes(r, parent.start, parent.end, func(b box) error {
+		switch b.typ {
+		case "tkhd":
+			data, err := readBox(r, b)
+			if err != nil {
+				return err
+			}
+			parseTrackHeader(data, metadata)
+		case "mdhd":
+			data, err := readBox(r, b)
+			if err != nil {
+				return err
+			}
+			if created, modified, _, _, ok := parseMediaHeader(data); ok {
+				metadata["MediaCreateDate"] = formatQuickTime(created)
+				metadata["MediaModifyDate"] = formatQuickTime(modified)
+			}
+		case "mdia":
+			return readTrack(r, b, depth+1, metadata)
+		}
+		return nil
+	})
+}
+
+// parseMediaHeader reads the times from an mvhd or mdhd payload, which share
+// their layout up to the duration
+func parseMediaHeader(data []byte) (created uint64, modified uint64, timescale uint32, duration uint64, ok bool) {
+	if len(data) < 4 {
+		return
+	}
+	if data[0] == 1 {
+		if len(data) < 32 {
+			return
+		}
+		return binary.BigEndian.Uint64(data[4:]), binary.BigEndian.Uint64(data[12:]), binary.BigEndian.Uint32(data[20:]), binary.BigEndian.Uint64(data[24:]), true
+	}
+	if len(data) < 20 {
+		return
+	}
+	return uint64(binary.BigEndian.Uint32(data[4:])), uint64(binary.BigEndian.Uint32(data[8:])), binary.BigEndian.Uint32(data[12:]), uint64(binary.BigEndian.Uint32(data[16:])), true
+}
+
+// parseTrackHeader reads the times, size and rotation from a tkhd payload
+func parseTrackHeader(data []byte, metadata map[string]string) {
+	// Version 1 has 64-bit times and duration, 12 bytes more before the rest
+	var created, modified uint64
+	rest := 0
+	switch {
+	case len(data) >= 96 && data[0] == 1:
+		created, modified = binary.BigEndian.Uint64(data[4:]), binary.BigEndian.Uint64(data[12:])
+		rest = 36
+	case len(data) >= 84 && data[0] == 0:
+		created, modified = uint64(binary.BigEndian.Uint32(data[4:])), uint64(binary.BigEndian.Uint32(data[8:]))
+		rest = 24
+	default:
+		return
+	}
+	metadata["TrackCreateDate"] = formatQuickTime(created)
+	metadata["TrackModifyDate"] = formatQuickTime(modified)
+
+	// reserved(8) layer(2) alternate_group(2) volume(2) reserved(2), then the
+	// 3x3 matrix and the width and height, all 16.16 fixed point but for the
+	// matrix's last column
+	matrix := data[rest+16:]
+	a, b := int32(binary.BigEndian.Uint32(matrix)), int32(binary.BigEndian.Uint32(matrix[4:]))
+	rotation := math.Atan2(float64(b), float64(a)) * 180 / math.Pi
+	metadata["Rotation"] = strconv.Itoa((int(math.Round(rotation)) + 360) % 360)
+	metadata["ImageWidth"] = strconv.Itoa(int(binary.BigEndian.Uint32(matrix[36:]) >> 16))
+	metadata["ImageHeight"] = strconv.Itoa(int(binary.BigEndian.Uint32(matrix[40:]) >> 16))
+}
+
+// iso6709 matches the "+37.7749-122.4194+010.000/" location phones write
+var iso6709 = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)`)
+
+// readUserData reads the location from a udta box's ©xyz entry
+func readUserData(r io.ReaderAt, udta box, metadata map[string]string) {
+	walkBoxes(r, udta.start, udta.end, func(b box) error {
+		if b.typ != "\xa9xyz" {
+			return nil
+		}
+		data, err := readBox(r, b)
+		if err != nil || len(data) < 4 {
+			return nil
+		}
+		// A 16-bit length and language code, then the text
+		match := iso6709.FindStringSubmatch(string(data[4:]))
+		if match == nil {
+			return nil
+		}
+		lat, _ := strconv.ParseFloat(match[1], 64)
+		lon, _ := strconv.ParseFloat(match[2], 64)
+		metadata["GPSCoordinates"] = fmt.Sprintf("%.4f %s, %.4f %s", math.Abs(lat), hemisphere(lat, "N", "S"), math.Abs(lon), hemisphere(lon, "E", "W"))
+		return nil
+	})
+}
+
+func hemisphere(n float64, positive string, negative string) string {
+	if n < 0 {
+		return negative
+	}
+	return positive
+}
+
+// formatQuickTime prints a QuickTime time as exiftool does, in UTC
+// Zero means the time was never set, which exiftool prints as zeros too.
+func formatQuickTime(seconds uint64) string {
+	if seconds == 0 {
+		return "0000:00:00 00:00:00"
+	}
+	return quickTimeEpoch.Add(time.Duration(seconds) * time.Second).Format("2006:01:02 15:04:05")
+}
+
+// formatDuration prints seconds as exiftool does: "12.50 s", or "0:01:23"
+// from 30 seconds on
+func formatDuration(seconds float64) string {
+	if seconds < 30 {
+		return fmt.Sprintf("%.2f s", seconds)
+	}
+	s := int(math.Round(seconds))
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+// readHEIFExif finds the Exif item of a HEIF meta box and reads it
+func readHEIFExif(r io.ReaderAt, meta box, metadata map[string]string) error {
+	// meta is a full box: version and flags come before its children
+	exifID := uint32(0)
+	var locations []byte
+	err := walkBoxes(r, meta.start+4, meta.end, func(b box) error {
+		switch b.typ {
+		case "iinf":
+			data, err := readBox(r, b)
+			if err != nil {
+				return err
+			}
+			exifID = findExifItem(r, b, data)
+		case "iloc":
+			data, err := readBox(r, b)
+			if err != nil {
+				return err
+			}
+			locations = data
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if exifID == 0 || locations == nil {
+		return errors.New("no Exif item")
+	}
+	offset, err := itemOffset(locations, exifID)
+	if err != nil {
+		return err
+	}
+
+	// The item starts with the offset of the TIFF header within it, past the
+	// "Exif\0\0" most writers put there
+	buf := make([]byte, 4)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return fmt.Errorf("unable to read Exif item: %v", err)
+	}
+	return readEXIF(r, offset+4+int64(binary.BigEndian.Uint32(buf)), metadata)
+}
+
+// findExifItem returns the ID of the item of type "Exif" listed in iinf
+func findExifItem(r io.ReaderAt, iinf box, data []byte) uint32 {
+	if len(data) < 6 {
+		return 0
+	}
+	// The entry count is 16 bits in version 0 and 32 bits after
+	start := iinf.start + 6
+	if data[0] != 0 {
+		start += 2
+	}
+	var id uint32
+	walkBoxes(r, start, iinf.end, func(b box) error {
+		if b.typ != "infe" || id != 0 {
+			return nil
+		}
+		infe, err := readBox(r, b)
+		if err != nil || len(infe) < 4 {
+			return nil
+		}
+		// Versions 2 and 3 give the item type; older ones can't hold EXIF
+		switch {
+		case infe[0] == 2 && len(infe) >= 12 && string(infe[8:12]) == "Exif":
+			id = uint32(binary.BigEndian.Uint16(infe[4:]))
+		case infe[0] == 3 && len(infe) >= 14 && string(infe[10:14]) == "Exif":
+			id = binary.BigEndian.Uint32(infe[4:])
+		}
+		return nil
+	})
+	return id
+}
+
+// itemOffset returns where in the file an item's data starts, from an iloc
+// payload. Only items stored in the file itself are supported.
+func itemOffset(data []byte, id uint32) (int64, error) {
+	if len(data) < 8 {
+		return 0, errors.New("iloc too short")
+	}
+	version := data[0]
+	offsetSize, lengthSize := int(data[4]>>4), int(data[4]&0xf)
+	baseOffsetSize, indexSize := int(data[5]>>4), int(data[5]&0xf)
+	if version == 0 {
+		indexSize = 0
+	}
+	pos := 6
+	next := func(size int) (uint64, bool) {
+		if size == 0 {
+			return 0, true
+		}
+		if pos+size > len(data) || (size != 2 && size != 4 && size != 8) {
+			return 0, false
+		}
+		var n uint64
+		switch size {
+		case 2:
+			n = uint64(binary.BigEndian.Uint16(data[pos:]))
+		case 4:
+			n = uint64(binary.BigEndian.Uint32(data[pos:]))
+		case 8:
+			n = binary.BigEndian.Uint64(data[pos:])
+		}
+		pos += size
+		return n, true
+	}
+
+	idSize := 2
+	if version >= 2 {
+		idSize = 4
+	}
+	count, ok := next(idSize)
+	if !ok {
+		return 0, errors.New("iloc too short")
+	}
+	for i := uint64(0); i < count; i++ {
+		itemID, ok := next(idSize)
+		method := uint64(0)
+		if ok && version >= 1 {
+			method, ok = next(2)
+			method &= 0xf
+		}
+		var base, extents uint64
+		if ok {
+			_, ok = next(2) // data_reference_index
+		}
+		if ok {
+			base, ok = next(baseOffsetSize)
+		}
+		if ok {
+			extents, ok = next(2)
+		}
+		if !ok {
+			return 0, errors.New("iloc too short")
+		}
+		var first uint64
+		for e := uint64(0); e < extents; e++ {
+			var offset uint64
+			_, ok = next(indexSize)
+			if ok {
+				offset, ok = next(offsetSize)
+			}
+			if ok {
+				_, ok = next(lengthSize)
+			}
+			if !ok {
+				return 0, errors.New("iloc too short")
+			}
+			if e == 0 {
+				first = offset
+			}
+		}
+		if uint32(itemID) == id {
+			if method != 0 {
+				return 0, errors.New("Exif item isn't stored in the file")
+			}
+			return int64(base + first), nil
+		}
+	}
+	return 0, errors.New("Exif item not located")
+}
@@ -0,0 +1,285 @@
+package sortengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mkbox builds a box with a 32-bit size
+func mkbox(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(out, typ...), body...)
+}
+
+// mkbox64 builds a box with a 64-bit size
+func mkbox64(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := binary.BigEndian.AppendUint32(nil, 1)
+	out = append(out, typ...)
+	out = binary.BigEndian.AppendUint64(out, uint64(16+len(body)))
+	return append(out, body...)
+}
+
+// mkbox0 builds a box with size 0, which runs to the end of its parent
+func mkbox0(typ string, payload ...[]byte) []byte {
+	return append(append([]byte{0, 0, 0, 0}, typ...), bytes.Join(payload, nil)...)
+}
+
+func u16(n uint16) []byte { return binary.BigEndian.AppendUint16(nil, n) }
+func u32(n uint32) []byte { return binary.BigEndian.AppendUint32(nil, n) }
+func u64(n uint64) []byte { return binary.BigEndian.AppendUint64(nil, n) }
+
+// quickTime returns t as seconds since the QuickTime epoch
+func quickTime(t time.Time) uint64 {
+	return uint64(t.Sub(quickTimeEpoch) / time.Second)
+}
+
+// mvhd builds a version 0 movie header
+func mvhd(created, modified time.Time, timescale uint32, duration uint32) []byte {
+	return mkbox("mvhd", u32(0), u32(uint32(quickTime(created))), u32(uint32(quickTime(modified))), u32(timescale), u32(duration), make([]byte, 80))
+}
+
+// mvhd64 builds a version 1 movie header, with 64-bit times and duration
+func mvhd64(created, modified time.Time, timescale uint32, duration uint64) []byte {
+	return mkbox("mvhd", u32(1<<24), u64(quickTime(created)), u64(quickTime(modified)), u32(timescale), u64(duration), make([]byte, 80))
+}
+
+// tkhd builds a version 0 track header for a picture of the given size,
+// rotated by a matrix with a and b in its first row
+func tkhd(created time.Time, a, b int32, width, height uint16) []byte {
+	matrix := bytes.Join([][]byte{u32(uint32(a)), u32(uint32(b)), u32(0), u32(uint32(-b)), u32(uint32(a)), u32(0), u32(0), u32(0), u32(1 << 30)}, nil)
+	return mkbox("tkhd", u32(0), u32(uint32(quickTime(created))), u32(uint32(quickTime(created))), u32(1), u32(0), u32(0),
+		make([]byte, 16), matrix, u32(uint32(width)<<16), u32(uint32(height)<<16))
+}
+
+// heic builds a HEIC file whose Exif item holds tiff
+func heic(tiff []byte) []byte {
+	ftyp := mkbox("ftyp", []byte("heic"), u32(0), []byte("mif1heic"))
+	infe := mkbox("infe", []byte{2, 0, 0, 0}, u16(1), u16(0), []byte("Exif"), []byte{0})
+	iinf := mkbox("iinf", u32(0), u16(1), infe)
+	item := append(append(u32(6), "Exif\x00\x00"...), tiff...)
+	iloc := func(offset uint32) []byte {
+		return mkbox("iloc", u32(0), []byte{0x44, 0x00}, u16(1), u16(1), u16(0), u16(1), u32(offset), u32(uint32(len(item))))
+	}
+	meta := func(offset uint32) []byte {
+		return mkbox("meta", u32(0), mkbox("hdlr", u32(0), u32(0), []byte("pict"), make([]byte, 13)), iinf, iloc(offset))
+	}
+	// The item starts after mdat's header, once the offset is known
+	offset := uint32(len(ftyp) + len(meta(0)) + 8)
+	return bytes.Join([][]byte{ftyp, meta(offset), mkbox("mdat", item)}, nil)
+}
+
+func TestWalkBoxes(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []box
+		wantErr string
+	}{
+		{"empty", nil, nil, ""},
+		{"two boxes", append(mkbox("ftyp", []byte("isom")), mkbox("free")...),
+			[]box{{"ftyp", 8, 12}, {"free", 20, 20}}, ""},
+		{"64-bit size", append(mkbox64("mdat", []byte("data")), mkbox("free")...),
+			[]box{{"mdat", 16, 20}, {"free", 28, 28}}, ""},
+		{"size 0 runs to the end", append(mkbox("ftyp", []byte("isom")), mkbox0("mdat", []byte("data to the end"))...),
+			[]box{{"ftyp", 8, 12}, {"mdat", 20, 35}}, ""},
+		{"size 0 with nothing after the header", mkbox0("mdat"), []box{{"mdat", 8, 8}}, ""},
+		{"trailing bytes ignored", append(mkbox("free"), 0, 0, 0), []box{{"free", 8, 8}}, ""},
+		{"size smaller than the header", append(u32(4), "free"...), nil, "bad size"},
+		{"size past the end", append(u32(100), "free"...), nil, "bad size"},
+		{"64-bit size smaller than the header", append(append(u32(1), "mdat"...), u64(8)...), nil, "bad size"},
+		{"64-bit size overflowing", append(append(u32(1), "mdat"...), u64(1<<63+16)...), nil, "bad size"},
+		{"64-bit size truncated", append(append(u32(1), "mdat"...), 0, 0, 0), nil, "unable to read box header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []box
+			err := walkBoxes(bytes.NewReader(tt.data), 0, int64(len(tt.data)), func(b box) error {
+				got = append(got, b)
+				return nil
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("walkBoxes error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("walkBoxes returned error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("walkBoxes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadISOBMFF(t *testing.T) {
+	created := time.Date(2021, time.February, 3, 4, 5, 6, 0, time.UTC)
+	modified := time.Date(2021, time.February, 3, 4, 6, 0, 0, time.UTC)
+	ftyp := mkbox("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2mp41"))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "mp4",
+			data: bytes.Join([][]byte{ftyp, mkbox("moov", mvhd(created, modified, 1000, 12500)), mkbox("mdat", []byte("frames"))}, nil),
+			want: map[string]string{
+				"FileType":   "MP4",
+				"CreateDate": "2021:02:03 04:05:06",
+				"ModifyDate": "2021:02:03 04:06:00",
+				"Duration":   "12.50 s",
+			},
+		},
+		{
+			name: "64-bit header and box sizes",
+			data: bytes.Join([][]byte{mkbox64("ftyp", []byte("qt  "), u32(0)), mkbox64("moov", mvhd64(created, modified, 600, 83*600))}, nil),
+			want: map[string]string{
+				"FileType":   "MOV",
+				"CreateDate": "2021:02:03 04:05:06",
+				"ModifyDate": "2021:02:03 04:06:00",
+				"Duration":   "0:01:23",
+			},
+		},
+		{
+			name: "moov with size 0",
+			data: bytes.Join([][]byte{ftyp, mkbox("mdat", []byte("frames")), mkbox0("moov", mvhd(created, created, 0, 0))}, nil),
+			want: map[string]string{
+				"FileType":   "MP4",
+				"CreateDate": "2021:02:03 04:05:06",
+				"ModifyDate": "2021:02:03 04:05:06",
+			},
+		},
+		{
+			name: "mdat with size 0 after moov",
+			data: bytes.Join([][]byte{ftyp, mkbox("moov", mvhd(created, modified, 1000, 2000)), mkbox0("mdat", []byte("frames to the end"))}, nil),
+			want: map[string]string{
+				"FileType":   "MP4",
+				"CreateDate": "2021:02:03 04:05:06",
+				"ModifyDate": "2021:02:03 04:06:00",
+				"Duration":   "2.00 s",
+			},
+		},
+		{
+			name: "unset times",
+			data: bytes.Join([][]byte{ftyp, mkbox("moov", mkbox("mvhd", make([]byte, 100)))}, nil),
+			want: map[string]string{
+				"FileType":   "MP4",
+				"CreateDate": "0000:00:00 00:00:00",
+				"ModifyDate": "0000:00:00 00:00:00",
+			},
+		},
+		{
+			name: "video track after an audio track",
+			data: bytes.Join([][]byte{ftyp, mkbox("moov",
+				mkbox("trak", tkhd(created, 1<<16, 0, 0, 0)),
+				mkbox("trak", tkhd(created, 0, 1<<16, 1920, 1080), mkbox("mdia", mkbox("mdhd", u32(0), u32(uint32(quickTime(modified))), u32(uint32(quickTime(modified))), u32(600), u32(0)))),
+				mkbox("trak", tkhd(created, 1<<16, 0, 640, 480)),
+			)}, nil),
+			want: map[string]string{
+				"FileType":        "MP4",
+				"TrackCreateDate": "2021:02:03 04:05:06",
+				"TrackModifyDate": "2021:02:03 04:05:06",
+				"MediaCreateDate": "2021:02:03 04:06:00",
+				"MediaModifyDate": "2021:02:03 04:06:00",
+				"Rotation":        "90",
+				"ImageWidth":      "1920",
+				"ImageHeight":     "1080",
+			},
+		},
+		{
+			name: "location",
+			data: bytes.Join([][]byte{ftyp, mkbox("moov", mkbox("udta", mkbox("\xa9xyz", u16(18), u16(0x15c7), []byte("+37.7749-122.4194/"))))}, nil),
+			want: map[string]string{"FileType": "MP4", "GPSCoordinates": "37.7749 N, 122.4194 W"},
+		},
+		{
+			name: "old quicktime without ftyp",
+			data: mkbox("moov", mvhd(created, modified, 600, 600)),
+			want: map[string]string{
+				"CreateDate": "2021:02:03 04:05:06",
+				"ModifyDate": "2021:02:03 04:06:00",
+				"Duration":   "1.00 s",
+			},
+		},
+		{
+			name: "heic",
+			data: heic(buildTIFF(binary.BigEndian, []tiffEntry{tiffASCIIEntry(0x010F, "Apple")}, []tiffEntry{tiffASCIIEntry(0x9003, "2023:08:09 10:11:12")}, nil)),
+			want: map[string]string{"FileType": "HEIC", "Make": "Apple", "DateTimeOriginal": "2023:08:09 10:11:12"},
+		},
+		{
+			name: "heic with broken exif",
+			data: heic([]byte("not a tiff header")),
+			want: map[string]string{"FileType": "HEIC"},
+		},
+		{
+			name: "track boxes nested too deeply",
+			data: func() []byte {
+				nested := mkbox("tkhd", make([]byte, 84))
+				for i := 0; i < maxBoxDepth+2; i++ {
+					nested = mkbox("mdia", nested)
+				}
+				return bytes.Join([][]byte{ftyp, mkbox("moov", mkbox("trak", nested))}, nil)
+			}(),
+			want: map[string]string{"FileType": "MP4"},
+		},
+		{
+			name:    "bad box size inside moov",
+			data:    bytes.Join([][]byte{ftyp, mkbox("moov", append(u32(4), "mvhd"...))}, nil),
+			want:    map[string]string{"FileType": "MP4"},
+			wantErr: "bad size",
+		},
+		{
+			name:    "truncated moov",
+			data:    bytes.Join([][]byte{ftyp, mkbox("moov", mvhd(created, modified, 1000, 12500))}, nil)[:len(ftyp)+30],
+			want:    map[string]string{"FileType": "MP4"},
+			wantErr: "bad size",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := make(map[string]string)
+			err := readISOBMFF(bytes.NewReader(tt.data), int64(len(tt.data)), metadata)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("readISOBMFF error = %v, want one containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("readISOBMFF returned error: %v", err)
+			}
+			if !reflect.DeepEqual(metadata, tt.want) {
+				t.Errorf("readISOBMFF = %v, want %v", metadata, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzReadISOBMFF(f *testing.F) {
+	created := time.Date(2021, time.February, 3, 4, 5, 6, 0, time.UTC)
+	f.Add(bytes.Join([][]byte{
+		mkbox("ftyp", []byte("isom"), u32(0)),
+		mkbox("moov", mvhd(created, created, 1000, 12500),
+			mkbox("trak", tkhd(created, 0, 1<<16, 1920, 1080), mkbox("mdia", mkbox("mdhd", u32(0), u32(1), u32(2), u32(600), u32(0)))),
+			mkbox("udta", mkbox("\xa9xyz", u16(18), u16(0), []byte("+37.7749-122.4194/")))),
+		mkbox0("mdat", []byte("frames")),
+	}, nil))
+	f.Add(mkbox64("moov", mvhd64(created, created, 600, 600)))
+	f.Add(heic(buildTIFF(binary.LittleEndian, []tiffEntry{tiffASCIIEntry(0x010F, "Apple")}, nil, nil)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metadata := make(map[string]string)
+		readISOBMFF(bytes.NewReader(data), int64(len(data)), metadata)
+		for name, value := range metadata {
+			if value == "" {
+				t.Errorf("readISOBMFF returned an empty %s", name)
+			}
+		}
+	})
+}
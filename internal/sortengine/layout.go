@@ -0,0 +1,222 @@
+package sortengine
+
+// Destination layout templates
+// server.layout decides where under SaveDir an upload is stored, e.g.
+//
+//	{year}-{month}/{date} {time}{seq}.{ext}       (the default)
+//	{year}/{month}-{monthname}/{make} {model}/{basename}{seq}.{ext}
+//
+// "/" separates directories on every platform. Values taken from the file
+// (camera make and model, original name, uploader) are cleaned so they can't
+// add directories or characters the filesystem won't accept.
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultLayout reproduces the fixed layout used before server.layout existed
+const DefaultLayout = "{year}-{month}/{date} {time}{seq}.{ext}"
+
+// unknownLayoutValue stands in for values a file doesn't have, like the camera of a screenshot
+const unknownLayoutValue = "unknown"
+
+// layoutTokens maps each {token} to the function producing its value
+// seq is the collision counter; 0 for the first file with a given name
+var layoutTokens = map[string]func(m *Media, seq int) string{
+	"year":      func(m *Media, seq int) string { return m.CreationDate.Format("2006") },
+	"month":     func(m *Media, seq int) string { return m.CreationDate.Format("01") },
+	"monthname": func(m *Media, seq int) string { return m.CreationDate.Format("January") },
+	"day":       func(m *Media, seq int) string { return m.CreationDate.Format("02") },
+	"hour":      func(m *Media, seq int) string { return m.CreationDate.Format("15") },
+	"minute":    func(m *Media, seq int) string { return m.CreationDate.Format("04") },
+	"second":    func(m *Media, seq int) string { return m.CreationDate.Format("05") },
+	"date":      func(m *Media, seq int) string { return m.CreationDate.Format("2006-01-02") },
+	"time":      func(m *Media, seq int) string { return m.CreationDate.Format("15.04.05") },
+	"ext":       func(m *Media, seq int) string { return cleanLayoutValue(m.Ext(), "") },
+	"type":      func(m *Media, seq int) string { return MediaType(m.Filename) },
+	"make":      func(m *Media, seq int) string { return cleanLayoutValue(m.Metadata["Make"], unknownLayoutValue) },
+	"model":     func(m *Media, seq int) string { return cleanLayoutValue(m.Metadata["Model"], unknownLayoutValue) },
+	"basename":  func(m *Media, seq int) string { return cleanLayoutValue(originalBasename(m), unknownLayoutValue) },
+	"uploader":  func(m *Media, seq int) string { return cleanLayoutValue(m.UploadedBy, unknownLayoutValue) },
+	"seq":       layoutSeq,
+}
+
+// layoutSeq is empty for the first file with a name, then .1, .2, ...
+func layoutSeq(m *Media, seq int) string {
+	if seq == 0 {
+		return ""
+	}
+	return fmt.Sprintf(".%d", seq)
+}
+
+// Layout is a parsed server.layout template
+type Layout struct {
+	template string
+	dirs     []string // Directory components, each a template
+	file     string   // File name template
+}
+
+// ParseLayout checks a layout template and prepares it for use
+// The template must be relative, may not use "..", and its file name must
+// contain {ext} and exactly one {seq} so files with the same name can be told apart.
+func ParseLayout(template string) (*Layout, error) {
+	if strings.TrimSpace(template) == "" {
+		return nil, fmt.Errorf("layout is empty")
+	}
+	if strings.HasPrefix(template, "/") || strings.Contains(template, `\`) || filepath.IsAbs(template) {
+		return nil, fmt.Errorf("layout must be a relative path using / between directories")
+	}
+
+	components := strings.Split(template, "/")
+	for _, component := range components {
+		if component == "" || component == "." || component == ".." {
+			return nil, fmt.Errorf("layout has an empty, \".\" or \"..\" path component")
+		}
+		tokens, err := layoutComponentTokens(component)
+		if err != nil {
+			return nil, err
+		}
+		for _, token := range tokens {
+			if _, ok := layoutTokens[token]; !ok {
+				return nil, fmt.Errorf("unknown layout token {%s} (valid: %s)", token, strings.Join(LayoutTokenNames(), ", "))
+			}
+		}
+	}
+
+	l := &Layout{
+		template: template,
+		dirs:     components[:len(components)-1],
+		file:     components[len(components)-1],
+	}
+	for _, dir := range l.dirs {
+		if strings.Contains(dir, "{seq}") {
+			return nil, fmt.Errorf("{seq} may only be used in the file name")
+		}
+	}
+	if strings.Count(l.file, "{seq}") != 1 {
+		return nil, fmt.Errorf("the file name must contain {seq} exactly once")
+	}
+	if !strings.Contains(l.file, "{ext}") {
+		return nil, fmt.Errorf("the file name must contain {ext}")
+	}
+	return l, nil
+}
+
+// LayoutTokenNames returns the supported tokens, sorted
+func LayoutTokenNames() []string {
+	names := make([]string, 0, len(layoutTokens))
+	for name := range layoutTokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String returns the template the layout was parsed from
+func (l *Layout) String() string {
+	return l.template
+}
+
+// UsesMetadata reports whether the layout needs the file's metadata ({make} or {model})
+func (l *Layout) UsesMetadata() bool {
+	return strings.Contains(l.template, "{make}") || strings.Contains(l.template, "{model}")
+}
+
+// Dir returns the directory for m, relative to SaveDir
+func (l *Layout) Dir(m *Media) string {
+	parts := make([]string, 0, len(l.dirs))
+	for _, dir := range l.dirs {
+		parts = append(parts, expandLayoutComponent(dir, m, 0))
+	}
+	return filepath.Join(parts...)
+}
+
+// Filename returns the file name for m with the given collision counter
+func (l *Layout) Filename(m *Media, seq int) string {
+	return expandLayoutComponent(l.file, m, seq)
+}
+
+// layoutComponentTokens returns the names of the tokens in one path component
+func layoutComponentTokens(component string) ([]string, error) {
+	var tokens []string
+	for rest := component; ; {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			return tokens, nil
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unmatched } in layout component %q", component)
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("unmatched { in layout component %q", component)
+		}
+		tokens = append(tokens, rest[open+1:open+1+end])
+		rest = rest[open+1+end+1:]
+	}
+}
+
+// expandLayoutComponent replaces every token in an already validated component
+func expandLayoutComponent(component string, m *Media, seq int) string {
+	var b strings.Builder
+	for rest := component; ; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			b.WriteString(rest)
+			return b.String()
+		}
+		end := strings.IndexByte(rest[open:], '}') + open
+		b.WriteString(rest[:open])
+		b.WriteString(layoutTokens[rest[open+1:end]](m, seq))
+		rest = rest[end+1:]
+	}
+}
+
+// cleanLayoutValue makes a value taken from a file safe to use inside one path
+// component: separators and characters Windows rejects become "_", and
+// leading or trailing spaces and dots are dropped so it can't become "..".
+// An empty result is replaced with fallback.
+func cleanLayoutValue(value string, fallback string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, value)
+	cleaned = strings.Trim(cleaned, " .")
+	if cleaned == "" {
+		return fallback
+	}
+	return cleaned
+}
+
+// originalBasename returns the name of the uploaded file without its directory
+// or extension. The path comes from the client, which may use either separator.
+func originalBasename(m *Media) string {
+	filename := m.Filename
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename))
+}
+
+// MediaType returns "image" or "video" based on the file extension alone, or
+// "other" for anything else. Unlike Media.IsImage it doesn't need the file to
+// exist, so it works on paths reported by a client.
+func MediaType(filename string) string {
+	ext := strings.TrimPrefix(filepath.Ext(filename), ".")
+	for _, e := range ImageExtensions {
+		if strings.EqualFold(ext, e) {
+			return "image"
+		}
+	}
+	for _, e := range VideoExtensions {
+		if strings.EqualFold(ext, e) {
+			return "video"
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,117 @@
+package sortengine
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string // Substring of the error, "" if the template is valid
+	}{
+		{"default", DefaultLayout, ""},
+		{"every token", "{year}/{month}-{monthname}/{day}/{type}/{make} {model}/{uploader}/{hour}{minute}{second} {date} {time} {basename}{seq}.{ext}", ""},
+		{"no directories", "{basename}{seq}.{ext}", ""},
+		{"empty", "", "layout is empty"},
+		{"blank", "   ", "layout is empty"},
+		{"absolute", "/{year}/{basename}{seq}.{ext}", "relative path"},
+		{"backslash", `{year}\{basename}{seq}.{ext}`, "relative path"},
+		{"parent directory", "../{basename}{seq}.{ext}", `".."`},
+		{"current directory", "./{basename}{seq}.{ext}", `".."`},
+		{"empty component", "{year}//{basename}{seq}.{ext}", `".."`},
+		{"trailing slash", "{year}/", `".."`},
+		{"unknown token", "{year}/{camera}{seq}.{ext}", "unknown layout token {camera}"},
+		{"unmatched open", "{year/{basename}{seq}.{ext}", "unmatched {"},
+		{"unmatched close", "year}/{basename}{seq}.{ext}", "unmatched }"},
+		{"nested braces", "{ye{ar}}/{basename}{seq}.{ext}", "unmatched {"},
+		{"no seq", "{year}/{basename}.{ext}", "{seq} exactly once"},
+		{"two seq", "{year}/{basename}{seq}{seq}.{ext}", "{seq} exactly once"},
+		{"seq in directory", "{year}{seq}/{basename}{seq}.{ext}", "{seq} may only be used in the file name"},
+		{"no ext", "{year}/{basename}{seq}.jpg", "must contain {ext}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := ParseLayout(tt.template)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseLayout(%q) returned error: %v", tt.template, err)
+				}
+				if l.String() != tt.template {
+					t.Errorf("String() = %q, want %q", l.String(), tt.template)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("ParseLayout(%q) succeeded, want error containing %q", tt.template, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseLayout(%q) error = %q, want it to contain %q", tt.template, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLayoutExpand(t *testing.T) {
+	m := &Media{
+		Filename:     `C:\Users\me\DCIM\IMG_0001.JPG`,
+		CreationDate: time.Date(2024, time.March, 5, 14, 7, 9, 0, time.UTC),
+		Metadata:     map[string]string{"Make": "Canon", "Model": "EOS R6/II"},
+		UploadedBy:   "",
+	}
+	tests := []struct {
+		name     string
+		template string
+		seq      int
+		wantDir  string
+		wantFile string
+	}{
+		{"default", DefaultLayout, 0, "2024-03", "2024-03-05 14.07.09.JPG"},
+		{"default seq 1", DefaultLayout, 1, "2024-03", "2024-03-05 14.07.09.1.JPG"},
+		{"default seq 12", DefaultLayout, 12, "2024-03", "2024-03-05 14.07.09.12.JPG"},
+		{"seq before ext only", "{basename}{seq}.{ext}", 2, "", "IMG_0001.2.JPG"},
+		{"seq mid name", "{basename}{seq} copy.{ext}", 3, "", "IMG_0001.3 copy.JPG"},
+		{"camera", "{year}/{monthname}/{make} {model}/{day}-{hour}{minute}{second}{seq}.{ext}", 0,
+			filepath.Join("2024", "March", "Canon EOS R6_II"), "05-140709.JPG"},
+		{"missing values", "{uploader}/{type}/{basename}{seq}.{ext}", 0, filepath.Join("unknown", "image"), "IMG_0001.JPG"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := ParseLayout(tt.template)
+			if err != nil {
+				t.Fatalf("ParseLayout(%q): %v", tt.template, err)
+			}
+			if got := l.Dir(m); got != tt.wantDir {
+				t.Errorf("Dir() = %q, want %q", got, tt.wantDir)
+			}
+			if got := l.Filename(m, tt.seq); got != tt.wantFile {
+				t.Errorf("Filename(%d) = %q, want %q", tt.seq, got, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestCleanLayoutValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		fallback string
+		want     string
+	}{
+		{"Canon", "unknown", "Canon"},
+		{"", "unknown", "unknown"},
+		{"..", "unknown", "unknown"},
+		{" . ", "unknown", "unknown"},
+		{"../etc", "unknown", "_etc"},
+		{`a/b\c:d*e?f"g<h>i|j`, "unknown", "a_b_c_d_e_f_g_h_i_j"},
+		{"tab\there", "unknown", "tab_here"},
+		{" NIKON CORPORATION ", "unknown", "NIKON CORPORATION"},
+	}
+	for _, tt := range tests {
+		if got := cleanLayoutValue(tt.value, tt.fallback); got != tt.want {
+			t.Errorf("cleanLayoutValue(%q, %q) = %q, want %q", tt.value, tt.fallback, got, tt.want)
+		}
+	}
+}
@@ -1,18 +1,16 @@
 package sortengine
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"fmt"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
-	"io"
 	//"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"reflect"
 	"sort"
 	"strconv"
 	"strings"
@@ -24,32 +22,40 @@ import (
 
 var TimeFormat string = "%Y:%m:%d %H:%M:%S"
 
-var ImageExtensions []string = []string{"jpg", "jpeg", "png", "gif", "tif", "tiff", "bmp"}
-var VideoExtensions []string = []string{"mpg", "mp4", "mkv", "avi", "mkv", "m4v", "mpeg", "mpeg4"}
+var ImageExtensions []string = []string{"jpg", "jpeg", "png", "gif", "tif", "tiff", "bmp", "heic", "heif"}
+var VideoExtensions []string = []string{"mpg", "mp4", "mkv", "avi", "mkv", "m4v", "mpeg", "mpeg4", "mov"}
 
 type Media struct {
-	Path         string
-	Filename     string
-	Checksum     string
-	Checksum100k string
-	Size         int64
-	ModifiedDate time.Time
-	CreationDate time.Time
-	Width        int
-	Height       int
-	Metadata     map[string]string
+	Path           string
+	Filename       string
+	Checksum       string
+	Checksum100k   string
+	HashAlgorithm  string // Algorithm used for Checksum and Checksum100k (see hash.go)
+	Size           int64
+	ModifiedDate   time.Time
+	CreationDate   time.Time
+	Width          int
+	Height         int
+	Metadata       map[string]string
+	StoredPath     string // Where the server saved the file under SaveDir (server-side only)
+	PerceptualHash string // dHash of the image content as 16 hex digits (images only, see phash.go)
+	UploadedBy     string // Name of the API token the file was uploaded with (server-side only)
 }
 
 func (m *Media) ToMap() map[string]interface{} {
 	return map[string]interface{}{
-		"filename":      m.Filename,
-		"path":          m.Path,
-		"checksum":      m.Checksum,
-		"checksum100k":  m.Checksum100k,
-		"size":          m.Size,
-		"modified_time": m.ModifiedDate.Format("2006-01-02 15:04:05"),
-		"creation_time": m.CreationDate.Format("2006-01-02 15:04:05"),
-		"metadata":      m.Metadata,
+		"filename":       m.Filename,
+		"path":           m.Path,
+		"checksum":       m.Checksum,
+		"checksum100k":   m.Checksum100k,
+		"hash_algorithm": m.HashAlgorithm,
+		"size":           m.Size,
+		"modified_time":  m.ModifiedDate.Format("2006-01-02 15:04:05"),
+		"creation_time":  m.CreationDate.Format("2006-01-02 15:04:05"),
+		"metadata":       m.Metadata,
+		"stored_path":    m.StoredPath,
+		"phash":          m.PerceptualHash,
+		"uploaded_by":    m.UploadedBy,
 	}
 }
 
@@ -73,10 +79,23 @@ func (m *Media) Ext() string {
 	}
 }
 
+// Hasher returns the algorithm this media's checksums are computed with
+// Media without an explicit algorithm uses DefaultHashAlgorithm
+func (m *Media) Hasher() (Hasher, error) {
+	if m.HashAlgorithm == "" {
+		m.HashAlgorithm = DefaultHashAlgorithm
+	}
+	return GetHasher(m.HashAlgorithm)
+}
+
 func (m *Media) SetChecksum() error {
-	cs, err := Checksum(m.Filename)
+	h, err := m.Hasher()
+	if err != nil {
+		return err
+	}
+	cs, err := ChecksumWith(h, m.Filename, false)
 	if err != nil {
-		fmt.Printf("Unable to get checksum: %s\v", err)
+		slog.Error("Unable to get checksum", "filename", m.Filename, "error", err)
 		return err
 	}
 	m.Checksum = cs
@@ -122,11 +141,28 @@ func NewMediaFile(filename string) *Media {
 	if err != nil {
 		panic(err)
 	}
+	mediaInstance, _ := LoadMediaFile(fullPathName)
+	return mediaInstance
+}
+
+// LoadMediaFile is NewMediaFile, but also returns the error from Init
+// The returned Media is usable even when there is an error; it just may be
+// missing metadata or fall back to the file's modification time.
+func LoadMediaFile(filename string) (*Media, error) {
+	fullPathName, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
 	mediaInstance := &Media{
 		Filename: fullPathName,
 	}
-	mediaInstance.Init()
-	return mediaInstance
+	return mediaInstance, mediaInstance.Init()
+}
+
+// IsRecognizedFile reports whether filename is a picture or video we can sort
+func IsRecognizedFile(filename string) bool {
+	m := Media{Filename: filename}
+	return m.IsRecognized()
 }
 
 func (m *Media) Exists() bool {
@@ -171,6 +207,29 @@ func (m *Media) Init() error {
 		return err
 	}
 	m.Metadata = metadata
+	if err := m.InitStat(); err != nil {
+		return err
+	}
+
+	m.CreationDate, err = m.GetDate()
+	if err != nil {
+		return err
+	}
+
+	// Perceptual hash for near-duplicate detection. Formats the image package
+	// can't decode (TIFF, BMP, ...) simply don't get one.
+	if m.IsImage() && m.PerceptualHash == "" {
+		if phash, err := PerceptualHash(m.Filename); err == nil {
+			m.PerceptualHash = FormatPerceptualHash(phash)
+		}
+	}
+	return nil
+}
+
+// InitStat is Init without reading metadata, so exiftool isn't needed: the
+// file is dated by its modification time and gets no perceptual hash. Thin
+// clients use it and leave the rest to the server (see ExtractReceived).
+func (m *Media) InitStat() error {
 	fileInfo, err := os.Stat(m.Filename)
 	if err != nil {
 		return err
@@ -180,18 +239,21 @@ func (m *Media) Init() error {
 	}
 	m.Size = fileInfo.Size()
 	m.ModifiedDate = fileInfo.ModTime()
+	m.CreationDate = m.ModifiedDate
 
 	// Don't need to calculate it unless we're going to insert or check if it exists.  I hope.
 	// m.Checksum, err = checksum(m.Filename)
 
-	m.Checksum100k, err = Checksum(m.Filename, true)
-	if err != nil {
-		return err
-	}
-
-	m.CreationDate, err = m.GetDate()
-	if err != nil {
-		return err
+	// Callers with cached checksums fill them in before Init to skip hashing
+	if m.Checksum100k == "" {
+		h, err := m.Hasher()
+		if err != nil {
+			return err
+		}
+		m.Checksum100k, err = ChecksumWith(h, m.Filename, true)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -218,9 +280,27 @@ func (m *Media) Print() {
 func (m *Media) GetDate() (time.Time, error) {
 	// First, attempt to get the date from EXIF data.
 	// If that doesn't work...
-	var fields []string
-	if m.IsImage() {
-		fields = []string{
+	fields := dateFields(m.IsImage(), m.IsVideo())
+	for _, field := range fields {
+		theDate, ok := m.Metadata[field]
+
+		if ok {
+			theDate2, err := time.Parse("2006:01:02 15:04:05", theDate)
+			if err != nil {
+				return m.ModifiedDate, err
+			}
+			return theDate2, err
+		}
+	}
+	// No exif data?  Then return the Modified Date.
+	// Linux timestamps do not store creation time.
+	return m.ModifiedDate, nil
+}
+
+// dateFields returns the metadata fields holding a creation date, in order of preference
+func dateFields(image bool, video bool) []string {
+	if image {
+		return []string{
 			// "Exif.Photo.DateTimeDigitized",
 			// "Exif.Photo.DateTimeOriginal",
 			// "Exif.Image.DateTime",
@@ -228,9 +308,9 @@ func (m *Media) GetDate() (time.Time, error) {
 			"DateTimeOriginal",
 			"DateTime",
 		}
-	} else if m.IsVideo() {
+	} else if video {
 		// Currently supports .mp4 only
-		fields = []string{
+		return []string{
 			"CreateDate",
 			"MediaCreateDate",
 			"TrackCreateDate",
@@ -239,20 +319,7 @@ func (m *Media) GetDate() (time.Time, error) {
 			"TrackModifyDate",
 		}
 	}
-	for _, field := range fields {
-		theDate, ok := m.Metadata[field]
-
-		if ok {
-			theDate2, err := time.Parse("2006:01:02 15:04:05", theDate)
-			if err != nil {
-				return m.ModifiedDate, err
-			}
-			return theDate2, err
-		}
-	}
-	// No exif data?  Then return the Modified Date.
-	// Linux timestamps do not store creation time.
-	return m.ModifiedDate, nil
+	return nil
 }
 
 func (m *Media) GetMetadata() (map[string]string, error) {
@@ -268,8 +335,7 @@ func (m *Media) GetMetadata() (map[string]string, error) {
 }
 
 func (m *Media) GetImageMetadata() (map[string]string, error) {
-	et := GetExiftool()
-	return et.ReadMetadata(m.Filename), nil
+	return m.readMetadata(), nil
 }
 
 func (m *Media) GetFileMetadata() (map[string]string, error) {
@@ -280,7 +346,7 @@ func (m *Media) GetFileMetadata() (map[string]string, error) {
 	}
 	metadata["File.Size"] = strconv.FormatInt(fileInfo.Size(), 10)
 	metadata["File.ModifiedDate"] = fileInfo.ModTime().Format("2006-01-02 16.04.05")
-	metadata["File.MD5Sum"], err = Checksum(m.Filename)
+	metadata["File.MD5Sum"], err = ChecksumWith(hashers["md5"], m.Filename, false)
 	if err != nil {
 		return make(map[string]string), err
 	}
@@ -288,66 +354,32 @@ func (m *Media) GetFileMetadata() (map[string]string, error) {
 }
 
 func (m *Media) GetVideoMetadata() (map[string]string, error) {
-	et = GetExiftool()
-
-	metadata := make(map[string]string)
+	return m.readMetadata(), nil
+}
 
-	fileInfos := et.et.ExtractMetadata(m.Filename)
-	for _, fileInfo := range fileInfos {
-		if fileInfo.Err != nil {
-			fmt.Printf("Error concerning %v: %v\n", fileInfo.File, fileInfo.Err)
-			continue
-		}
-		for key, value := range fileInfo.Fields {
-			// metadata[k] = v
-			// fmt.Printf("[%v] %v\n", k, v)
-			switch v := value.(type) {
-			case string:
-				metadata[key] = v
-			case int:
-				metadata[key] = strconv.Itoa(v)
-			case float64:
-				metadata[key] = strconv.FormatFloat(v, 'f', -1, 64)
-			case bool:
-				metadata[key] = strconv.FormatBool(v)
-			default:
-				metadata[key] = fmt.Sprintf("<Unsupported field of type %s>", reflect.TypeOf(v))
-			}
-		}
+// readMetadata reads the file's metadata with the shared MetadataReader
+// A file it can't read is logged and treated as having no metadata, so the
+// file is still sorted, by its modification time.
+func (m *Media) readMetadata() map[string]string {
+	metadata, err := GetMetadataReader().ReadMetadata(m.Filename)
+	if err != nil {
+		slog.Warn("Unable to read metadata", "file", m.Filename, "error", err)
+		return make(map[string]string)
 	}
-
-	return metadata, nil
+	return metadata
 }
 
+// Checksum returns the checksum of a file using DefaultHashAlgorithm
+// Pass true to only hash the first 100KB (checksum100k)
 func Checksum(filename string, short ...bool) (string, error) {
 	var hundredk bool = false
 	if len(short) > 0 {
 		hundredk = short[0]
 	}
 
-	// Open file
-	f, err := os.Open(filename)
+	h, err := GetHasher(DefaultHashAlgorithm)
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
-
-	// Set the checksum function
-	h := md5.New()
-
-	// Get the file's checksum
-	var BUFSIZE int64 = 102400
-	if hundredk {
-		_, err = io.CopyN(h, f, BUFSIZE)
-		if err != nil {
-			return "", err
-		}
-	} else {
-		_, err = io.Copy(h, f)
-		if err != nil {
-			return "", err
-		}
-	}
-
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	return ChecksumWith(h, filename, hundredk)
 }
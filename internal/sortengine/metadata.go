@@ -0,0 +1,316 @@
+package sortengine
+
+// Metadata storage
+// Everything exiftool reports about a file is kept in media_metadata as
+// key/value rows. The fields people search by are also copied ("promoted")
+// into columns of the media table, parsed into numbers where that makes sense,
+// so questions like "all photos from the Canon" are answered without reading
+// any files.
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PromotedMetadata holds the metadata fields stored as media columns
+// Zero values (nil for coordinates) mean the file didn't say.
+type PromotedMetadata struct {
+	CameraMake  string   `json:"camera_make,omitempty"`
+	CameraModel string   `json:"camera_model,omitempty"`
+	Lens        string   `json:"lens,omitempty"`
+	ISO         int      `json:"iso,omitempty"`
+	GPSLat      *float64 `json:"gps_lat,omitempty"`     // Decimal degrees, negative south of the equator
+	GPSLon      *float64 `json:"gps_lon,omitempty"`     // Decimal degrees, negative west of Greenwich
+	Orientation int      `json:"orientation,omitempty"` // EXIF orientation, 1 (normal) to 8
+	Duration    float64  `json:"duration,omitempty"`    // Seconds, for videos
+}
+
+// promotedColumns are the promoted metadata columns, in PromotedMetadata order
+const promotedColumns = "camera_make, camera_model, lens, iso, gps_lat, gps_lon, orientation, duration"
+
+// mediaColumns are the columns every insert into media fills, in the order
+// mediaValues returns them
+const mediaColumns = "filename, checksum, checksum100k, size, create_date, stored_path, hash_algorithm, phash, uploaded_by, " + promotedColumns
+
+// mediaValues returns the values for mediaColumns
+func mediaValues(m *Media) []interface{} {
+	p := PromoteMetadata(m.Metadata)
+	return []interface{}{
+		m.Filename,
+		m.Checksum,
+		m.Checksum100k,
+		m.Size,
+		m.CreationDate,
+		m.StoredPath,
+		m.HashAlgorithm,
+		m.PerceptualHash,
+		m.UploadedBy,
+		nullString(p.CameraMake),
+		nullString(p.CameraModel),
+		nullString(p.Lens),
+		nullInt(p.ISO),
+		p.GPSLat,
+		p.GPSLon,
+		nullInt(p.Orientation),
+		nullFloat(p.Duration),
+	}
+}
+
+// placeholders returns n comma-separated SQL placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// scanPromoted reads promoted columns selected in promotedColumns order
+// Call it with the destinations it returns, then finish to fill in p.
+func scanPromoted(p *PromotedMetadata) (dest []interface{}, finish func()) {
+	var cameraMake, model, lens sql.NullString
+	var iso, orientation sql.NullInt64
+	var lat, lon, duration sql.NullFloat64
+	dest = []interface{}{&cameraMake, &model, &lens, &iso, &lat, &lon, &orientation, &duration}
+	finish = func() {
+		p.CameraMake = cameraMake.String
+		p.CameraModel = model.String
+		p.Lens = lens.String
+		p.ISO = int(iso.Int64)
+		if lat.Valid && lon.Valid {
+			p.GPSLat = &lat.Float64
+			p.GPSLon = &lon.Float64
+		}
+		p.Orientation = int(orientation.Int64)
+		p.Duration = duration.Float64
+	}
+	return dest, finish
+}
+
+// likeEscaper escapes LIKE wildcards, for use with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// insertMetadata stores a file's metadata as key/value rows
+func insertMetadata(tx *sql.Tx, checksum string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO media_metadata (checksum, key, value) VALUES (?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("error preparing metadata insert: %v", err)
+	}
+	defer stmt.Close()
+	for key, value := range metadata {
+		if value == "" {
+			continue
+		}
+		if _, err := stmt.Exec(checksum, key, value); err != nil {
+			return fmt.Errorf("error inserting metadata %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// MediaMetadata returns every metadata field stored for a checksum
+// A file without metadata, or an unknown checksum, gives an empty map.
+func (d *DB) MediaMetadata(checksum string) (map[string]string, error) {
+	rows, err := d.db.Query("SELECT key, value FROM media_metadata WHERE checksum = ?", checksum)
+	if err != nil {
+		return nil, fmt.Errorf("error querying metadata: %v", err)
+	}
+	defer rows.Close()
+	metadata := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("error reading metadata row: %v", err)
+		}
+		metadata[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating metadata rows: %v", err)
+	}
+	return metadata, nil
+}
+
+// PromoteMetadata picks the promoted fields out of exiftool's output
+// exiftool formats values for people ("37 deg 46' 29.64\" N", "Rotate 90 CW",
+// "0:01:23"), so they are parsed back into numbers here. Values that can't
+// be parsed are left out; the raw text is still in media_metadata.
+func PromoteMetadata(metadata map[string]string) PromotedMetadata {
+	var p PromotedMetadata
+	if len(metadata) == 0 {
+		return p
+	}
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if value := strings.TrimSpace(metadata[key]); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	p.CameraMake = first("Make")
+	p.CameraModel = first("Model")
+	p.Lens = first("LensModel", "LensID", "Lens")
+	if iso, ok := leadingNumber(first("ISO")); ok && iso > 0 {
+		p.ISO = int(iso)
+	}
+	p.GPSLat, p.GPSLon = parsePosition(metadata)
+	p.Orientation = parseOrientation(first("Orientation"), first("Rotation"))
+	p.Duration = parseDuration(first("Duration", "MediaDuration", "TrackDuration"))
+	return p
+}
+
+// numberPattern matches the numbers in a formatted value
+var numberPattern = regexp.MustCompile(`[-+]?\d+(?:\.\d+)?`)
+
+// leadingNumber returns the first number in s, e.g. 100 for "100" or "100 (Auto)"
+func leadingNumber(s string) (float64, bool) {
+	match := numberPattern.FindString(s)
+	if match == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(match, 64)
+	return n, err == nil
+}
+
+// parsePosition finds GPS coordinates, preferring the separate latitude and
+// longitude fields over combined ones such as QuickTime's GPSCoordinates
+func parsePosition(metadata map[string]string) (*float64, *float64) {
+	lat, latOK := parseCoordinate(metadata["GPSLatitude"], metadata["GPSLatitudeRef"])
+	lon, lonOK := parseCoordinate(metadata["GPSLongitude"], metadata["GPSLongitudeRef"])
+	if !latOK || !lonOK {
+		for _, key := range []string{"GPSPosition", "GPSCoordinates"} {
+			parts := strings.Split(metadata[key], ",")
+			if len(parts) < 2 {
+				continue
+			}
+			lat, latOK = parseCoordinate(parts[0], "")
+			lon, lonOK = parseCoordinate(parts[1], "")
+			if latOK && lonOK {
+				break
+			}
+		}
+	}
+	if !latOK || !lonOK || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil, nil
+	}
+	// 0,0 is what cameras without a fix tend to write
+	if lat == 0 && lon == 0 {
+		return nil, nil
+	}
+	return &lat, &lon
+}
+
+// parseCoordinate parses decimal degrees ("-33.86") or degrees, minutes and
+// seconds ("33 deg 51' 54.00\" S"). The hemisphere comes from a trailing
+// letter or from ref ("South", "W", ...).
+func parseCoordinate(value string, ref string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	numbers := numberPattern.FindAllString(value, 3)
+	if len(numbers) == 0 {
+		return 0, false
+	}
+	var degrees float64
+	for i, scale := range []float64{1, 60, 3600}[:len(numbers)] {
+		n, err := strconv.ParseFloat(numbers[i], 64)
+		if err != nil {
+			return 0, false
+		}
+		degrees += abs(n) / scale
+	}
+	negative := strings.HasPrefix(numbers[0], "-")
+	hemisphere := strings.ToUpper(strings.TrimSpace(ref))
+	if fields := strings.Fields(value); hemisphere == "" && len(fields) > 0 {
+		hemisphere = strings.ToUpper(fields[len(fields)-1])
+	}
+	if strings.HasPrefix(hemisphere, "S") || strings.HasPrefix(hemisphere, "W") {
+		negative = true
+	}
+	if negative {
+		degrees = -degrees
+	}
+	return degrees, true
+}
+
+func abs(n float64) float64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// orientations maps exiftool's names for the EXIF orientation values
+var orientations = map[string]int{
+	"horizontal (normal)":                 1,
+	"mirror horizontal":                   2,
+	"rotate 180":                          3,
+	"mirror vertical":                     4,
+	"mirror horizontal and rotate 270 cw": 5,
+	"rotate 90 cw":                        6,
+	"mirror horizontal and rotate 90 cw":  7,
+	"rotate 270 cw":                       8,
+}
+
+// parseOrientation returns the EXIF orientation of a picture, or converts a
+// video's rotation in degrees to the matching orientation
+func parseOrientation(orientation string, rotation string) int {
+	if orientation != "" {
+		if n, err := strconv.Atoi(orientation); err == nil && n >= 1 && n <= 8 {
+			return n
+		}
+		return orientations[strings.ToLower(orientation)]
+	}
+	switch rotation {
+	case "0":
+		return 1
+	case "90":
+		return 6
+	case "180":
+		return 3
+	case "270":
+		return 8
+	}
+	return 0
+}
+
+// parseDuration parses "83.2", "83.2 s", "0:01:23" or "1:23" into seconds
+func parseDuration(value string) float64 {
+	value = strings.TrimSuffix(strings.TrimSpace(strings.TrimSuffix(value, "(approx)")), " s")
+	if !strings.Contains(value, ":") {
+		seconds, _ := leadingNumber(value)
+		return seconds
+	}
+	var seconds float64
+	for _, part := range strings.Split(value, ":") {
+		n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds
+}
+
+// nullString, nullInt and nullFloat store zero values as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func nullInt(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+func nullFloat(n float64) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package sortengine
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestPromoteMetadata(t *testing.T) {
+	coord := func(f float64) *float64 { return &f }
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     PromotedMetadata
+	}{
+		{"nil", nil, PromotedMetadata{}},
+		{"empty values", map[string]string{"Make": " ", "ISO": ""}, PromotedMetadata{}},
+		{"camera trimmed", map[string]string{"Make": " Canon ", "Model": "Canon EOS R6"},
+			PromotedMetadata{CameraMake: "Canon", CameraModel: "Canon EOS R6"}},
+		{"lens model preferred", map[string]string{"LensID": "RF24-105mm", "LensModel": "RF24-105mm F4 L IS USM", "Lens": "24-105"},
+			PromotedMetadata{Lens: "RF24-105mm F4 L IS USM"}},
+		{"lens fallback", map[string]string{"Lens": "24-105"}, PromotedMetadata{Lens: "24-105"}},
+		{"iso", map[string]string{"ISO": "400"}, PromotedMetadata{ISO: 400}},
+		{"iso with note", map[string]string{"ISO": "100 (Auto)"}, PromotedMetadata{ISO: 100}},
+		{"iso zero", map[string]string{"ISO": "0"}, PromotedMetadata{}},
+		{"iso text", map[string]string{"ISO": "Auto"}, PromotedMetadata{}},
+		{"gps dms with refs", map[string]string{
+			"GPSLatitude": `37 deg 46' 29.64" N`, "GPSLatitudeRef": "North",
+			"GPSLongitude": `122 deg 25' 9.84" W`, "GPSLongitudeRef": "West",
+		}, PromotedMetadata{GPSLat: coord(37.7749), GPSLon: coord(-122.4194)}},
+		{"gps hemisphere letters", map[string]string{
+			"GPSLatitude": `33 deg 51' 36.00" S`, "GPSLongitude": `151 deg 12' 36.00" E`,
+		}, PromotedMetadata{GPSLat: coord(-33.86), GPSLon: coord(151.21)}},
+		{"gps decimal", map[string]string{"GPSLatitude": "-33.86", "GPSLongitude": "151.21"},
+			PromotedMetadata{GPSLat: coord(-33.86), GPSLon: coord(151.21)}},
+		{"gps combined", map[string]string{"GPSCoordinates": `33 deg 51' 36.00" S, 151 deg 12' 36.00" E, 58 m Above Sea Level`},
+			PromotedMetadata{GPSLat: coord(-33.86), GPSLon: coord(151.21)}},
+		{"gps latitude only", map[string]string{"GPSLatitude": "12.5"}, PromotedMetadata{}},
+		{"gps no fix", map[string]string{"GPSLatitude": "0", "GPSLongitude": "0"}, PromotedMetadata{}},
+		{"gps out of range", map[string]string{"GPSLatitude": "91", "GPSLongitude": "10"}, PromotedMetadata{}},
+		{"orientation name", map[string]string{"Orientation": "Rotate 90 CW"}, PromotedMetadata{Orientation: 6}},
+		{"orientation number", map[string]string{"Orientation": "3"}, PromotedMetadata{Orientation: 3}},
+		{"orientation unknown", map[string]string{"Orientation": "Sideways"}, PromotedMetadata{}},
+		{"orientation out of range", map[string]string{"Orientation": "9"}, PromotedMetadata{}},
+		{"video rotation", map[string]string{"Rotation": "270"}, PromotedMetadata{Orientation: 8}},
+		{"duration clock", map[string]string{"Duration": "0:01:23"}, PromotedMetadata{Duration: 83}},
+		{"duration minutes", map[string]string{"Duration": "1:23"}, PromotedMetadata{Duration: 83}},
+		{"duration seconds", map[string]string{"Duration": "83.2 s"}, PromotedMetadata{Duration: 83.2}},
+		{"duration approx", map[string]string{"MediaDuration": "12.5 s (approx)"}, PromotedMetadata{Duration: 12.5}},
+		{"duration unparseable", map[string]string{"Duration": "1:xx"}, PromotedMetadata{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PromoteMetadata(tt.metadata)
+			if !sameCoordinate(got.GPSLat, tt.want.GPSLat) || !sameCoordinate(got.GPSLon, tt.want.GPSLon) {
+				t.Errorf("GPS = %s, %s, want %s, %s", formatCoordinate(got.GPSLat), formatCoordinate(got.GPSLon),
+					formatCoordinate(tt.want.GPSLat), formatCoordinate(tt.want.GPSLon))
+			}
+			got.GPSLat, got.GPSLon = nil, nil
+			tt.want.GPSLat, tt.want.GPSLon = nil, nil
+			if math.Abs(got.Duration-tt.want.Duration) < 1e-9 {
+				got.Duration = tt.want.Duration
+			}
+			if got != tt.want {
+				t.Errorf("PromoteMetadata(%v) = %+v, want %+v", tt.metadata, got, tt.want)
+			}
+		})
+	}
+}
+
+// sameCoordinate compares coordinates to about 10cm, since DMS values don't
+// convert to decimal degrees exactly
+func sameCoordinate(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return math.Abs(*a-*b) < 1e-6
+}
+
+func formatCoordinate(c *float64) string {
+	if c == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("%.6f", *c)
+}
@@ -0,0 +1,66 @@
+package sortengine
+
+// Metadata readers
+// Metadata is read with exiftool when it is installed, since it knows every
+// format there is. Without it, NativeReader reads the fields sorting and
+// searching need from the common formats itself, so the binaries work on
+// machines with nothing else installed.
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// MetadataReader reads the metadata of pictures and videos
+// Fields are named and formatted as exiftool prints them, whatever reads
+// them, so the rest of sortengine doesn't need to know which it was.
+type MetadataReader interface {
+	ReadMetadata(filename string) (map[string]string, error)
+	Close() error
+}
+
+var (
+	metadataReaderOnce sync.Once
+	metadataReader     MetadataReader
+	metadataReaderSize = 1
+)
+
+// SetMetadataReaderSize sets how many files the shared reader may read at
+// once, which for exiftool is how many processes it may run. Binaries set it
+// to their worker count before anything reads metadata; once the reader
+// exists it has no effect.
+func SetMetadataReaderSize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	metadataReaderSize = n
+}
+
+// GetMetadataReader returns the shared reader, starting exiftool the first
+// time if it is installed
+func GetMetadataReader() MetadataReader {
+	metadataReaderOnce.Do(func() {
+		if ExiftoolAvailable() {
+			pool, err := NewExiftoolPool(metadataReaderSize)
+			if err == nil {
+				slog.Info("Reading metadata with exiftool", "max_processes", metadataReaderSize)
+				metadataReader = pool
+				return
+			}
+			slog.Warn("Unable to start exiftool, reading metadata natively", "error", err)
+		} else {
+			slog.Info("exiftool not found, reading metadata natively")
+		}
+		metadataReader = NewNativeReader()
+	})
+	return metadataReader
+}
+
+// CloseMetadataReader stops exiftool if it was started, waiting for reads in
+// progress to finish
+func CloseMetadataReader() error {
+	if metadataReader == nil {
+		return nil
+	}
+	return metadataReader.Close()
+}
@@ -0,0 +1,421 @@
+package sortengine
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx so helpers can run
+// either directly against the database or inside a migration transaction
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Migration is a single step in the schema history
+// Steps are applied in Version order, each inside its own transaction, and the
+// settings table records the last version applied as "schema_version"
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(d *DB, tx *sql.Tx) error
+}
+
+// MigrationInfo describes a migration and whether it has been applied
+type MigrationInfo struct {
+	Version     int
+	Description string
+	Applied     bool
+}
+
+// migrations is the ordered schema history
+// NEVER edit or reorder a migration that has shipped - append a new one instead
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create settings and media tables",
+		Up:          migrateCreateTables,
+	},
+	{
+		Version:     2,
+		Description: "Add media.stored_path and backfill it from files under SaveDir",
+		Up:          migrateAddStoredPath,
+	},
+	{
+		Version:     3,
+		Description: "Add media.hash_algorithm (existing rows are MD5)",
+		Up:          migrateAddHashAlgorithm,
+	},
+	{
+		Version:     4,
+		Description: "Add media.phash for near-duplicate image detection",
+		Up:          migrateAddPerceptualHash,
+	},
+	{
+		Version:     5,
+		Description: "Create upload_sessions table for resumable chunked uploads",
+		Up:          migrateCreateUploadSessions,
+	},
+	{
+		Version:     6,
+		Description: "Add media.uploaded_by to record which API token uploaded each file",
+		Up:          migrateAddUploadedBy,
+	},
+	{
+		Version:     7,
+		Description: "Create rejected table for checksums deleted with reject",
+		Up:          migrateCreateRejected,
+	},
+	{
+		Version:     8,
+		Description: "Create upload_intents table so interrupted uploads can be recovered",
+		Up:          migrateCreateUploadIntents,
+	},
+	{
+		Version:     9,
+		Description: "Add media.uploaded_at to record when each file was uploaded",
+		Up:          migrateAddUploadedAt,
+	},
+	{
+		Version:     10,
+		Description: "Create media_metadata table and promoted metadata columns on media",
+		Up:          migrateCreateMediaMetadata,
+	},
+	{
+		Version:     11,
+		Description: "Add rejected.hash_algorithm and rejected.stored_path so -rehash can convert rejected checksums",
+		Up:          migrateAddRejectedHashAlgorithm,
+	},
+}
+
+// LatestSchemaVersion returns the version the schema will be at once all migrations are applied
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func migrateCreateTables(d *DB, tx *sql.Tx) error {
+	// IF NOT EXISTS lets this adopt databases created before migrations existed
+	stmt := `
+	CREATE TABLE IF NOT EXISTS
+		settings (
+			setting CHAR UNIQUE,
+			value CHAR
+		)
+	`
+	if _, err := tx.Exec(stmt); err != nil {
+		return err
+	}
+
+	stmt = `
+	CREATE TABLE IF NOT EXISTS
+		media (
+			filename CHAR,
+			checksum CHAR UNIQUE,
+			checksum100k CHAR,
+			size INT,
+			create_date TIMESTAMP
+		)
+	`
+	_, err := tx.Exec(stmt)
+	return err
+}
+
+func migrateAddStoredPath(d *DB, tx *sql.Tx) error {
+	// Databases created by versions that added the column ad hoc already have it
+	hasStoredPath, err := columnExists(tx, "media", "stored_path")
+	if err != nil {
+		return err
+	}
+	if !hasStoredPath {
+		if _, err := tx.Exec("ALTER TABLE media ADD COLUMN stored_path CHAR"); err != nil {
+			return fmt.Errorf("unable to add stored_path column: %v", err)
+		}
+	}
+
+	// Backfill failures are not fatal - rows without a stored_path still work
+	// for duplicate detection
+	if err := backfillStoredPaths(tx, d.filename, d.config.Server.SaveDir); err != nil {
+		slog.Warn("Could not backfill stored paths", "error", err)
+	}
+	return nil
+}
+
+func migrateAddHashAlgorithm(d *DB, tx *sql.Tx) error {
+	// The default marks every pre-existing row as MD5, which is what they were hashed with
+	_, err := tx.Exec(fmt.Sprintf("ALTER TABLE media ADD COLUMN hash_algorithm CHAR DEFAULT '%s'", LegacyHashAlgorithm))
+	return err
+}
+
+func migrateAddPerceptualHash(d *DB, tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE media ADD COLUMN phash CHAR")
+	return err
+}
+
+func migrateCreateUploadSessions(d *DB, tx *sql.Tx) error {
+	// received is a JSON list of byte ranges; timestamps are unix seconds
+	_, err := tx.Exec(`
+	CREATE TABLE
+		upload_sessions (
+			id CHAR PRIMARY KEY,
+			checksum CHAR UNIQUE,
+			size INT,
+			media TEXT,
+			temp_path CHAR,
+			received TEXT,
+			created_at INT,
+			updated_at INT
+		)
+	`)
+	return err
+}
+
+func migrateAddUploadedBy(d *DB, tx *sql.Tx) error {
+	// Rows uploaded before tokens existed stay NULL
+	_, err := tx.Exec("ALTER TABLE media ADD COLUMN uploaded_by CHAR")
+	return err
+}
+
+func migrateCreateRejected(d *DB, tx *sql.Tx) error {
+	// checksum100k is kept so clients' quick pre-check skips rejected files
+	// without hashing them in full; rejected_at is unix seconds
+	_, err := tx.Exec(`
+	CREATE TABLE
+		rejected (
+			checksum CHAR PRIMARY KEY,
+			checksum100k CHAR,
+			filename CHAR,
+			rejected_by CHAR,
+			rejected_at INT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX idx_rejected_checksum100k ON rejected(checksum100k)")
+	return err
+}
+
+func migrateCreateUploadIntents(d *DB, tx *sql.Tx) error {
+	// state is "pending" or "committed"; created_at is unix seconds
+	_, err := tx.Exec(`
+	CREATE TABLE
+		upload_intents (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			checksum CHAR,
+			temp_path CHAR,
+			stored_path CHAR,
+			state CHAR,
+			created_at INT
+		)
+	`)
+	return err
+}
+
+func migrateAddUploadedAt(d *DB, tx *sql.Tx) error {
+	// Unix seconds; rows from before this migration, and files added by
+	// -reindex or -reimport rather than uploaded, have none
+	if _, err := tx.Exec("ALTER TABLE media ADD COLUMN uploaded_at INT"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("CREATE INDEX idx_uploaded_at ON media(uploaded_at)")
+	return err
+}
+
+func migrateCreateMediaMetadata(d *DB, tx *sql.Tx) error {
+	// Rows from before this migration have no metadata: the server used to
+	// discard what clients sent
+	columns := []string{
+		"camera_make CHAR",
+		"camera_model CHAR",
+		"lens CHAR",
+		"iso INT",
+		"gps_lat REAL",
+		"gps_lon REAL",
+		"orientation INT",
+		"duration REAL",
+	}
+	for _, column := range columns {
+		if _, err := tx.Exec("ALTER TABLE media ADD COLUMN " + column); err != nil {
+			return fmt.Errorf("unable to add column %s: %v", column, err)
+		}
+	}
+	stmts := []string{
+		"CREATE INDEX idx_camera ON media(camera_make, camera_model)",
+		`CREATE TABLE
+			media_metadata (
+				checksum CHAR,
+				key CHAR,
+				value TEXT,
+				PRIMARY KEY (checksum, key)
+			)`,
+		"CREATE INDEX idx_media_metadata_key ON media_metadata(key, value)",
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateAddRejectedHashAlgorithm(d *DB, tx *sql.Tx) error {
+	// The media rows these were copied from are gone, so the algorithm is
+	// told from the checksum's length. Anything else stays NULL, never matches
+	// an upload, and is reported by -rehash.
+	stmts := []string{
+		"ALTER TABLE rejected ADD COLUMN hash_algorithm CHAR",
+		"ALTER TABLE rejected ADD COLUMN stored_path CHAR",
+		"UPDATE rejected SET hash_algorithm = CASE length(checksum) WHEN 32 THEN 'md5' WHEN 64 THEN 'sha256' END",
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion returns the schema version recorded in the settings table
+// A database that predates the migration framework reports version 0
+func (d *DB) SchemaVersion() (int, error) {
+	var value string
+	err := d.db.QueryRow("SELECT value FROM settings WHERE setting = 'schema_version'").Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %v", err)
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q: %v", value, err)
+	}
+	return version, nil
+}
+
+func setSchemaVersion(tx *sql.Tx, version int) error {
+	_, err := tx.Exec(`
+		INSERT INTO settings (setting, value) VALUES ('schema_version', ?)
+		ON CONFLICT(setting) DO UPDATE SET value = excluded.value
+	`, strconv.Itoa(version))
+	return err
+}
+
+// tableExists reports whether the database has a table with the given name
+func tableExists(db dbExecutor, table string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking for table %s: %v", table, err)
+	}
+	return count > 0, nil
+}
+
+// columnExists reports whether a table has a column with the given name
+func columnExists(db dbExecutor, table string, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("error reading table info for %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, fmt.Errorf("error scanning table info for %s: %v", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// ensureSettingsTable creates the settings table if needed so the schema
+// version can be read before any migration has run
+func (d *DB) ensureSettingsTable() error {
+	return d.DbExec(`
+	CREATE TABLE IF NOT EXISTS
+		settings (
+			setting CHAR UNIQUE,
+			value CHAR
+		)
+	`)
+}
+
+// Migrate applies all pending migrations in order
+// Each migration runs in its own transaction together with the schema_version
+// update, so a failure leaves the database at the last fully applied version
+func (d *DB) Migrate() error {
+	if err := d.ensureSettingsTable(); err != nil {
+		return fmt.Errorf("unable to create settings table: %v", err)
+	}
+
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", current, LatestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		slog.Info("Applying database migration", "version", m.Version, "description", m.Description)
+		tx, err := d.db.Begin()
+		if err != nil {
+			return fmt.Errorf("error starting migration %d: %v", m.Version, err)
+		}
+		if err := m.Up(d, tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		if err := setSchemaVersion(tx, m.Version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error recording schema version %d: %v", m.Version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing migration %d: %v", m.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatus returns the current schema version and every known migration
+// with whether it has been applied. It does not change the database.
+func (d *DB) MigrationStatus() (int, []MigrationInfo, error) {
+	current := 0
+	hasSettings, err := tableExists(d.db, "settings")
+	if err != nil {
+		return 0, nil, err
+	}
+	if hasSettings {
+		current, err = d.SchemaVersion()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	infos := make([]MigrationInfo, 0, len(migrations))
+	for _, m := range migrations {
+		infos = append(infos, MigrationInfo{
+			Version:     m.Version,
+			Description: m.Description,
+			Applied:     m.Version <= current,
+		})
+	}
+	return current, infos, nil
+}
@@ -0,0 +1,133 @@
+package sortengine
+
+// NativeReader reads metadata without exiftool
+// It knows far fewer formats and fields than exiftool: EXIF from JPEG, TIFF
+// and HEIC pictures, and dates, duration, size, rotation and location from
+// MP4 and MOV videos. That covers what files are sorted and searched by (see
+// GetDate and PromoteMetadata). The format is recognized from the content, so
+// files don't need the right extension, which uploaded temp files don't have.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// NativeReader is a MetadataReader written in Go
+type NativeReader struct{}
+
+// NewNativeReader creates a NativeReader
+func NewNativeReader() *NativeReader {
+	return &NativeReader{}
+}
+
+// Close does nothing; NativeReader holds nothing open between files
+func (n *NativeReader) Close() error {
+	return nil
+}
+
+// ReadMetadata returns the fields NativeReader understands in filename
+// Formats it doesn't know give just a FileType, or nothing. A file that is
+// damaged part way through gives the fields read before the damage, and an
+// error only if there were none.
+func (n *NativeReader) ReadMetadata(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(f, header); err != nil {
+		// Too short to be anything we know
+		return map[string]string{}, nil
+	}
+
+	metadata := make(map[string]string)
+	switch {
+	case header[0] == 0xFF && header[1] == 0xD8:
+		metadata["FileType"] = "JPEG"
+		err = readJPEG(f, info.Size(), metadata)
+	case bytes.HasPrefix(header, []byte("II*\x00")) || bytes.HasPrefix(header, []byte("MM\x00*")):
+		metadata["FileType"] = "TIFF"
+		err = readEXIF(f, 0, metadata)
+	case isISOBMFF(header):
+		err = readISOBMFF(f, info.Size(), metadata)
+	case bytes.HasPrefix(header, []byte("\x89PNG")):
+		metadata["FileType"] = "PNG"
+	case bytes.HasPrefix(header, []byte("GIF8")):
+		metadata["FileType"] = "GIF"
+	case bytes.HasPrefix(header, []byte("BM")):
+		metadata["FileType"] = "BMP"
+	}
+	if err != nil && len(metadata) <= 1 {
+		return metadata, fmt.Errorf("unable to read %s: %v", filename, err)
+	}
+	return metadata, nil
+}
+
+// isISOBMFF reports whether a file starts with a box of a type MP4, MOV or
+// HEIC files start with. Old QuickTime files have no ftyp.
+func isISOBMFF(header []byte) bool {
+	switch string(header[4:8]) {
+	case "ftyp", "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+// readJPEG reads the picture size and the EXIF APP1 segment of a JPEG
+// The segments holding them come before the image data, so reading stops
+// there.
+func readJPEG(r io.ReaderAt, size int64, metadata map[string]string) error {
+	buf := make([]byte, 10)
+	for pos := int64(2); pos+4 <= size; {
+		if _, err := r.ReadAt(buf[:4], pos); err != nil {
+			return fmt.Errorf("unable to read JPEG segment: %v", err)
+		}
+		if buf[0] != 0xFF {
+			return fmt.Errorf("bad JPEG segment at %d", pos)
+		}
+		marker := buf[1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte before a marker
+			pos++
+			continue
+		case marker == 0xD9 || marker == 0xDA:
+			// End of image, or the image data
+			return nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			// Markers without a length
+			pos += 2
+			continue
+		}
+		length := int64(binary.BigEndian.Uint16(buf[2:4]))
+		if length < 2 {
+			return fmt.Errorf("bad JPEG segment at %d", pos)
+		}
+
+		switch {
+		case marker == 0xE1 && length >= 14:
+			if _, err := r.ReadAt(buf[:6], pos+4); err == nil && string(buf[:6]) == "Exif\x00\x00" {
+				if err := readEXIF(r, pos+10, metadata); err != nil {
+					return err
+				}
+			}
+		case marker >= 0xC0 && marker <= 0xC3 && length >= 7:
+			// Start of frame: precision, then height and width
+			if _, err := r.ReadAt(buf[:5], pos+4); err == nil {
+				metadata["ImageHeight"] = fmt.Sprintf("%d", binary.BigEndian.Uint16(buf[1:3]))
+				metadata["ImageWidth"] = fmt.Sprintf("%d", binary.BigEndian.Uint16(buf[3:5]))
+			}
+		}
+		pos += 2 + length
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package sortengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// jpegSegment builds a JPEG marker segment
+func jpegSegment(marker byte, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	return append([]byte{0xFF, marker, byte((len(body) + 2) >> 8), byte(len(body) + 2)}, body...)
+}
+
+// jpegFrame builds a baseline start of frame segment
+func jpegFrame(width, height uint16) []byte {
+	return jpegSegment(0xC0, []byte{8}, u16(height), u16(width), []byte{1, 1, 0x11, 0})
+}
+
+func TestNativeReaderReadMetadata(t *testing.T) {
+	exif := jpegSegment(0xE1, []byte("Exif\x00\x00"), buildTIFF(binary.LittleEndian, []tiffEntry{tiffASCIIEntry(0x010F, "Canon")}, nil, nil))
+	jfif := jpegSegment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+	scan := append(jpegSegment(0xDA, []byte{1, 1, 0, 0, 63, 0}), 0x12, 0x34, 0xFF, 0xD9)
+	soi := []byte{0xFF, 0xD8}
+	created := time.Date(2021, time.February, 3, 4, 5, 6, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "jpeg",
+			data: bytes.Join([][]byte{soi, exif, jfif, jpegFrame(640, 480), scan}, nil),
+			want: map[string]string{"FileType": "JPEG", "Make": "Canon", "ImageWidth": "640", "ImageHeight": "480"},
+		},
+		{
+			name: "jpeg with fill bytes",
+			data: bytes.Join([][]byte{soi, {0xFF, 0xFF}, jpegFrame(640, 480), scan}, nil),
+			want: map[string]string{"FileType": "JPEG", "ImageWidth": "640", "ImageHeight": "480"},
+		},
+		{
+			name: "jpeg app1 that isn't exif",
+			data: bytes.Join([][]byte{soi, jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")), jpegFrame(640, 480), scan}, nil),
+			want: map[string]string{"FileType": "JPEG", "ImageWidth": "640", "ImageHeight": "480"},
+		},
+		{
+			name:    "jpeg damaged before anything was read",
+			data:    append(soi, make([]byte, 20)...),
+			want:    map[string]string{"FileType": "JPEG"},
+			wantErr: true,
+		},
+		{
+			name:    "jpeg with broken exif",
+			data:    bytes.Join([][]byte{soi, jpegSegment(0xE1, []byte("Exif\x00\x00"), []byte("XX*\x00\x08\x00\x00\x00")), scan}, nil),
+			want:    map[string]string{"FileType": "JPEG"},
+			wantErr: true,
+		},
+		{
+			name: "jpeg damaged after the frame",
+			data: bytes.Join([][]byte{soi, jpegFrame(640, 480), make([]byte, 20)}, nil),
+			want: map[string]string{"FileType": "JPEG", "ImageWidth": "640", "ImageHeight": "480"},
+		},
+		{
+			name: "jpeg segment length past the end",
+			data: bytes.Join([][]byte{soi, jpegFrame(640, 480), {0xFF, 0xE2, 0xFF, 0xFF}, make([]byte, 10)}, nil),
+			want: map[string]string{"FileType": "JPEG", "ImageWidth": "640", "ImageHeight": "480"},
+		},
+		{
+			name: "tiff little endian",
+			data: buildTIFF(binary.LittleEndian, []tiffEntry{tiffASCIIEntry(0x010F, "Nikon")}, nil, nil),
+			want: map[string]string{"FileType": "TIFF", "Make": "Nikon"},
+		},
+		{
+			name: "tiff big endian",
+			data: buildTIFF(binary.BigEndian, []tiffEntry{tiffASCIIEntry(0x010F, "Nikon")}, nil, nil),
+			want: map[string]string{"FileType": "TIFF", "Make": "Nikon"},
+		},
+		{
+			name: "mp4",
+			data: bytes.Join([][]byte{mkbox("ftyp", []byte("mp42"), u32(0)), mkbox("moov", mvhd(created, created, 1000, 1500))}, nil),
+			want: map[string]string{
+				"FileType":   "MP4",
+				"CreateDate": "2021:02:03 04:05:06",
+				"ModifyDate": "2021:02:03 04:05:06",
+				"Duration":   "1.50 s",
+			},
+		},
+		{
+			name: "quicktime starting with a wide box",
+			data: bytes.Join([][]byte{mkbox("wide"), mkbox("moov", mvhd(created, created, 600, 600))}, nil),
+			want: map[string]string{
+				"CreateDate": "2021:02:03 04:05:06",
+				"ModifyDate": "2021:02:03 04:05:06",
+				"Duration":   "1.00 s",
+			},
+		},
+		{
+			name:    "mp4 with a bad box",
+			data:    append(mkbox("ftyp", []byte("mp42"), u32(0)), append(u32(3), "moov"...)...),
+			want:    map[string]string{"FileType": "MP4"},
+			wantErr: true,
+		},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), map[string]string{"FileType": "PNG"}, false},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00"), map[string]string{"FileType": "GIF"}, false},
+		{"unknown", []byte("just some text, not a picture"), map[string]string{}, false},
+		{"too short", soi, map[string]string{}, false},
+		{"empty", nil, map[string]string{}, false},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No extension: the format must be recognized from the content
+			path := filepath.Join(dir, string(rune('a'+i)))
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := NewNativeReader().ReadMetadata(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReadMetadata error = %v, want error: %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadMetadata = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := NewNativeReader().ReadMetadata(filepath.Join(dir, "missing")); err == nil {
+			t.Error("ReadMetadata of a missing file succeeded")
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package sortengine
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Perceptual hashing lets us find images that look the same but are not
+// byte-identical: re-saved JPEGs, resized copies, phone exports, etc.
+//
+// We use a difference hash (dHash): the image is reduced to a 9x8 grayscale
+// grid and each bit records whether a cell is brighter than its right-hand
+// neighbour. Visually similar images produce hashes that differ in only a few
+// bits, so similarity is the Hamming distance between two hashes.
+
+const (
+	dHashWidth  = 9
+	dHashHeight = 8
+
+	// Each grid cell is averaged over at most this many samples per axis.
+	// That is plenty to smooth out noise without walking every pixel of a
+	// 24 megapixel photo through image.Image.At().
+	dHashSamplesPerCell = 16
+)
+
+// DefaultSimilarityDistance is the Hamming distance under which two images are
+// considered near-duplicates when no distance is configured
+const DefaultSimilarityDistance = 10
+
+// PerceptualHash decodes an image file and returns its 64-bit dHash
+// Any format registered with the image package can be hashed (JPEG, PNG and GIF
+// are imported by media.go); other files return an error
+func PerceptualHash(filename string) (uint64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+	return dHash(img), nil
+}
+
+func dHash(img image.Image) uint64 {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	height := bounds.Dy()
+
+	var grid [dHashHeight][dHashWidth]float64
+	for row := 0; row < dHashHeight; row++ {
+		y0 := bounds.Min.Y + row*height/dHashHeight
+		y1 := bounds.Min.Y + (row+1)*height/dHashHeight
+		for col := 0; col < dHashWidth; col++ {
+			x0 := bounds.Min.X + col*width/dHashWidth
+			x1 := bounds.Min.X + (col+1)*width/dHashWidth
+			grid[row][col] = averageLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for row := 0; row < dHashHeight; row++ {
+		for col := 0; col < dHashWidth-1; col++ {
+			hash <<= 1
+			if grid[row][col] > grid[row][col+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// averageLuma returns the mean gray level of up to dHashSamplesPerCell^2
+// evenly spaced pixels inside [x0,x1) x [y0,y1)
+func averageLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+
+	stepX := (x1 - x0 + dHashSamplesPerCell - 1) / dHashSamplesPerCell
+	stepY := (y1 - y0 + dHashSamplesPerCell - 1) / dHashSamplesPerCell
+
+	// JPEGs decode to YCbCr, where the Y plane already is the gray level
+	ycbcr, isYCbCr := img.(*image.YCbCr)
+
+	var sum float64
+	var count int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			if isYCbCr {
+				sum += float64(ycbcr.Y[ycbcr.YOffset(x, y)])
+			} else {
+				sum += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
+
+// FormatPerceptualHash renders a hash the way it is stored in the database
+func FormatPerceptualHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParsePerceptualHash parses a hash produced by FormatPerceptualHash
+func ParsePerceptualHash(s string) (uint64, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("invalid perceptual hash %q", s)
+	}
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// HammingDistance returns the number of bits that differ between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// SimilarCluster is a group of images that are all within the requested
+// distance of at least one other member of the group
+type SimilarCluster struct {
+	Media       []MediaRecord `json:"media"`
+	MaxDistance int           `json:"max_distance"` // Largest distance between any two members
+}
+
+// ClusterSimilar groups records whose perceptual hashes are within maxDistance
+// of each other. Records without a valid hash are ignored and clusters of one
+// are dropped. Clusters are returned largest first.
+func ClusterSimilar(records []MediaRecord, maxDistance int) []SimilarCluster {
+	hashes := make([]uint64, 0, len(records))
+	valid := make([]MediaRecord, 0, len(records))
+	for _, r := range records {
+		h, err := ParsePerceptualHash(r.PerceptualHash)
+		if err != nil {
+			continue
+		}
+		hashes = append(hashes, h)
+		valid = append(valid, r)
+	}
+
+	// Union-find over every pair. This is O(n^2) comparisons, but each is a
+	// single XOR + popcount, so it stays fast for home-sized libraries.
+	parent := make([]int, len(valid))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := 0; i < len(hashes); i++ {
+		for j := i + 1; j < len(hashes); j++ {
+			if HammingDistance(hashes[i], hashes[j]) <= maxDistance {
+				if ri, rj := find(i), find(j); ri != rj {
+					parent[ri] = rj
+				}
+			}
+		}
+	}
+
+	groups := make(map[int][]int)
+	for i := range valid {
+		root := find(i)
+		groups[root] = append(groups[root], i)
+	}
+
+	clusters := make([]SimilarCluster, 0)
+	for _, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		cluster := SimilarCluster{Media: make([]MediaRecord, 0, len(members))}
+		for a, i := range members {
+			cluster.Media = append(cluster.Media, valid[i])
+			for _, j := range members[a+1:] {
+				if d := HammingDistance(hashes[i], hashes[j]); d > cluster.MaxDistance {
+					cluster.MaxDistance = d
+				}
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].Media) != len(clusters[j].Media) {
+			return len(clusters[i].Media) > len(clusters[j].Media)
+		}
+		return clusters[i].Media[0].Checksum < clusters[j].Media[0].Checksum
+	})
+	return clusters
+}
@@ -0,0 +1,208 @@
+package sortengine
+
+// Rebuilding the index
+// Reindex adds every picture and video under SaveDir that the database doesn't
+// know about, without moving anything. This recovers from a lost gosort.db
+// and adopts a folder that was organized before GoSort was pointed at it;
+// without it the server would accept a duplicate of every file.
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reindexBatchSize is how many files are inserted per transaction
+const reindexBatchSize = 100
+
+// ReindexResult counts what Reindex did
+type ReindexResult struct {
+	Added      int
+	Known      int // Already recorded at this path
+	Duplicates int // Same checksum as a file recorded elsewhere
+	Rejected   int // Deleted with reject; removed again rather than indexed
+	Failed     int
+}
+
+// Reindex hashes the files under SaveDir with workers goroutines and records
+// the ones the database is missing
+func (e *Engine) Reindex(workers int) (ReindexResult, error) {
+	var result ReindexResult
+	if workers < 1 {
+		workers = 1
+	}
+	saveDir := filepath.Clean(e.Config.Server.SaveDir)
+
+	// Find candidates first so progress can be reported against a total
+	slog.Info("Reindex: scanning", "savedir", saveDir)
+	var paths []string
+	err := filepath.WalkDir(saveDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Continue on errors
+		}
+		if d.IsDir() {
+			if path != saveDir && (d.Name() == QuarantineDirName || d.Name() == UploadsDirName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".download") || MediaType(path) == "other" {
+			return nil
+		}
+		known, err := e.DB.StoredPathExists(path)
+		if err != nil {
+			slog.Warn("Unable to look up stored path", "path", path, "error", err)
+			return nil
+		}
+		if known {
+			result.Known++
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("error walking %s: %v", saveDir, err)
+	}
+	slog.Info("Reindex: hashing files", "files", len(paths), "known", result.Known, "workers", workers)
+
+	pathChan := make(chan string, workers*2)
+	mediaChan := make(chan *Media, workers*2)
+	// done is closed if inserting fails, to stop the feeder and the workers
+	done := make(chan struct{})
+	var failed, duplicates, rejected int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range pathChan {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				m, err := e.loadStoredFile(path)
+				if err != nil {
+					slog.Warn("Unable to index file", "path", path, "error", err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				if e.DB.ChecksumRejected(m.Checksum, m.HashAlgorithm) {
+					// A delete with reject couldn't remove it; try again
+					// rather than bring it back
+					if err := e.removeRejectedFile(path); err != nil {
+						atomic.AddInt64(&failed, 1)
+					} else {
+						atomic.AddInt64(&rejected, 1)
+					}
+					continue
+				}
+				if e.DB.ChecksumExists(m.Checksum) {
+					atomic.AddInt64(&duplicates, 1)
+					continue
+				}
+				select {
+				case mediaChan <- m:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+	feed:
+		for _, path := range paths {
+			select {
+			case pathChan <- path:
+			case <-done:
+				break feed
+			}
+		}
+		close(pathChan)
+		wg.Wait()
+		close(mediaChan)
+	}()
+
+	// Insert from a single goroutine, in batches
+	start := time.Now()
+	lastReport := start
+	batch := make([]*Media, 0, reindexBatchSize)
+	seen := make(map[string]bool)
+	processed := func() int64 {
+		return int64(result.Added) + atomic.LoadInt64(&failed) + atomic.LoadInt64(&duplicates) + atomic.LoadInt64(&rejected)
+	}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := e.DB.AddFilesToDBBatch(batch, reindexBatchSize); err != nil {
+			return err
+		}
+		result.Added += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	// abort stops the feeder and the workers and waits for them to exit
+	abort := func(err error) (ReindexResult, error) {
+		close(done)
+		for range mediaChan {
+		}
+		return result, err
+	}
+
+	for m := range mediaChan {
+		// Two copies of the same file on disk: only the first one is recorded
+		if seen[m.Checksum] {
+			atomic.AddInt64(&duplicates, 1)
+			continue
+		}
+		seen[m.Checksum] = true
+
+		batch = append(batch, m)
+		if len(batch) >= reindexBatchSize {
+			if err := flush(); err != nil {
+				return abort(err)
+			}
+		}
+		if time.Since(lastReport) >= 5*time.Second {
+			done := processed() + int64(len(batch))
+			rate := float64(done) / time.Since(start).Seconds()
+			slog.Info("Reindex progress", "done", done, "total", len(paths), "files_per_sec", fmt.Sprintf("%.1f", rate))
+			lastReport = time.Now()
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+
+	result.Failed = int(failed)
+	result.Duplicates = int(duplicates)
+	result.Rejected = int(rejected)
+	return result, nil
+}
+
+// loadStoredFile builds the Media for a file already under SaveDir
+// The original client path isn't known, so Filename is the stored path.
+func (e *Engine) loadStoredFile(path string) (*Media, error) {
+	m, err := LoadMediaFile(path)
+	if err != nil {
+		// Init gets the size, checksum100k and a fallback date before it can
+		// fail on unparseable metadata dates; that's enough to index the file
+		if m == nil || m.Checksum100k == "" {
+			return nil, err
+		}
+	}
+	m.HashAlgorithm = e.Config.Server.HashAlgorithm
+	if err := m.SetChecksum(); err != nil {
+		return nil, err
+	}
+	m.StoredPath = path
+	return m, nil
+}
@@ -0,0 +1,252 @@
+package sortengine
+
+// Reorganizing an existing library
+// Reorganize moves every stored file to where server.layout would put it
+// today and updates its stored_path. Each move is appended to a journal
+// before it happens, so UndoReorganize can put everything back, including
+// after a crash halfway through.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JournalEntry records one file moved by Reorganize
+type JournalEntry struct {
+	Checksum string `json:"checksum"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// ReorganizeResult counts what Reorganize did
+type ReorganizeResult struct {
+	Moved     int
+	Unchanged int
+	Skipped   int // No stored file, or the move failed
+}
+
+// DefaultJournalPath returns a new journal file name next to the database
+func (e *Engine) DefaultJournalPath() string {
+	name := fmt.Sprintf("reorganize-%s.journal", time.Now().Format("20060102-150405"))
+	return filepath.Join(filepath.Dir(e.Config.Server.DBFile), name)
+}
+
+// Reorganize moves stored files to the paths the current layout gives them
+// With dryRun set nothing is moved and each planned move is only printed;
+// otherwise moves are recorded in journalPath, which must not exist yet.
+// Files that would get the same name are numbered with {seq} exactly as
+// uploads are. The server must not be running at the same time.
+func (e *Engine) Reorganize(dryRun bool, journalPath string) (ReorganizeResult, error) {
+	var result ReorganizeResult
+
+	records, _, err := e.DB.QueryMedia(MediaQuery{})
+	if err != nil {
+		return result, err
+	}
+
+	var journal *os.File
+	if !dryRun {
+		journal, err = os.OpenFile(journalPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return result, fmt.Errorf("unable to create journal: %v", err)
+		}
+		defer journal.Close()
+	}
+
+	// Old and new names of files moved in this run are both kept off limits, so
+	// a dry run picks the same names a real run would
+	reserved := make(map[string]bool)
+	readMetadata := e.layout.UsesMetadata()
+	journaled := 0
+
+	slog.Info("Reorganizing files", "files", len(records), "layout", e.layout)
+	for i, r := range records {
+		if i > 0 && i%100 == 0 {
+			slog.Info("Reorganize progress", "done", i, "total", len(records))
+		}
+		if r.StoredPath == "" || !FileOrDirExists(r.StoredPath) {
+			slog.Warn("No stored file for checksum, skipping", "checksum", r.Checksum)
+			result.Skipped++
+			continue
+		}
+		current := filepath.Clean(r.StoredPath)
+
+		// Filename keeps the client's original path, which {basename} and
+		// {ext} are taken from
+		m := &Media{
+			Filename:      r.Filename,
+			Checksum:      r.Checksum,
+			HashAlgorithm: r.HashAlgorithm,
+			CreationDate:  r.CreateDate,
+			Size:          r.Size,
+			UploadedBy:    r.UploadedBy,
+		}
+		if readMetadata {
+			m.Metadata = map[string]string{"Make": r.CameraMake, "Model": r.CameraModel}
+			// Rows stored before metadata was kept have neither; read them
+			// from the stored file
+			if r.CameraMake == "" && r.CameraModel == "" {
+				stored := &Media{Filename: current}
+				m.Metadata, _ = stored.GetMetadata()
+			}
+		}
+
+		target, err := e.nextFreeFilename(m, e.newFileDir(m), reserved, false, current)
+		if err != nil {
+			slog.Warn("Unable to choose a new name, skipping", "path", current, "error", err)
+			result.Skipped++
+			continue
+		}
+		reserved[target] = true
+		if target == current {
+			result.Unchanged++
+			continue
+		}
+		reserved[current] = true
+
+		if dryRun {
+			fmt.Printf("  %s -> %s\n", current, target)
+			result.Moved++
+			continue
+		}
+
+		entry := JournalEntry{Checksum: r.Checksum, From: current, To: target}
+		if err := writeJournalEntry(journal, entry); err != nil {
+			return result, err
+		}
+		journaled++
+		if err := e.moveStoredFile(entry.Checksum, entry.From, entry.To); err != nil {
+			slog.Warn("Unable to move file", "error", err)
+			result.Skipped++
+			continue
+		}
+		result.Moved++
+	}
+
+	// Nothing to undo; don't leave an empty journal behind
+	if journal != nil && journaled == 0 {
+		journal.Close()
+		os.Remove(journalPath)
+	}
+	return result, nil
+}
+
+// UndoReorganize moves the files recorded in a journal back, newest first
+// Entries whose file is already back in place (or was never moved, if the
+// run was interrupted) are skipped.
+func (e *Engine) UndoReorganize(journalPath string) (restored int, skipped int, err error) {
+	entries, err := readJournal(journalPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	slog.Info("Undoing moves", "moves", len(entries), "journal", journalPath)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if !FileOrDirExists(entry.To) || FileOrDirExists(entry.From) {
+			// Make sure the database points at the file wherever it is
+			if FileOrDirExists(entry.From) {
+				if err := e.DB.SetStoredPath(entry.Checksum, entry.From); err != nil {
+					slog.Warn("Unable to record stored path", "checksum", entry.Checksum, "error", err)
+				}
+			}
+			skipped++
+			continue
+		}
+		if err := e.moveStoredFile(entry.Checksum, entry.To, entry.From); err != nil {
+			slog.Warn("Unable to move file", "error", err)
+			skipped++
+			continue
+		}
+		restored++
+	}
+	return restored, skipped, nil
+}
+
+// moveStoredFile renames a stored file and updates its stored_path, removing
+// directories left empty. If the database can't be updated the file is moved back.
+func (e *Engine) moveStoredFile(checksum string, from string, to string) error {
+	if FileOrDirExists(to) {
+		return fmt.Errorf("not moving %s: %s already exists", from, to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return fmt.Errorf("unable to create directory for %s: %v", to, err)
+	}
+	// Both paths are under SaveDir, so this is a rename within one filesystem
+	// and either happens completely or not at all
+	if err := os.Rename(from, to); err != nil {
+		return fmt.Errorf("unable to move %s to %s: %v", from, to, err)
+	}
+	if err := e.DB.SetStoredPath(checksum, to); err != nil {
+		if rerr := os.Rename(to, from); rerr != nil {
+			return fmt.Errorf("%v; moving %s back also failed: %v", err, to, rerr)
+		}
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(from), e.Config.Server.SaveDir)
+	return nil
+}
+
+// removeEmptyDirs removes dir and then its parents for as long as they are
+// empty, stopping at root
+func removeEmptyDirs(dir string, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		// os.Remove refuses to remove directories that aren't empty
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// writeJournalEntry appends an entry and syncs it to disk, so the journal
+// never misses a move that happened
+func writeJournalEntry(journal *os.File, entry JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding journal entry: %v", err)
+	}
+	if _, err := journal.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing journal: %v", err)
+	}
+	if err := journal.Sync(); err != nil {
+		return fmt.Errorf("error syncing journal: %v", err)
+	}
+	return nil
+}
+
+// readJournal reads every entry of a journal
+// A partly written last line, from a crash while writing it, is ignored.
+func readJournal(journalPath string) ([]JournalEntry, error) {
+	f, err := os.Open(journalPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("journal %s does not exist", journalPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal: %v", err)
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("Ignoring unreadable journal line", "line", line, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading journal: %v", err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,272 @@
+package sortengine
+
+// Library scrubbing
+// Scrub checks that the files under SaveDir still match the media table: every
+// row's file must exist with the recorded size and checksum, and every picture
+// or video on disk must have a row. Silent corruption of an archive is only
+// noticed by reading it back, so every stored file is hashed again.
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// QuarantineDirName is the directory under SaveDir that problem files are moved to
+const QuarantineDirName = ".quarantine"
+
+// staleTempFileAge is how old a .download file must be before scrub reports it
+// Younger ones may belong to an upload in progress.
+const staleTempFileAge = 24 * time.Hour
+
+// Kinds of problems Scrub reports
+const (
+	ScrubMissing   = "missing"   // Row whose file is gone
+	ScrubCorrupt   = "corrupt"   // File whose size or checksum no longer matches its row
+	ScrubOrphan    = "orphan"    // Picture or video on disk with no row
+	ScrubDuplicate = "duplicate" // Orphan whose checksum belongs to another row
+	ScrubTemp      = "temp"      // Leftover .download file from an interrupted upload
+	ScrubRejected  = "rejected"  // Orphan whose checksum was deleted with reject
+)
+
+// ScrubIssue is one problem found by Scrub, and what was done about it
+type ScrubIssue struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	Checksum string `json:"checksum,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Action   string `json:"action,omitempty"` // "quarantined", "reimported", "removed", or empty if left alone
+}
+
+// ScrubOptions selects what Scrub does about the problems it finds
+type ScrubOptions struct {
+	Quarantine bool // Move corrupt, orphan and temp files to SaveDir/.quarantine
+	Reimport   bool // Add orphans to the database where they are
+}
+
+// ScrubReport is the result of a scrub
+type ScrubReport struct {
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Checked  int          `json:"checked"` // Rows whose file was hashed
+	OK       int          `json:"ok"`
+	Issues   []ScrubIssue `json:"issues"`
+}
+
+// Count returns how many issues of a kind were found
+func (r *ScrubReport) Count(kind string) int {
+	n := 0
+	for _, issue := range r.Issues {
+		if issue.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// Scrub verifies the library and reports every problem found
+// It is safe to run while the server accepts uploads.
+func (e *Engine) Scrub(opts ScrubOptions) (*ScrubReport, error) {
+	report := &ScrubReport{Started: time.Now(), Issues: make([]ScrubIssue, 0)}
+	saveDir := filepath.Clean(e.Config.Server.SaveDir)
+	quarantineDir := filepath.Join(saveDir, QuarantineDirName, report.Started.Format("20060102-150405"))
+
+	records, _, err := e.DB.QueryMedia(MediaQuery{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Pass 1: every row's file exists and still has the same contents
+	slog.Info("Scrub: verifying stored files", "files", len(records))
+	for i, r := range records {
+		if i > 0 && i%500 == 0 {
+			slog.Info("Scrub progress", "done", i, "total", len(records))
+		}
+		issue := e.verifyStoredFile(r)
+		if issue == nil {
+			report.Checked++
+			report.OK++
+			continue
+		}
+		if issue.Kind == ScrubCorrupt {
+			report.Checked++
+			if opts.Quarantine {
+				// Dropping the row lets an intact copy be uploaded again
+				if err := quarantineFile(issue.Path, saveDir, quarantineDir); err != nil {
+					issue.Detail += fmt.Sprintf("; quarantine failed: %v", err)
+				} else if err := e.DB.DeleteMedia(r.Checksum); err != nil {
+					issue.Detail += fmt.Sprintf("; quarantined but the row could not be removed: %v", err)
+					issue.Action = "quarantined"
+				} else {
+					issue.Action = "quarantined"
+				}
+			}
+		}
+		report.Issues = append(report.Issues, *issue)
+	}
+
+	// Pass 2: everything on disk is accounted for
+	activeUploads := make(map[string]bool)
+	sessions, err := e.DB.UploadSessions()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sessions {
+		activeUploads[filepath.Clean(s.TempPath)] = true
+	}
+
+	slog.Info("Scrub: looking for files without a database row", "savedir", saveDir)
+	err = filepath.WalkDir(saveDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Continue on errors
+		}
+		if d.IsDir() {
+			if path != saveDir && d.Name() == QuarantineDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		if strings.HasSuffix(path, ".download") {
+			if activeUploads[filepath.Clean(path)] || time.Since(info.ModTime()) < staleTempFileAge {
+				return nil
+			}
+			issue := ScrubIssue{Kind: ScrubTemp, Path: path, Detail: fmt.Sprintf("last modified %s", info.ModTime().Format("2006-01-02 15:04:05"))}
+			if opts.Quarantine {
+				e.quarantineIssue(&issue, saveDir, quarantineDir)
+			}
+			report.Issues = append(report.Issues, issue)
+			return nil
+		}
+
+		// Anything else that isn't a picture or video (the database, journals,
+		// thumbnails a file manager left behind) is none of our business
+		if MediaType(path) == "other" {
+			return nil
+		}
+		// Files uploaded since the scrub started are not orphans
+		if !info.ModTime().Before(report.Started) {
+			return nil
+		}
+		known, err := e.DB.StoredPathExists(path)
+		if err != nil || known {
+			return nil
+		}
+
+		issue := ScrubIssue{Kind: ScrubOrphan, Path: path}
+		if opts.Reimport {
+			e.reimportOrphan(&issue)
+		}
+		if issue.Action == "" && opts.Quarantine {
+			e.quarantineIssue(&issue, saveDir, quarantineDir)
+		}
+		report.Issues = append(report.Issues, issue)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %v", saveDir, err)
+	}
+
+	report.Finished = time.Now()
+	return report, nil
+}
+
+// verifyStoredFile checks one row against its file, returning nil if it matches
+func (e *Engine) verifyStoredFile(r MediaRecord) *ScrubIssue {
+	if r.StoredPath == "" {
+		return &ScrubIssue{Kind: ScrubMissing, Checksum: r.Checksum, Detail: "no stored path recorded"}
+	}
+	info, err := os.Stat(r.StoredPath)
+	if err != nil {
+		return &ScrubIssue{Kind: ScrubMissing, Path: r.StoredPath, Checksum: r.Checksum, Detail: err.Error()}
+	}
+	if info.Size() != r.Size {
+		return &ScrubIssue{Kind: ScrubCorrupt, Path: r.StoredPath, Checksum: r.Checksum, Detail: fmt.Sprintf("size is %d, expected %d", info.Size(), r.Size)}
+	}
+
+	algorithm := r.HashAlgorithm
+	if algorithm == "" {
+		algorithm = LegacyHashAlgorithm
+	}
+	h, err := GetHasher(algorithm)
+	if err != nil {
+		return &ScrubIssue{Kind: ScrubCorrupt, Path: r.StoredPath, Checksum: r.Checksum, Detail: err.Error()}
+	}
+	sum, err := ChecksumWith(h, r.StoredPath, false)
+	if err != nil {
+		return &ScrubIssue{Kind: ScrubCorrupt, Path: r.StoredPath, Checksum: r.Checksum, Detail: fmt.Sprintf("unreadable: %v", err)}
+	}
+	if sum != r.Checksum {
+		return &ScrubIssue{Kind: ScrubCorrupt, Path: r.StoredPath, Checksum: r.Checksum, Detail: fmt.Sprintf("%s checksum is %s", algorithm, sum)}
+	}
+	return nil
+}
+
+// reimportOrphan adds an orphan to the database where it is
+// Orphans that are copies of a file the database already has become duplicates
+// instead. Orphans that were deleted with reject are never added back: they
+// are left over from a delete that couldn't remove the file, which is retried.
+func (e *Engine) reimportOrphan(issue *ScrubIssue) {
+	m, err := LoadMediaFile(issue.Path)
+	if err != nil {
+		issue.Detail = fmt.Sprintf("reimport failed: %v", err)
+		return
+	}
+	m.HashAlgorithm = e.Config.Server.HashAlgorithm
+	if err := m.SetChecksum(); err != nil {
+		issue.Detail = fmt.Sprintf("reimport failed: %v", err)
+		return
+	}
+	issue.Checksum = m.Checksum
+	if e.DB.ChecksumRejected(m.Checksum, m.HashAlgorithm) {
+		issue.Kind = ScrubRejected
+		if err := e.removeRejectedFile(issue.Path); err != nil {
+			issue.Detail = fmt.Sprintf("rejected, but could not be removed: %v", err)
+			return
+		}
+		issue.Detail = "deleted with reject"
+		issue.Action = "removed"
+		return
+	}
+	if e.DB.ChecksumExists(m.Checksum) {
+		issue.Kind = ScrubDuplicate
+		issue.Detail = "same checksum as a file already in the library"
+		return
+	}
+	m.StoredPath = issue.Path
+	if err := e.DB.AddFileToDB(m); err != nil {
+		issue.Detail = fmt.Sprintf("reimport failed: %v", err)
+		return
+	}
+	issue.Action = "reimported"
+}
+
+// quarantineIssue moves an issue's file to the quarantine directory
+func (e *Engine) quarantineIssue(issue *ScrubIssue, saveDir string, quarantineDir string) {
+	if err := quarantineFile(issue.Path, saveDir, quarantineDir); err != nil {
+		issue.Detail = strings.TrimPrefix(issue.Detail+"; ", "; ") + fmt.Sprintf("quarantine failed: %v", err)
+		return
+	}
+	issue.Action = "quarantined"
+}
+
+// quarantineFile moves path to the same relative location under quarantineDir
+func quarantineFile(path string, saveDir string, quarantineDir string) error {
+	rel, err := filepath.Rel(saveDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%s is not under %s", path, saveDir)
+	}
+	target := filepath.Join(quarantineDir, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, target)
+}
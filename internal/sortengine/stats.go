@@ -0,0 +1,110 @@
+package sortengine
+
+// Library statistics
+// LibraryStats summarizes the media table with aggregate queries, so it stays
+// cheap on large libraries: nothing is read per row in Go.
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MediaCount is the number and total size of a group of files
+type MediaCount struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// LibraryStats describes everything stored in the library
+type LibraryStats struct {
+	Total        MediaCount            `json:"total"`
+	ByType       map[string]MediaCount `json:"by_type"`        // "image", "video" or "other", by extension
+	ByYear       map[string]MediaCount `json:"by_year"`        // "2006", by creation date
+	ByMonth      map[string]MediaCount `json:"by_month"`       // "2006-01", by creation date
+	LastUploadAt *time.Time            `json:"last_upload_at"` // nil if nothing was uploaded since uploaded_at was added
+}
+
+// unknownDate groups files whose creation date is missing
+const unknownDate = "unknown"
+
+// LibraryStats counts the stored files in total, by type and by creation
+// year and month, and finds the most recent upload
+func (d *DB) LibraryStats() (*LibraryStats, error) {
+	stats := &LibraryStats{
+		ByType:  make(map[string]MediaCount),
+		ByYear:  make(map[string]MediaCount),
+		ByMonth: make(map[string]MediaCount),
+	}
+
+	var lastUpload sql.NullInt64
+	err := d.db.QueryRow("SELECT count(*), coalesce(sum(size), 0), max(uploaded_at) FROM media").Scan(&stats.Total.Count, &stats.Total.Bytes, &lastUpload)
+	if err != nil {
+		return nil, fmt.Errorf("error counting media: %v", err)
+	}
+	if lastUpload.Valid {
+		t := time.Unix(lastUpload.Int64, 0)
+		stats.LastUploadAt = &t
+	}
+
+	// The type comes from the extension, as MediaType does. LIKE is
+	// case-insensitive for ASCII, which is what extensions need.
+	if err := d.countMediaBy(mediaTypeExpr(), stats.ByType); err != nil {
+		return nil, err
+	}
+
+	// create_date is stored as text ("2006-01-02 15:04:05 ..."), so the month
+	// is its first seven characters
+	month := fmt.Sprintf("coalesce(nullif(substr(create_date, 1, 7), ''), '%s')", unknownDate)
+	if err := d.countMediaBy(month, stats.ByMonth); err != nil {
+		return nil, err
+	}
+	for month, count := range stats.ByMonth {
+		year := month
+		if month != unknownDate && len(month) >= 4 {
+			year = month[:4]
+		}
+		total := stats.ByYear[year]
+		total.Count += count.Count
+		total.Bytes += count.Bytes
+		stats.ByYear[year] = total
+	}
+
+	return stats, nil
+}
+
+// countMediaBy groups the media table by a SQL expression and stores the
+// count and size of each group in counts
+func (d *DB) countMediaBy(expr string, counts map[string]MediaCount) error {
+	rows, err := d.db.Query("SELECT " + expr + " AS grp, count(*), coalesce(sum(size), 0) FROM media GROUP BY grp")
+	if err != nil {
+		return fmt.Errorf("error counting media: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var group string
+		var count MediaCount
+		if err := rows.Scan(&group, &count.Count, &count.Bytes); err != nil {
+			return fmt.Errorf("error reading media counts: %v", err)
+		}
+		counts[group] = count
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading media counts: %v", err)
+	}
+	return nil
+}
+
+// mediaTypeExpr returns a SQL expression giving a row's media type from the
+// extension of its filename
+func mediaTypeExpr() string {
+	match := func(extensions []string) string {
+		var likes []string
+		for _, ext := range extensions {
+			likes = append(likes, fmt.Sprintf("filename LIKE '%%.%s'", ext))
+		}
+		return strings.Join(likes, " OR ")
+	}
+	return fmt.Sprintf("CASE WHEN %s THEN 'image' WHEN %s THEN 'video' ELSE 'other' END", match(ImageExtensions), match(VideoExtensions))
+}
@@ -0,0 +1,162 @@
+package sortengine
+
+// API tokens
+// Each person or household uploading to the server gets a named token. Only a
+// SHA-256 hash of the token is stored, in the settings table under
+// "token:<hash>", so a copy of the database doesn't give anyone access. The
+// token itself is shown once when it is created.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tokenSettingPrefix marks token rows in the settings table
+const tokenSettingPrefix = "token:"
+
+// TokenInfo describes a token without revealing it
+type TokenInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HashToken returns the form a token is stored and looked up in
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateToken returns a new random token
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// AddToken creates a token for name and returns it
+// This is the only time the token is available; it can't be recovered later
+func (d *DB) AddToken(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("token name must not be empty")
+	}
+
+	tokens, err := d.ListTokens()
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tokens {
+		if t.Name == name {
+			return "", fmt.Errorf("a token named %q already exists", name)
+		}
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	value, err := json.Marshal(TokenInfo{Name: name, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return "", fmt.Errorf("error encoding token: %v", err)
+	}
+	_, err = d.db.Exec("INSERT INTO settings (setting, value) VALUES (?, ?)", tokenSettingPrefix+HashToken(token), string(value))
+	if err != nil {
+		return "", fmt.Errorf("error storing token: %v", err)
+	}
+	return token, nil
+}
+
+// RevokeToken deletes the token with the given name
+func (d *DB) RevokeToken(name string) error {
+	rows, err := d.tokenRows()
+	if err != nil {
+		return err
+	}
+	for setting, info := range rows {
+		if info.Name != name {
+			continue
+		}
+		if _, err := d.db.Exec("DELETE FROM settings WHERE setting = ?", setting); err != nil {
+			return fmt.Errorf("error revoking token %q: %v", name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no token named %q", name)
+}
+
+// ListTokens returns every token, sorted by name
+func (d *DB) ListTokens() ([]TokenInfo, error) {
+	rows, err := d.tokenRows()
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]TokenInfo, 0, len(rows))
+	for _, info := range rows {
+		tokens = append(tokens, info)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens, nil
+}
+
+// LookupToken returns the name of a token, or "" if it isn't valid
+func (d *DB) LookupToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	var value string
+	err := d.db.QueryRow("SELECT value FROM settings WHERE setting = ?", tokenSettingPrefix+HashToken(token)).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error looking up token: %v", err)
+	}
+	var info TokenInfo
+	if err := json.Unmarshal([]byte(value), &info); err != nil {
+		return "", fmt.Errorf("error decoding token: %v", err)
+	}
+	return info.Name, nil
+}
+
+// TokenCount returns how many tokens exist
+func (d *DB) TokenCount() (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT count(*) FROM settings WHERE setting LIKE ?", tokenSettingPrefix+"%").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting tokens: %v", err)
+	}
+	return count, nil
+}
+
+// tokenRows returns every token row keyed by its setting name
+func (d *DB) tokenRows() (map[string]TokenInfo, error) {
+	rows, err := d.db.Query("SELECT setting, value FROM settings WHERE setting LIKE ?", tokenSettingPrefix+"%")
+	if err != nil {
+		return nil, fmt.Errorf("error reading tokens: %v", err)
+	}
+	defer rows.Close()
+
+	tokens := make(map[string]TokenInfo)
+	for rows.Next() {
+		var setting, value string
+		if err := rows.Scan(&setting, &value); err != nil {
+			return nil, fmt.Errorf("error reading token row: %v", err)
+		}
+		var info TokenInfo
+		if err := json.Unmarshal([]byte(value), &info); err != nil {
+			return nil, fmt.Errorf("error decoding token %s: %v", setting, err)
+		}
+		tokens[setting] = info
+	}
+	return tokens, rows.Err()
+}
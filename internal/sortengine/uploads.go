@@ -0,0 +1,220 @@
+package sortengine
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Chunked uploads let large files be sent in pieces that can be resumed after
+// a dropped connection. The server keeps one upload session per checksum in the
+// upload_sessions table; received data goes to a .download temp file under
+// SaveDir/.uploads and the byte ranges written so far are recorded with the
+// session, so both sides can work out what is still missing after a restart.
+
+// UploadsDirName is the directory under SaveDir holding chunked upload temp files
+const UploadsDirName = ".uploads"
+
+// ByteRange is a half-open range of bytes [Start, End)
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// UploadSession is a chunked upload in progress
+type UploadSession struct {
+	ID        string      `json:"upload_id"`
+	Checksum  string      `json:"checksum"`
+	Size      int64       `json:"size"`
+	Media     Media       `json:"-"` // What the client sent when it started the upload
+	TempPath  string      `json:"-"`
+	Received  []ByteRange `json:"received"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// NewUploadID returns a random identifier for an upload session
+func NewUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("unable to generate upload id: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// UploadTempPath returns where the data for an upload session is written
+func UploadTempPath(saveDir string, id string) string {
+	return filepath.Join(saveDir, UploadsDirName, id+".download")
+}
+
+// AddByteRange merges r into a sorted list of non-overlapping ranges
+func AddByteRange(ranges []ByteRange, r ByteRange) []ByteRange {
+	if r.End <= r.Start {
+		return ranges
+	}
+	all := append(append(make([]ByteRange, 0, len(ranges)+1), ranges...), r)
+	sort.Slice(all, func(i, j int) bool { return all[i].Start < all[j].Start })
+
+	merged := make([]ByteRange, 0, len(all))
+	for _, cur := range all {
+		last := len(merged) - 1
+		if last >= 0 && cur.Start <= merged[last].End {
+			if cur.End > merged[last].End {
+				merged[last].End = cur.End
+			}
+			continue
+		}
+		merged = append(merged, cur)
+	}
+	return merged
+}
+
+// MissingByteRanges returns the parts of [0, size) not covered by ranges
+// ranges must be sorted and non-overlapping, as returned by AddByteRange
+func MissingByteRanges(ranges []ByteRange, size int64) []ByteRange {
+	missing := make([]ByteRange, 0)
+	var pos int64
+	for _, r := range ranges {
+		if r.Start > pos {
+			missing = append(missing, ByteRange{Start: pos, End: r.Start})
+		}
+		if r.End > pos {
+			pos = r.End
+		}
+	}
+	if pos < size {
+		missing = append(missing, ByteRange{Start: pos, End: size})
+	}
+	return missing
+}
+
+// BytesReceived returns how many bytes of the file the server has
+func (s *UploadSession) BytesReceived() int64 {
+	var total int64
+	for _, r := range s.Received {
+		total += r.End - r.Start
+	}
+	return total
+}
+
+// Complete reports whether every byte of the file has been received
+func (s *UploadSession) Complete() bool {
+	return len(MissingByteRanges(s.Received, s.Size)) == 0
+}
+
+// CreateUploadSession records a new upload session
+func (d *DB) CreateUploadSession(s *UploadSession) error {
+	mediaJSON, err := json.Marshal(s.Media)
+	if err != nil {
+		return fmt.Errorf("error marshalling media: %v", err)
+	}
+	receivedJSON, err := json.Marshal(s.Received)
+	if err != nil {
+		return fmt.Errorf("error marshalling received ranges: %v", err)
+	}
+	_, err = d.db.Exec(
+		"INSERT INTO upload_sessions (id, checksum, size, media, temp_path, received, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		s.ID, s.Checksum, s.Size, string(mediaJSON), s.TempPath, string(receivedJSON), s.CreatedAt.Unix(), s.UpdatedAt.Unix(),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating upload session: %v", err)
+	}
+	return nil
+}
+
+const uploadSessionColumns = "id, checksum, size, media, temp_path, received, created_at, updated_at"
+
+func scanUploadSession(row interface{ Scan(...interface{}) error }) (*UploadSession, error) {
+	var s UploadSession
+	var mediaJSON, receivedJSON string
+	var createdAt, updatedAt int64
+	if err := row.Scan(&s.ID, &s.Checksum, &s.Size, &mediaJSON, &s.TempPath, &receivedJSON, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(mediaJSON), &s.Media); err != nil {
+		return nil, fmt.Errorf("invalid media for upload %s: %v", s.ID, err)
+	}
+	if err := json.Unmarshal([]byte(receivedJSON), &s.Received); err != nil {
+		return nil, fmt.Errorf("invalid received ranges for upload %s: %v", s.ID, err)
+	}
+	if s.Received == nil {
+		s.Received = make([]ByteRange, 0)
+	}
+	s.CreatedAt = time.Unix(createdAt, 0)
+	s.UpdatedAt = time.Unix(updatedAt, 0)
+	return &s, nil
+}
+
+// GetUploadSession looks up an upload session by id
+// It returns nil without an error if there is no such session
+func (d *DB) GetUploadSession(id string) (*UploadSession, error) {
+	s, err := scanUploadSession(d.db.QueryRow("SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading upload session: %v", err)
+	}
+	return s, nil
+}
+
+// FindUploadSession looks up the upload session for a checksum, so a client
+// that starts over after a crash picks up where it left off
+// It returns nil without an error if there is no such session
+func (d *DB) FindUploadSession(checksum string) (*UploadSession, error) {
+	s, err := scanUploadSession(d.db.QueryRow("SELECT "+uploadSessionColumns+" FROM upload_sessions WHERE checksum = ?", checksum))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading upload session: %v", err)
+	}
+	return s, nil
+}
+
+// UploadSessions returns every upload session in progress
+func (d *DB) UploadSessions() ([]*UploadSession, error) {
+	rows, err := d.db.Query("SELECT " + uploadSessionColumns + " FROM upload_sessions")
+	if err != nil {
+		return nil, fmt.Errorf("error querying upload sessions: %v", err)
+	}
+	defer rows.Close()
+
+	sessions := make([]*UploadSession, 0)
+	for rows.Next() {
+		s, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading upload session: %v", err)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// SetUploadReceived records the byte ranges received for an upload session
+func (d *DB) SetUploadReceived(id string, received []ByteRange) error {
+	receivedJSON, err := json.Marshal(received)
+	if err != nil {
+		return fmt.Errorf("error marshalling received ranges: %v", err)
+	}
+	_, err = d.db.Exec("UPDATE upload_sessions SET received = ?, updated_at = ? WHERE id = ?", string(receivedJSON), time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("error updating upload session: %v", err)
+	}
+	return nil
+}
+
+// DeleteUploadSession removes an upload session
+// The caller is responsible for removing its temp file
+func (d *DB) DeleteUploadSession(id string) error {
+	if _, err := d.db.Exec("DELETE FROM upload_sessions WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error deleting upload session: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package sortengine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddByteRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []ByteRange
+		add    ByteRange
+		want   []ByteRange
+	}{
+		{"first", nil, ByteRange{0, 10}, []ByteRange{{0, 10}}},
+		{"empty range ignored", []ByteRange{{0, 10}}, ByteRange{5, 5}, []ByteRange{{0, 10}}},
+		{"inverted range ignored", []ByteRange{{0, 10}}, ByteRange{8, 2}, []ByteRange{{0, 10}}},
+		{"disjoint after", []ByteRange{{0, 10}}, ByteRange{20, 30}, []ByteRange{{0, 10}, {20, 30}}},
+		{"disjoint before", []ByteRange{{20, 30}}, ByteRange{0, 10}, []ByteRange{{0, 10}, {20, 30}}},
+		{"adjacent merges", []ByteRange{{0, 10}}, ByteRange{10, 20}, []ByteRange{{0, 20}}},
+		{"overlap merges", []ByteRange{{0, 10}}, ByteRange{5, 15}, []ByteRange{{0, 15}}},
+		{"contained", []ByteRange{{0, 10}}, ByteRange{2, 8}, []ByteRange{{0, 10}}},
+		{"fills gap", []ByteRange{{0, 10}, {20, 30}}, ByteRange{10, 20}, []ByteRange{{0, 30}}},
+		{"covers several", []ByteRange{{5, 10}, {20, 30}, {40, 50}}, ByteRange{0, 45}, []ByteRange{{0, 50}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := append([]ByteRange(nil), tt.ranges...)
+			got := AddByteRange(tt.ranges, tt.add)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AddByteRange(%v, %v) = %v, want %v", tt.ranges, tt.add, got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.ranges, before) {
+				t.Errorf("AddByteRange modified its input: %v, was %v", tt.ranges, before)
+			}
+		})
+	}
+}
+
+func TestMissingByteRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []ByteRange
+		size   int64
+		want   []ByteRange
+	}{
+		{"nothing received", nil, 100, []ByteRange{{0, 100}}},
+		{"everything received", []ByteRange{{0, 100}}, 100, []ByteRange{}},
+		{"start missing", []ByteRange{{50, 100}}, 100, []ByteRange{{0, 50}}},
+		{"end missing", []ByteRange{{0, 50}}, 100, []ByteRange{{50, 100}}},
+		{"gaps", []ByteRange{{10, 20}, {30, 40}}, 50, []ByteRange{{0, 10}, {20, 30}, {40, 50}}},
+		{"empty file", nil, 0, []ByteRange{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MissingByteRanges(tt.ranges, tt.size)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MissingByteRanges(%v, %d) = %v, want %v", tt.ranges, tt.size, got, tt.want)
+			}
+		})
+	}
+}